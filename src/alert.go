@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alert states
+const (
+	AlertPending  = "pending"  // The condition is met but has not been met for long enough
+	AlertFiring   = "firing"   // The condition has been met for the required duration
+	AlertResolved = "resolved" // The value has recovered past the threshold and hysteresis
+)
+
+// AlertRule defines a threshold condition that is evaluated against every measurement.
+type AlertRule struct {
+	Name       string  `json:"name"`       // Name of the rule
+	Condition  string  `json:"condition"`  // Condition, e.g. "moisture < 30 for 20m"
+	Hysteresis float64 `json:"hysteresis"` // Amount the value must recover past the threshold before the alert resolves
+}
+
+// AlertCondition holds a parsed alert rule condition.
+type AlertCondition struct {
+	Field     string        // Measurement field to evaluate
+	Operator  string        // Comparison operator (<, <=, > or >=)
+	Threshold float64       // Threshold value
+	For       time.Duration // Time the condition must hold before the alert fires
+}
+
+// Alert holds the current state of an alert rule.
+type Alert struct {
+	Rule       string    `json:"rule"`       // Name of the rule that raised the alert
+	Condition  string    `json:"condition"`  // Condition of the rule
+	State      string    `json:"state"`      // Current state (pending, firing or resolved)
+	Value      float64   `json:"value"`      // Last value evaluated
+	Message    string    `json:"message"`    // Description of the alert
+	Since      time.Time `json:"since"`      // Time the condition was first met
+	FiredAt    time.Time `json:"firedAt"`    // Time the alert started firing
+	ResolvedAt time.Time `json:"resolvedAt"` // Time the alert was resolved
+	UpdatedAt  time.Time `json:"updatedAt"`  // Time the alert was last evaluated
+	External   bool      `json:"external"`   // Alert is raised and cleared by a module rather than a configured rule
+}
+
+// ParseCondition parses the rule condition.
+// The condition takes the form "<field> <operator> <threshold> [for <duration>]".
+func (r *AlertRule) ParseCondition() (AlertCondition, error) {
+	c := AlertCondition{}
+	f := strings.Fields(r.Condition)
+	if len(f) != 3 && len(f) != 5 {
+		return c, errors.New("condition '" + r.Condition + "' must be in the form '<field> <operator> <threshold> [for <duration>]'")
+	}
+
+	m := Measurement{}
+	if _, ok := m.Value(f[0]); !ok {
+		return c, errors.New("unknown field '" + f[0] + "'")
+	}
+	c.Field = f[0]
+
+	switch f[1] {
+	case "<", "<=", ">", ">=":
+		c.Operator = f[1]
+	default:
+		return c, errors.New("unknown operator '" + f[1] + "'")
+	}
+
+	t, err := strconv.ParseFloat(f[2], 64)
+	if err != nil {
+		return c, errors.New("invalid threshold '" + f[2] + "'")
+	}
+	c.Threshold = t
+
+	if len(f) == 5 {
+		if strings.ToLower(f[3]) != "for" {
+			return c, errors.New("expected 'for' but found '" + f[3] + "'")
+		}
+		d, err := time.ParseDuration(f[4])
+		if err != nil {
+			return c, errors.New("invalid duration '" + f[4] + "'")
+		}
+		c.For = d
+	}
+	return c, nil
+}
+
+// IsMet returns whether the value meets the condition.
+func (c *AlertCondition) IsMet(v float64) bool {
+	switch c.Operator {
+	case "<":
+		return v < c.Threshold
+	case "<=":
+		return v <= c.Threshold
+	case ">":
+		return v > c.Threshold
+	case ">=":
+		return v >= c.Threshold
+	}
+	return false
+}
+
+// IsRecovered returns whether the value has moved far enough past the
+// threshold, by the hysteresis amount, for a firing alert to resolve.
+func (c *AlertCondition) IsRecovered(v float64, hysteresis float64) bool {
+	if hysteresis < 0 {
+		hysteresis = 0
+	}
+	switch c.Operator {
+	case "<", "<=":
+		return v >= c.Threshold+hysteresis
+	case ">", ">=":
+		return v <= c.Threshold-hysteresis
+	}
+	return true
+}
+
+// IsActive returns whether the alert is pending or firing.
+func (a *Alert) IsActive() bool {
+	return a.State == AlertPending || a.State == AlertFiring
+}
+
+// Serialize serializes the entity and returns the serialized string
+func (a *Alert) Serialize() (string, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// String returns a short description of the alert.
+func (a *Alert) String() string {
+	return fmt.Sprintf("%s (%s) is %s, value %.1f", a.Rule, a.Condition, a.State, a.Value)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCanParseAlertCondition(t *testing.T) {
+	r := AlertRule{Condition: "moisture < 30 for 20m"}
+	c, err := r.ParseCondition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Field != "moisture" || c.Operator != "<" || c.Threshold != 30 || c.For != 20*time.Minute {
+		t.Error("Condition was not parsed correctly.", c)
+	}
+
+	r = AlertRule{Condition: "leaves > 3"}
+	if _, err := r.ParseCondition(); err == nil {
+		t.Error("Unknown field was accepted.")
+	}
+}
+
+func TestAlertStateMachine(t *testing.T) {
+	s := newTestServer(&Config{
+		AlertRules: []AlertRule{{Name: "dry", Condition: "moisture < 30 for 20m", Hysteresis: 5}},
+	})
+	a := AlertManager{Srv: s}
+	st := time.Now()
+
+	a.Evaluate(Measurement{Moisture: 29, DateMeasured: st})
+	if l := a.Active(); len(l) != 1 || l[0].State != AlertPending {
+		t.Fatal("Alert is not pending.", l)
+	}
+	a.Evaluate(Measurement{Moisture: 28, DateMeasured: st.Add(20 * time.Minute)})
+	if l := a.Active(); len(l) != 1 || l[0].State != AlertFiring {
+		t.Fatal("Alert is not firing.", l)
+	}
+	a.Evaluate(Measurement{Moisture: 32, DateMeasured: st.Add(25 * time.Minute)})
+	if l := a.Active(); len(l) != 1 || l[0].State != AlertFiring {
+		t.Fatal("Alert resolved within the hysteresis band.", l)
+	}
+	a.Evaluate(Measurement{Moisture: 36, DateMeasured: st.Add(30 * time.Minute)})
+	if l := a.All(); len(l) != 1 || l[0].State != AlertResolved {
+		t.Fatal("Alert is not resolved.", l)
+	}
+}
+
+func TestRaiseSavesOnlyChanges(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "soilmonitor")
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "alerts.json")
+	a := AlertManager{Srv: newTestServer(&Config{}), FilePath: p}
+
+	a.Raise("frost", "Frost expected", 1.5)
+	if st, err := os.Stat(p); err != nil || st.Mode().Perm() != 0644 {
+		t.Fatal("Expected the alert to be saved", err)
+	}
+	os.Remove(p)
+	a.Raise("frost", "Frost expected", 1.2)
+	if _, err := os.Stat(p); err == nil {
+		t.Error("Expected an alert that is still firing not to be saved again")
+	}
+	a.Clear("frost", 4)
+	if _, err := os.Stat(p); err != nil {
+		t.Error("Expected the cleared alert to be saved", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// AlertController handles the Web Methods for reading the alerts.
+type AlertController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *AlertController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/alerts").Name("GetAlerts").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetAlerts)))
+}
+
+func (c *AlertController) handleGetAlerts(w http.ResponseWriter, r *http.Request) {
+	l := AlertList{}
+	if r.URL.Query().Get("all") == "true" {
+		l.Alerts = c.Srv.Alerts.All()
+	} else {
+		l.Alerts = c.Srv.Alerts.Active()
+	}
+	if err := l.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing alerts. "+err.Error(), 500)
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *AlertController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("AlertController", LevelInfo, a)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// AlertList holds a list of alerts
+type AlertList struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+// ReadFromFile will read the alert list from the specified file
+func (l *AlertList) ReadFromFile(path string) error {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &l)
+}
+
+// WriteToFile will write the alert list to the specified file.
+// The file is replaced in one step so that it is never left half written.
+func (l *AlertList) WriteToFile(path string) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (l *AlertList) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
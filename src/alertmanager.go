@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AlertManager evaluates the configured alert rules against each measurement
+// and keeps track of the state of the alerts.
+type AlertManager struct {
+	Srv      *Server           // Server instance
+	FilePath string            // Path of the file used to persist the alert state
+	alerts   map[string]*Alert // Alerts keyed by rule name
+	lock     sync.Mutex        // Guards the alerts
+}
+
+// Load reads the persisted alert state from the file.
+func (a *AlertManager) Load() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.alerts = map[string]*Alert{}
+	if a.FilePath == "" {
+		return nil
+	}
+	l := AlertList{}
+	if err := l.ReadFromFile(a.FilePath); err != nil {
+		return err
+	}
+	for i := range l.Alerts {
+		al := l.Alerts[i]
+		a.alerts[al.Rule] = &al
+	}
+	return nil
+}
+
+// Evaluate evaluates every configured rule against the measurement and
+// moves the alerts through the pending, firing and resolved states.
+func (a *AlertManager) Evaluate(v Measurement) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.alerts == nil {
+		a.alerts = map[string]*Alert{}
+	}
+	now := v.DateMeasured
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	changed := false
+	rules := map[string]bool{}
+	for _, r := range a.Srv.Config().AlertRules {
+		c, err := r.ParseCondition()
+		if err != nil {
+			a.logError("Invalid condition for rule.", "rule", r.Name, "error", err)
+			continue
+		}
+		rules[r.Name] = true
+		val, ok := v.Value(c.Field)
+		if !ok {
+			// The reading was not taken, so leave the alert as it is
+			continue
+		}
+		met := c.IsMet(val)
+
+		al := a.alerts[r.Name]
+		if al == nil || !al.IsActive() {
+			if !met {
+				if al != nil {
+					al.Value = val
+					al.UpdatedAt = now
+				}
+				continue
+			}
+			al = &Alert{
+				Rule:  r.Name,
+				State: AlertPending,
+				Since: now,
+			}
+			a.alerts[r.Name] = al
+			a.logInfo("Alert ", r.Name, " is pending.")
+			a.notify(*al)
+			changed = true
+		}
+		al.Condition = r.Condition
+		al.Value = val
+		al.UpdatedAt = now
+		al.Message = fmt.Sprintf("%s %s %g (value %.1f)", c.Field, c.Operator, c.Threshold, val)
+
+		switch al.State {
+		case AlertPending:
+			if !met {
+				// The condition did not hold for long enough
+				a.logInfo("Alert ", r.Name, " is no longer pending.")
+				al.State = AlertResolved
+				al.ResolvedAt = now
+				a.notify(*al)
+				delete(a.alerts, r.Name)
+				changed = true
+			} else if now.Sub(al.Since) >= c.For {
+				al.State = AlertFiring
+				al.FiredAt = now
+				a.logInfo("Alert ", al.String())
+				a.notify(*al)
+				changed = true
+			}
+		case AlertFiring:
+			if c.IsRecovered(val, r.Hysteresis) {
+				al.State = AlertResolved
+				al.ResolvedAt = now
+				a.logInfo("Alert ", al.String())
+				a.notify(*al)
+				changed = true
+			}
+		}
+	}
+
+	// Remove the alerts for rules that no longer exist
+	for n, al := range a.alerts {
+		if !al.External && !rules[n] {
+			delete(a.alerts, n)
+			changed = true
+		}
+	}
+
+	if changed {
+		a.save()
+	}
+}
+
+// Raise raises an alert that is not driven by a configured rule.
+// The alert fires immediately and keeps firing until it is cleared.
+func (a *AlertManager) Raise(name string, msg string, value float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.alerts == nil {
+		a.alerts = map[string]*Alert{}
+	}
+	now := time.Now()
+	al := a.alerts[name]
+	isNew := al == nil || !al.IsActive()
+	if isNew {
+		al = &Alert{
+			Rule:     name,
+			State:    AlertFiring,
+			Since:    now,
+			FiredAt:  now,
+			External: true,
+		}
+		a.alerts[name] = al
+	}
+	al.Message = msg
+	al.Value = value
+	al.UpdatedAt = now
+	if isNew {
+		// Only a change of state is saved, not every new value
+		a.logInfo("Alert ", al.String(), ". ", msg)
+		a.notify(*al)
+		a.save()
+	}
+}
+
+// Clear resolves an alert that was raised using Raise.
+func (a *AlertManager) Clear(name string, value float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	al := a.alerts[name]
+	if al == nil || !al.IsActive() {
+		return
+	}
+	now := time.Now()
+	al.State = AlertResolved
+	al.ResolvedAt = now
+	al.UpdatedAt = now
+	al.Value = value
+	a.logInfo("Alert ", al.String())
+	a.notify(*al)
+	a.save()
+}
+
+// Active returns the list of pending and firing alerts.
+func (a *AlertManager) Active() []Alert {
+	return a.list(false)
+}
+
+// All returns the list of all the alerts, including the resolved alerts.
+func (a *AlertManager) All() []Alert {
+	return a.list(true)
+}
+
+func (a *AlertManager) list(all bool) []Alert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	l := []Alert{}
+	for _, al := range a.alerts {
+		if all || al.IsActive() {
+			l = append(l, *al)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Since.Before(l[j].Since)
+	})
+	return l
+}
+
+// notify shows the firing alert on the display and publishes the alert state change.
+func (a *AlertManager) notify(al Alert) {
+	a.Srv.Events.Publish(EventAlert, al)
+	if a.Srv.LCD != nil {
+		n := "ALERT:" + al.Rule
+		if al.State == AlertFiring {
+			a.Srv.LCD.ShowAlert(n, al.Rule, fmt.Sprintf("%.1f", al.Value))
+		} else if al.State == AlertResolved {
+			a.Srv.LCD.RemoveItem(n)
+		}
+	}
+	if a.Srv.MqttClient == nil {
+		return
+	}
+	a.Srv.MqttClient.Async(func() {
+		if err := a.Srv.MqttClient.SendAlert(al); err != nil {
+			a.logError("Error sending alert to MQTT broker.", "error", err)
+		}
+	})
+}
+
+// save writes the alert state to the file.  The lock must be held.
+func (a *AlertManager) save() {
+	if a.FilePath == "" {
+		return
+	}
+	l := AlertList{Alerts: []Alert{}}
+	for _, al := range a.alerts {
+		l.Alerts = append(l.Alerts, *al)
+	}
+	if err := l.WriteToFile(a.FilePath); err != nil {
+		a.logError("Error saving alert state.", "error", err)
+	}
+}
+
+func (a *AlertManager) logDebug(v ...interface{}) {
+	s := fmt.Sprint(v...)
+	logEntry("AlertManager", LevelDebug, s)
+}
+
+func (a *AlertManager) logInfo(v ...interface{}) {
+	s := fmt.Sprint(v...)
+	logEntry("AlertManager", LevelInfo, s)
+}
+
+func (a *AlertManager) logError(msg string, kv ...interface{}) {
+	logEntry("AlertManager", LevelError, msg, kv...)
+}
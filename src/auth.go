@@ -0,0 +1,594 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Authentication roles
+const (
+	RoleRead  = "read"  // Can read the measurements and history
+	RoleAdmin = "admin" // Can also change the configuration, irrigation and calibration
+)
+
+const sessionCookie = "soilmonitor_session" // Name of the login session cookie
+
+// passwordIterations is the number of PBKDF2 iterations used to hash new passwords.
+var passwordIterations = 100000
+
+// Authentication errors
+var (
+	ErrNotAuthenticated  = errors.New("authentication is required")
+	ErrInvalidLogin      = errors.New("user name or password is not valid")
+	ErrTooManyAttempts   = errors.New("too many failed attempts, try again later")
+	ErrInvalidRole       = errors.New("role must be '" + RoleRead + "' or '" + RoleAdmin + "'")
+	ErrNameAlreadyExists = errors.New("name is already in use")
+	ErrNameNotFound      = errors.New("name was not found")
+)
+
+// publicRoutes are the routes that can be used without logging in.
+var publicRoutes = map[string]bool{
+	"Assets":    true,
+	"LoginPage": true,
+	"Login":     true,
+	"Logout":    true,
+	"WhoAmI":    true,
+	"GetHealth": true,
+	"GetReady":  true,
+}
+
+// adminReadRoutes are the read-only routes that disclose the configuration or
+// the logs, so need the admin role.
+var adminReadRoutes = map[string]bool{
+	"ConfigWebPage":   true,
+	"GetConfig":       true,
+	"GetConfigAPI":    true,
+	"GetConfigStatus": true,
+	"GetLogs":         true,
+}
+
+// AuthManager authenticates the requests made to the web server.
+// Machines use API tokens passed in the Authorization header, and people log
+// in to the web pages with a user name and password to get a session cookie.
+// Authentication is optional: it is switched on once a token or user is added.
+type AuthManager struct {
+	FilePath       string                    // Path of the file holding the tokens and users
+	SessionTimeout int                       // Time (in minutes) a login session lasts without being used.  Defaults to 12 hours.
+	MaxAttempts    int                       // Number of failed attempts before a client is locked out.  Defaults to 5.
+	LockoutTime    int                       // Time (in minutes) a client is locked out for.  Defaults to 15 minutes.
+	State          AuthState                 // The tokens and users
+	sessions       map[string]*authSession   // Login sessions, keyed by session ID
+	failures       map[string]*loginFailures // Failed attempts, keyed by client address
+	modTime        time.Time                 // Modification time of the file when it was loaded
+	checked        time.Time                 // Time the file was last checked for changes
+	lock           sync.Mutex                // Guards the state
+}
+
+// AuthState holds the tokens and users persisted to the file.
+type AuthState struct {
+	Tokens []AuthToken `json:"tokens"` // API tokens
+	Users  []AuthUser  `json:"users"`  // Users that log in to the web pages
+}
+
+// AuthToken holds an API token.  Only the hash of the token is kept.
+type AuthToken struct {
+	Name    string    `json:"name"`    // Name of the token
+	Role    string    `json:"role"`    // Role granted by the token
+	Hash    string    `json:"hash"`    // SHA-256 hash of the token
+	Created time.Time `json:"created"` // Time the token was created
+}
+
+// AuthUser holds a user that logs in to the web pages.
+type AuthUser struct {
+	Name       string `json:"name"`       // User name
+	Role       string `json:"role"`       // Role of the user
+	Salt       string `json:"salt"`       // Salt used to hash the password
+	Hash       string `json:"hash"`       // PBKDF2-SHA256 hash of the password
+	Iterations int    `json:"iterations"` // Number of PBKDF2 iterations
+}
+
+// AuthIdentity holds who made a request.
+type AuthIdentity struct {
+	Name    string `json:"name"`    // Name of the user or token
+	Role    string `json:"role"`    // Role of the user or token
+	Enabled bool   `json:"enabled"` // Authentication is switched on
+}
+
+// authSession holds a login session.
+type authSession struct {
+	user    string
+	expires time.Time
+}
+
+// loginFailures holds the failed attempts made by a client.
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// Load reads the tokens and users from the file.
+func (a *AuthManager) Load() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.load()
+}
+
+// IsEnabled returns whether authentication is switched on.
+func (a *AuthManager) IsEnabled() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.refresh()
+	return a.isEnabled()
+}
+
+// AddToken creates a new API token with the role and returns it.
+// The token is only returned once; only its hash is kept.
+func (a *AuthManager) AddToken(name string, role string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := validateAuthName(name, role); err != nil {
+		return "", err
+	}
+	a.refresh()
+	for _, t := range a.State.Tokens {
+		if t.Name == name {
+			return "", ErrNameAlreadyExists
+		}
+	}
+	tok, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	a.State.Tokens = append(a.State.Tokens, AuthToken{
+		Name:    name,
+		Role:    role,
+		Hash:    hashToken(tok),
+		Created: time.Now(),
+	})
+	return tok, a.save()
+}
+
+// RevokeToken removes the API token.
+func (a *AuthManager) RevokeToken(name string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.refresh()
+	for i, t := range a.State.Tokens {
+		if t.Name == name {
+			a.State.Tokens = append(a.State.Tokens[:i], a.State.Tokens[i+1:]...)
+			return a.save()
+		}
+	}
+	return ErrNameNotFound
+}
+
+// SetUser adds the user, or changes the role and password of an existing user.
+func (a *AuthManager) SetUser(name string, role string, password string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := validateAuthName(name, role); err != nil {
+		return err
+	}
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	u := AuthUser{
+		Name:       name,
+		Role:       role,
+		Salt:       salt,
+		Iterations: passwordIterations,
+	}
+	u.Hash = hex.EncodeToString(pbkdf2SHA256([]byte(password), []byte(salt), u.Iterations, 32))
+
+	a.refresh()
+	for i := range a.State.Users {
+		if a.State.Users[i].Name == name {
+			a.State.Users[i] = u
+			return a.save()
+		}
+	}
+	a.State.Users = append(a.State.Users, u)
+	return a.save()
+}
+
+// DeleteUser removes the user.  Sessions of the user end with the next request.
+func (a *AuthManager) DeleteUser(name string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.refresh()
+	for i, u := range a.State.Users {
+		if u.Name == name {
+			a.State.Users = append(a.State.Users[:i], a.State.Users[i+1:]...)
+			return a.save()
+		}
+	}
+	return ErrNameNotFound
+}
+
+// Login checks the user name and password and starts a login session.
+// Returns the session ID.  Clients are locked out after too many failed attempts.
+func (a *AuthManager) Login(name string, password string, client string) (string, error) {
+	a.lock.Lock()
+	if a.isLockedOut(client) {
+		a.lock.Unlock()
+		return "", ErrTooManyAttempts
+	}
+	a.refresh()
+	user := AuthUser{}
+	for _, u := range a.State.Users {
+		if u.Name == name {
+			user = u
+		}
+	}
+	a.lock.Unlock()
+
+	// The password hash is slow, so is checked without holding the lock
+	ok := user.Name != "" && user.checkPassword(password)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !ok {
+		a.addFailure(client)
+		return "", ErrInvalidLogin
+	}
+	delete(a.failures, client)
+
+	id, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	if a.sessions == nil {
+		a.sessions = map[string]*authSession{}
+	}
+	a.sessions[id] = &authSession{user: name, expires: time.Now().Add(a.sessionTimeout())}
+	return id, nil
+}
+
+// Logout ends the login session.
+func (a *AuthManager) Logout(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.sessions, id)
+}
+
+// Authenticate returns who made the request, from the API token in the
+// Authorization header or the login session cookie.
+func (a *AuthManager) Authenticate(r *http.Request) (AuthIdentity, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.refresh()
+	id := AuthIdentity{Enabled: a.isEnabled()}
+	if !id.Enabled {
+		return id, nil
+	}
+	client := clientAddress(r)
+
+	if h := r.Header.Get("Authorization"); h != "" {
+		if a.isLockedOut(client) {
+			return id, ErrTooManyAttempts
+		}
+		if !strings.HasPrefix(h, "Bearer ") {
+			return id, ErrNotAuthenticated
+		}
+		hash := hashToken(strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")))
+		for _, t := range a.State.Tokens {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+				id.Name = t.Name
+				id.Role = t.Role
+				return id, nil
+			}
+		}
+		a.addFailure(client)
+		return id, ErrNotAuthenticated
+	}
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		s, ok := a.sessions[c.Value]
+		if ok && time.Now().Before(s.expires) {
+			for _, u := range a.State.Users {
+				if u.Name == s.user {
+					s.expires = time.Now().Add(a.sessionTimeout())
+					id.Name = u.Name
+					id.Role = u.Role
+					return id, nil
+				}
+			}
+		}
+		delete(a.sessions, c.Value)
+	}
+	return id, ErrNotAuthenticated
+}
+
+// Middleware checks that the request is authenticated and that the role allows
+// the route.  Web pages are redirected to the login page.
+func (a *AuthManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := requiredRole(r)
+		if need == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := a.Authenticate(r)
+		switch {
+		case !id.Enabled:
+			// Authentication is switched off
+		case err == ErrTooManyAttempts:
+			w.Header().Set("Retry-After", strconv.Itoa(a.lockoutTime()*60))
+			http.Error(w, "Too many failed attempts. Try again later.", 429)
+			return
+		case err != nil:
+			if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="SoilMonitor"`)
+			http.Error(w, "Authentication is required.", 401)
+			return
+		case !roleAllows(id.Role, need):
+			http.Error(w, "The '"+id.Role+"' role does not allow this request.", 403)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requiredRole returns the role needed for the request, or an empty string if the route is public.
+// Requests that make changes need the admin role.
+func requiredRole(r *http.Request) string {
+	name := ""
+	if rt := mux.CurrentRoute(r); rt != nil {
+		name = rt.GetName()
+	}
+	switch {
+	case publicRoutes[name]:
+		return ""
+	case adminReadRoutes[name]:
+		return RoleAdmin
+	case r.Method == "GET" || r.Method == "HEAD":
+		return RoleRead
+	}
+	return RoleAdmin
+}
+
+// roleAllows returns whether the role has the needed role.
+func roleAllows(role string, need string) bool {
+	return role == RoleAdmin || role == need
+}
+
+// load reads the tokens and users from the file.  The lock must be held.
+func (a *AuthManager) load() error {
+	a.checked = time.Now()
+	fi, err := os.Stat(a.FilePath)
+	if os.IsNotExist(err) {
+		a.State = AuthState{}
+		a.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(a.FilePath)
+	if err != nil {
+		return err
+	}
+	st := AuthState{}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+	a.State = st
+	a.modTime = fi.ModTime()
+	return nil
+}
+
+// refresh reloads the file if it has been changed, such as by the command line.
+// The file is checked at most every few seconds.  The lock must be held.
+func (a *AuthManager) refresh() {
+	if a.FilePath == "" || time.Since(a.checked) < 5*time.Second {
+		return
+	}
+	a.checked = time.Now()
+	fi, err := os.Stat(a.FilePath)
+	if err == nil && fi.ModTime().Equal(a.modTime) {
+		return
+	}
+	if os.IsNotExist(err) && a.modTime.IsZero() {
+		return
+	}
+	if err := a.load(); err != nil {
+		a.logError("Error reloading the users.", "file", a.FilePath, "error", err)
+	}
+}
+
+// save writes the tokens and users to the file.  The lock must be held.
+func (a *AuthManager) save() error {
+	if a.FilePath == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(a.State, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(a.FilePath, b, 0600); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(a.FilePath); err == nil {
+		a.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+// isEnabled returns whether any tokens or users have been added.  The lock must be held.
+func (a *AuthManager) isEnabled() bool {
+	return len(a.State.Tokens) != 0 || len(a.State.Users) != 0
+}
+
+// isLockedOut returns whether the client has made too many failed attempts.  The lock must be held.
+func (a *AuthManager) isLockedOut(client string) bool {
+	f, ok := a.failures[client]
+	return ok && time.Now().Before(f.lockedUntil)
+}
+
+// addFailure records a failed attempt by the client, and locks the client out
+// if it has made too many failed attempts.  The lock must be held.
+func (a *AuthManager) addFailure(client string) {
+	now := time.Now()
+	lt := time.Duration(a.lockoutTime()) * time.Minute
+	if a.failures == nil {
+		a.failures = map[string]*loginFailures{}
+	}
+	for k, f := range a.failures {
+		if now.Sub(f.first) > lt && now.After(f.lockedUntil) {
+			delete(a.failures, k)
+		}
+	}
+	f, ok := a.failures[client]
+	if !ok {
+		f = &loginFailures{first: now}
+		a.failures[client] = f
+	}
+	f.count++
+	max := a.MaxAttempts
+	if max <= 0 {
+		max = 5
+	}
+	if f.count >= max {
+		f.lockedUntil = now.Add(lt)
+		f.count = 0
+		f.first = now
+		a.logError("Locked out a client after too many failed attempts.", "client", client, "attempts", max)
+	}
+}
+
+func (a *AuthManager) sessionTimeout() time.Duration {
+	if a.SessionTimeout <= 0 {
+		return 12 * time.Hour
+	}
+	return time.Duration(a.SessionTimeout) * time.Minute
+}
+
+func (a *AuthManager) lockoutTime() int {
+	if a.LockoutTime <= 0 {
+		return 15
+	}
+	return a.LockoutTime
+}
+
+// checkPassword returns whether the password matches the user's password hash.
+func (u *AuthUser) checkPassword(password string) bool {
+	h, err := hex.DecodeString(u.Hash)
+	if err != nil || u.Iterations <= 0 {
+		return false
+	}
+	p := pbkdf2SHA256([]byte(password), []byte(u.Salt), u.Iterations, len(h))
+	return subtle.ConstantTimeCompare(p, h) == 1
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (id *AuthIdentity) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// validateAuthName checks the name and role of a token or user.
+func validateAuthName(name string, role string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name must be specified")
+	}
+	if role != RoleRead && role != RoleAdmin {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+// clientAddress returns the IP address of the client that made the request.
+func clientAddress(r *http.Request) string {
+	h, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return h
+}
+
+// hashToken returns the SHA-256 hash of the API token.
+func hashToken(t string) string {
+	h := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(h[:])
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// pbkdf2SHA256 derives a key from the password using PBKDF2 with HMAC-SHA256 (RFC 8018).
+func pbkdf2SHA256(password []byte, salt []byte, iter int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hl := prf.Size()
+	n := (keyLen + hl - 1) / hl
+	dk := make([]byte, 0, n*hl)
+	u := make([]byte, hl)
+	var bn [4]byte
+	for block := 1; block <= n; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(bn[:], uint32(block))
+		prf.Write(bn[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hl:]
+		copy(u, t)
+		for i := 2; i <= iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+func (a *AuthManager) logError(msg string, kv ...interface{}) {
+	logEntry("AuthManager", LevelError, msg, kv...)
+}
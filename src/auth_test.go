@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func newAuthTest(t *testing.T) (*AuthManager, func()) {
+	passwordIterations = 10
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &AuthManager{FilePath: filepath.Join(dir, "auth.json")}
+	return a, func() { os.RemoveAll(dir) }
+}
+
+func authTestRouter(a *AuthManager) *mux.Router {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r := mux.NewRouter()
+	r.Use(a.Middleware)
+	r.Methods("GET").Path("/measure/get").Name("GetMeasurements").Handler(ok)
+	r.Methods("POST").Path("/irrigation/start").Name("StartIrrigation").Handler(ok)
+	r.Methods("GET").Path("/config/get").Name("GetConfig").Handler(ok)
+	r.Methods("GET").Path("/login").Name("LoginPage").Handler(ok)
+	return r
+}
+
+func authTestRequest(r *mux.Router, method string, path string, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAuthIsOptional(t *testing.T) {
+	a, done := newAuthTest(t)
+	defer done()
+	r := authTestRouter(a)
+	if c := authTestRequest(r, "POST", "/irrigation/start", ""); c != 200 {
+		t.Error("Expected 200 with authentication switched off but got", c)
+	}
+}
+
+func TestAuthTokenRoles(t *testing.T) {
+	a, done := newAuthTest(t)
+	defer done()
+	rt, err := a.AddToken("grafana", RoleRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at, err := a.AddToken("homeassistant", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AddToken("grafana", RoleAdmin); err != ErrNameAlreadyExists {
+		t.Error("Expected a duplicate token name to be rejected")
+	}
+	b, _ := ioutil.ReadFile(a.FilePath)
+	if bytes.Contains(b, []byte(rt)) {
+		t.Error("Token was saved in plain text")
+	}
+
+	r := authTestRouter(a)
+	for _, x := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/measure/get", "", 401},
+		{"GET", "/measure/get", "wrong", 401},
+		{"GET", "/login", "", 200},
+		{"GET", "/measure/get", rt, 200},
+		{"POST", "/irrigation/start", rt, 403},
+		{"GET", "/config/get", rt, 403},
+		{"GET", "/measure/get", at, 200},
+		{"POST", "/irrigation/start", at, 200},
+		{"GET", "/config/get", at, 200},
+	} {
+		if c := authTestRequest(r, x.method, x.path, x.token); c != x.code {
+			t.Error("Expected", x.code, "for", x.method, x.path, "but got", c)
+		}
+	}
+
+	if err := a.RevokeToken("grafana"); err != nil {
+		t.Fatal(err)
+	}
+	if c := authTestRequest(r, "GET", "/measure/get", rt); c != 401 {
+		t.Error("Expected revoked token to be rejected but got", c)
+	}
+}
+
+func TestAuthLoginSession(t *testing.T) {
+	a, done := newAuthTest(t)
+	defer done()
+	if err := a.SetUser("gardener", RoleAdmin, "green-fingers"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Web pages are redirected to the login page
+	r := authTestRouter(a)
+	req := httptest.NewRequest("GET", "/config/get", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 303 || !strings.HasPrefix(w.Header().Get("Location"), "/login?next=") {
+		t.Error("Expected a redirect to the login page but got", w.Code, w.Header().Get("Location"))
+	}
+
+	id, err := a.Login("gardener", "green-fingers", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("POST", "/irrigation/start", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Error("Expected the session to be accepted but got", w.Code)
+	}
+
+	// Deleting the user ends the session
+	if err := a.DeleteUser("gardener"); err != nil {
+		t.Fatal(err)
+	}
+	a.SetUser("other", RoleRead, "something-else")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Error("Expected the session to end but got", w.Code)
+	}
+}
+
+func TestAuthLoginIsRateLimited(t *testing.T) {
+	a, done := newAuthTest(t)
+	defer done()
+	a.MaxAttempts = 3
+	a.SetUser("gardener", RoleRead, "green-fingers")
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.Login("gardener", "guess", "10.0.0.2"); err != ErrInvalidLogin {
+			t.Fatal("Expected invalid login but got", err)
+		}
+	}
+	if _, err := a.Login("gardener", "green-fingers", "10.0.0.2"); err != ErrTooManyAttempts {
+		t.Error("Expected the client to be locked out but got", err)
+	}
+	if _, err := a.Login("gardener", "green-fingers", "10.0.0.3"); err != nil {
+		t.Error("Expected another client to be able to log in but got", err)
+	}
+}
+
+func TestAuthCommand(t *testing.T) {
+	a, done := newAuthTest(t)
+	defer done()
+	out := &bytes.Buffer{}
+	if err := RunAuthCommand(a, "user-set", []string{"gardener", RoleAdmin}, strings.NewReader("green-fingers\n"), out); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunAuthCommand(a, "token-add", []string{"grafana", "owner"}, nil, out); err != ErrInvalidRole {
+		t.Error("Expected an invalid role error but got", err)
+	}
+	if err := RunAuthCommand(a, "user-list", nil, nil, out); err != nil || !strings.Contains(out.String(), "gardener  admin") {
+		t.Error("Expected the user to be listed.", err, out.String())
+	}
+
+	// The running service picks up the new user from the file
+	b := &AuthManager{FilePath: a.FilePath}
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Login("gardener", "green-fingers", "10.0.0.2"); err != nil {
+		t.Error("Expected the user to log in but got", err)
+	}
+}
+
+func TestPbkdf2(t *testing.T) {
+	k := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	if s := hex.EncodeToString(k); s != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783" {
+		t.Error("Unexpected key", s)
+	}
+	k = pbkdf2SHA256([]byte("Password"), []byte("NaCl"), 80000, 32)
+	if s := hex.EncodeToString(k); s != "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" {
+		t.Error("Unexpected key", s)
+	}
+}
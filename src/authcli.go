@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// AuthActions are the valid actions of the -auth command line flag.
+var AuthActions = []string{"token-add", "token-list", "token-revoke", "user-set", "user-list", "user-delete"}
+
+// authFilePath returns the path of the authentication file, which is kept
+// next to the executable, as the service changes to that directory when it starts.
+func authFilePath() string {
+	ap, err := os.Executable()
+	if err != nil {
+		return "auth.json"
+	}
+	return filepath.Join(filepath.Dir(ap), "auth.json")
+}
+
+// RunAuthCommand runs the authentication management action from the command line.
+// Passwords are read from the input so that they are not left in the shell history.
+func RunAuthCommand(a *AuthManager, action string, args []string, in io.Reader, out io.Writer) error {
+	if err := a.Load(); err != nil {
+		return err
+	}
+	arg := func(i int, name string) (string, error) {
+		if len(args) <= i {
+			return "", errors.New(action + " needs the " + name)
+		}
+		return args[i], nil
+	}
+
+	switch action {
+	case "token-add":
+		n, err := arg(0, "token name")
+		if err != nil {
+			return err
+		}
+		r, err := arg(1, "role ('"+RoleRead+"' or '"+RoleAdmin+"')")
+		if err != nil {
+			return err
+		}
+		t, err := a.AddToken(n, r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Created token", n, "with the", r, "role.  It will not be shown again:")
+		fmt.Fprintln(out, t)
+
+	case "token-list":
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tROLE\tCREATED")
+		for _, t := range a.State.Tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", t.Name, t.Role, t.Created.Format("2006-01-02 15:04"))
+		}
+		w.Flush()
+
+	case "token-revoke":
+		n, err := arg(0, "token name")
+		if err != nil {
+			return err
+		}
+		if err := a.RevokeToken(n); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Revoked token", n+".")
+
+	case "user-set":
+		n, err := arg(0, "user name")
+		if err != nil {
+			return err
+		}
+		r, err := arg(1, "role ('"+RoleRead+"' or '"+RoleAdmin+"')")
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out, "Password: ")
+		p, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		fmt.Fprintln(out)
+		if err := a.SetUser(n, r, strings.TrimRight(p, "\r\n")); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Saved user", n, "with the", r, "role.")
+
+	case "user-list":
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tROLE")
+		for _, u := range a.State.Users {
+			fmt.Fprintf(w, "%s\t%s\n", u.Name, u.Role)
+		}
+		w.Flush()
+
+	case "user-delete":
+		n, err := arg(0, "user name")
+		if err != nil {
+			return err
+		}
+		if err := a.DeleteUser(n); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Deleted user", n+".")
+
+	default:
+		return errors.New(action + " is an invalid action.  Valid actions are " + strings.Join(AuthActions, ", "))
+	}
+	return nil
+}
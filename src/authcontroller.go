@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// AuthController handles the Web Methods for logging in to the web pages.
+type AuthController struct {
+	Srv *Server
+}
+
+// LoginPageData holds the data used to write to the login page.
+type LoginPageData struct {
+	User  string
+	Next  string
+	Error string
+}
+
+// AddController adds the controller routes to the router
+func (c *AuthController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/login").Name("LoginPage").
+		Handler(http.HandlerFunc(c.handleLoginWebPage))
+	router.Methods("POST").Path("/login").Name("Login").
+		Handler(Logger(c, http.HandlerFunc(c.handleLogin)))
+	router.Methods("GET", "POST").Path("/logout").Name("Logout").
+		Handler(Logger(c, http.HandlerFunc(c.handleLogout)))
+	router.Methods("GET").Path("/auth/whoami").Name("WhoAmI").
+		Handler(Logger(c, http.HandlerFunc(c.handleWhoAmI)))
+}
+
+func (c *AuthController) handleLoginWebPage(w http.ResponseWriter, r *http.Request) {
+	c.writeLoginPage(w, 200, LoginPageData{Next: safeRedirect(r.URL.Query().Get("next"))})
+}
+
+func (c *AuthController) handleLogin(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	v := LoginPageData{
+		User: r.Form.Get("user"),
+		Next: safeRedirect(r.Form.Get("next")),
+	}
+	client := clientAddress(r)
+	id, err := c.Srv.Auth.Login(v.User, r.Form.Get("password"), client)
+	switch err {
+	case nil:
+	case ErrTooManyAttempts:
+		c.LogError("Login locked out for ", client, ".")
+		v.Error = "Too many failed attempts. Try again later."
+		c.writeLoginPage(w, 429, v)
+		return
+	case ErrInvalidLogin:
+		c.LogError("Failed login for '", v.User, "' from ", client, ".")
+		v.Error = "The user name or password is not valid."
+		c.writeLoginPage(w, 401, v)
+		return
+	default:
+		http.Error(w, "Error logging in. "+err.Error(), 500)
+		return
+	}
+
+	c.LogInfo("User '", v.User, "' logged in from ", client, ".")
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, v.Next, http.StatusSeeOther)
+}
+
+func (c *AuthController) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if ck, err := r.Cookie(sessionCookie); err == nil {
+		c.Srv.Auth.Logout(ck.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (c *AuthController) handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	id, _ := c.Srv.Auth.Authenticate(r)
+	if err := id.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing identity. "+err.Error(), 500)
+	}
+}
+
+func (c *AuthController) writeLoginPage(w http.ResponseWriter, status int, v LoginPageData) {
+	t := template.Must(template.ParseFiles("./html/login.html"))
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	t.Execute(w, v)
+}
+
+// safeRedirect returns the path to go to after logging in.  Only local paths
+// are allowed so that the login page cannot be used to send people elsewhere.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *AuthController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("AuthController", LevelInfo, a)
+}
+
+// LogError is used to log error messages for this controller.
+func (c *AuthController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("AuthController", LevelError, a)
+}
@@ -1,46 +1,163 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 )
 
 // Config holds the configuration required for the Soil Monitor module.
 type Config struct {
-	Period           int    `json:"period"`           // The update period (in minutes)
-	EnableThingspeak bool   `json:"enableThingspeak"` // Enable Thingspeak integration
-	ThingspeakID     string `json:"thingspeakID"`     // Thingspeak ID
-	EnableMqtt       bool   `json:"enableMqtt"`       // Enable MQTT integration
-	MqttHost         string `json:"mqttHost"`         // MQTT Host
-	MqttUsername     string `json:"mqttUsername"`     // MQTT Username
-	MqttPassword     string `json:"mqttPassword"`     // MQTT password
-	AirTempID        string `json:"airTempId"`        // ID of the Air temperature sensor
-	SoilTempID       string `json:"soilTempId"`       // ID of the Soil temperature sensor
+	Period           int               `json:"period"`           // The update period (in minutes)
+	EnableThingspeak bool              `json:"enableThingspeak"` // Enable Thingspeak integration
+	ThingspeakID     Secret            `json:"thingspeakID"`     // Thingspeak write key (write-only)
+	EnableMqtt       bool              `json:"enableMqtt"`       // Enable MQTT integration
+	MqttHost         string            `json:"mqttHost"`         // MQTT Host
+	MqttUsername     string            `json:"mqttUsername"`     // MQTT Username
+	MqttPassword     Secret            `json:"mqttPassword"`     // MQTT password (write-only)
+	MqttTopic        string            `json:"mqttTopic"`        // Prefix of the MQTT topics.  Defaults to home/garden.
+	AirTempID        string            `json:"airTempId"`        // ID of the Air temperature sensor
+	SoilTempID       string            `json:"soilTempId"`       // ID of the Soil temperature sensor
+	AlertRules       []AlertRule       `json:"alertRules"`       // Threshold alert rules evaluated against each measurement
+	EnableIrrigation bool              `json:"enableIrrigation"` // Enable automatic irrigation
+	IrrigationPin    int               `json:"irrigationPin"`    // GPIO pin that drives the valve relay
+	TargetMoisture   float64           `json:"targetMoisture"`   // Moisture (%) below which watering starts
+	WaterDuration    int               `json:"waterDuration"`    // Time (in seconds) to water for
+	SoakTime         int               `json:"soakTime"`         // Time (in minutes) to wait for the soil to respond before re-evaluating
+	WaterCooldown    int               `json:"waterCooldown"`    // Minimum time (in minutes) between automatic waterings
+	MaxDailyWater    int               `json:"maxDailyWater"`    // Maximum watering time per day (in minutes)
+	WaterWindows     string            `json:"waterWindows"`     // Allowed watering windows, e.g. "06:00-09:00,18:00-20:00"
+	WaterSchedule    string            `json:"waterSchedule"`    // Times to water regardless of the moisture, e.g. "06:00,18:00"
+	EnableFrost      bool              `json:"enableFrost"`      // Enable frost warnings
+	FrostThreshold   float64           `json:"frostThreshold"`   // Air temperature (C) at which frost is expected
+	FrostLeadTime    int               `json:"frostLeadTime"`    // Time (in hours) ahead to predict the air temperature
+	FrostWindow      int               `json:"frostWindow"`      // Time (in minutes) of recent readings used for the temperature trend
+	GddBase          float64           `json:"gddBase"`          // Base temperature (C) for growing degree days
+	GddCap           float64           `json:"gddCap"`           // Temperature (C) above which growing degree days do not accumulate
+	GddMethod        string            `json:"gddMethod"`        // Growing degree day method ("average" or "triangle")
+	ChillBase        float64           `json:"chillBase"`        // Air temperature (C) below which chill hours accumulate
+	SeasonStart      string            `json:"seasonStart"`      // Day the season starts, in the form MM-DD
+	DryThreshold     float64           `json:"dryThreshold"`     // Moisture (%) at which the soil is considered dry
+	Profile          string            `json:"profile"`          // Plant profile assigned to the unit
+	ProbeProfiles    map[string]string `json:"probeProfiles"`    // Plant profiles assigned to the probes, keyed by probe name (soil, air or light)
+	CustomProfiles   []PlantProfile    `json:"customProfiles"`   // Custom plant profiles
+	LightCurve       []LightPoint      `json:"lightCurve"`       // Transfer curve from the light sensor reading (%) to lux
+	PpfdFactor       float64           `json:"ppfdFactor"`       // Factor converting lux to PPFD (umol/m2/s)
+	DaylightLux      float64           `json:"daylightLux"`      // Illuminance (lux) above which it is daytime
+	Schedules        []ScheduleRule    `json:"schedules"`        // Measurement schedule rules.  If empty, measurements are taken every Period.
+	Windows          map[string]string `json:"windows"`          // Named time windows, e.g. {"night": "20:00-06:00"}
+	QuietHours       string            `json:"quietHours"`       // Named window or time windows when the display and LED are switched off
+	SensorTimeout    int               `json:"sensorTimeout"`    // Time (in seconds) to wait for a sensor read
+	SensorRetries    int               `json:"sensorRetries"`    // Number of times a failed sensor read is retried.  Negative for no retries.
+	SensorBackoff    int               `json:"sensorBackoff"`    // Time (in milliseconds) to wait before the first retry, doubling for each retry
+	HealthStaleAge   int               `json:"healthStaleAge"`   // Time (in minutes) after which the last successful measurement is stale.  Defaults to 3 scheduled runs.
+	HealthMinDisk    int               `json:"healthMinDisk"`    // Free disk space (in MB) below which the disk check fails
+	HealthRules      map[string]string `json:"healthRules"`      // Status a failing health check gives the unit ("degraded", "unhealthy" or "ignore"), keyed by check name
+	DegradedCode     int               `json:"degradedCode"`     // HTTP status code returned by /health when the unit is degraded.  Defaults to 200.
+	StreamClients    int               `json:"streamClients"`    // Maximum number of clients connected to the live stream
+	StreamHeartbeat  int               `json:"streamHeartbeat"`  // Time (in seconds) between heartbeats sent to the live stream clients
+
+	version uint64 // Counts the changes applied while running, so that the ETag changes when only a secret changes
+}
+
+// configFile holds the configuration as it is stored in the configuration file,
+// with the secrets encrypted with the device key.
+type configFile struct {
+	*Config
+	ThingspeakID string `json:"thingspeakID"` // Encrypted Thingspeak write key
+	MqttPassword string `json:"mqttPassword"` // Encrypted MQTT password
 }
 
-// ReadFromFile will read the configuration settings from the specified file
+// ReadFromFile will read the configuration settings from the specified file.
+// Secrets found in plain text are encrypted and the file is written back.
 func (c *Config) ReadFromFile(path string) error {
 	_, err := os.Stat(path)
 	if !os.IsNotExist(err) {
-		b, err := ioutil.ReadFile(path)
+		var b []byte
+		b, err = ioutil.ReadFile(path)
 		if err == nil {
-			err = json.Unmarshal(b, &c)
+			var plain bool
+			plain, err = c.decodeFile(path, b, false)
+			if err == nil && plain {
+				c.setDefaults()
+				err = c.WriteToFile(path)
+			}
 		}
 	}
 	c.setDefaults()
 	return err
 }
 
-// WriteToFile will write the configuration settings to the specified file
+// WriteToFile will write the configuration settings to the specified file.
+// The secrets are encrypted, only the owner can read the file, and the file
+// is replaced in one step so that it is never left half written.
 func (c *Config) WriteToFile(path string) error {
-	b, err := json.Marshal(c)
+	f := configFile{Config: c}
+	if c.ThingspeakID != "" || c.MqttPassword != "" {
+		key, err := loadDeviceKey(deviceKeyPath(path))
+		if err != nil {
+			return err
+		}
+		if f.ThingspeakID, err = encryptSecret(key, "thingspeakID", c.ThingspeakID); err != nil {
+			return err
+		}
+		if f.MqttPassword, err = encryptSecret(key, "mqttPassword", c.MqttPassword); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(f)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, b, 0666)
+	return writeFileAtomic(path, b, 0600)
+}
+
+// decodeFile decodes the contents of the configuration file and decrypts the secrets.
+// If strict is set, unknown values are rejected.  Returns whether any of the secrets
+// were in plain text.
+func (c *Config) decodeFile(path string, b []byte, strict bool) (bool, error) {
+	f := configFile{Config: c}
+	d := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		d.DisallowUnknownFields()
+	}
+	if err := d.Decode(&f); err != nil {
+		return false, err
+	}
+
+	plain := false
+	var key []byte
+	for _, s := range []struct {
+		name  string
+		value string
+		dest  *Secret
+	}{
+		{"thingspeakID", f.ThingspeakID, &c.ThingspeakID},
+		{"mqttPassword", f.MqttPassword, &c.MqttPassword},
+	} {
+		if !isEncryptedSecret(s.value) {
+			*s.dest = Secret(s.value)
+			plain = plain || s.value != ""
+			continue
+		}
+		if key == nil {
+			k, err := loadDeviceKey(deviceKeyPath(path))
+			if err != nil {
+				return false, err
+			}
+			key = k
+		}
+		v, err := decryptSecret(key, s.name, s.value)
+		if err != nil {
+			return false, err
+		}
+		*s.dest = v
+	}
+	return plain, nil
 }
 
 // ReadFrom reads the string from the reader and deserializes it into the entity values
@@ -82,8 +199,123 @@ func (c *Config) Deserialize(v string) error {
 	return err
 }
 
+// Clone returns a deep copy of the configuration, including the secrets, so
+// that it can be changed without changing the running configuration.
+func (c *Config) Clone() Config {
+	nc := *c
+	nc.AlertRules = append(c.AlertRules[:0:0], c.AlertRules...)
+	nc.CustomProfiles = append(c.CustomProfiles[:0:0], c.CustomProfiles...)
+	nc.LightCurve = append(c.LightCurve[:0:0], c.LightCurve...)
+	nc.Schedules = append(c.Schedules[:0:0], c.Schedules...)
+	nc.ProbeProfiles = copyStringMap(c.ProbeProfiles)
+	nc.Windows = copyStringMap(c.Windows)
+	nc.HealthRules = copyStringMap(c.HealthRules)
+	return nc
+}
+
+// copyStringMap returns a copy of the map.  A nil map stays nil.
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	n := make(map[string]string, len(m))
+	for k, v := range m {
+		n[k] = v
+	}
+	return n
+}
+
 func (c *Config) setDefaults() {
 	if c.Period <= 0 {
 		c.Period = 5
 	}
+	if c.MqttTopic == "" {
+		c.MqttTopic = defaultMqttTopic
+	}
+	if c.IrrigationPin <= 0 {
+		c.IrrigationPin = 23
+	}
+	if c.WaterDuration <= 0 {
+		c.WaterDuration = 60
+	}
+	if c.SoakTime <= 0 {
+		c.SoakTime = 30
+	}
+	if c.MaxDailyWater <= 0 {
+		c.MaxDailyWater = 10
+	}
+	if c.FrostLeadTime <= 0 {
+		c.FrostLeadTime = 6
+	}
+	if c.FrostWindow <= 0 {
+		c.FrostWindow = 120
+	}
+	if c.GddBase == 0 && c.GddCap == 0 {
+		c.GddBase = 10
+		c.GddCap = 30
+	}
+	if c.GddMethod == "" {
+		c.GddMethod = GddAverage
+	}
+	if c.ChillBase == 0 {
+		c.ChillBase = 7.2
+	}
+	if c.SeasonStart == "" {
+		c.SeasonStart = "01-01"
+	}
+	if c.DryThreshold <= 0 {
+		c.DryThreshold = 30
+	}
+	if c.Profile == "" {
+		c.Profile = builtinProfiles[0].Name
+	}
+	if c.PpfdFactor <= 0 {
+		c.PpfdFactor = 0.0185
+	}
+	if c.DaylightLux <= 0 {
+		c.DaylightLux = 1000
+	}
+	if c.SensorTimeout <= 0 {
+		c.SensorTimeout = 10
+	}
+	if c.SensorRetries == 0 {
+		c.SensorRetries = 2
+	}
+	if c.SensorBackoff <= 0 {
+		c.SensorBackoff = 500
+	}
+	if c.HealthMinDisk <= 0 {
+		c.HealthMinDisk = 50
+	}
+	if c.DegradedCode <= 0 {
+		c.DegradedCode = 200
+	}
+	if c.StreamClients <= 0 {
+		c.StreamClients = 5
+	}
+	if c.StreamHeartbeat <= 0 {
+		c.StreamHeartbeat = 15
+	}
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory
+// and renames it over the file, so that readers see either the old or the new file.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err = f.Chmod(perm); err == nil {
+		if _, err = f.Write(b); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ConfigAPIController handles the JSON REST API for configuring the module.
+// Updates are validated before they are applied, and the ETag returned by GET
+// can be passed back in the If-Match header so that an update fails with
+// 412 Precondition Failed if someone else has changed the configuration.
+// Secrets are write-only: they are returned as a mask, and sending the mask back
+// leaves them unchanged.
+type ConfigAPIController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *ConfigAPIController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/api/v1/config").Name("GetConfigAPI").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetConfig)))
+	router.Methods("PUT").Path("/api/v1/config").Name("PutConfigAPI").
+		Handler(Logger(c, http.HandlerFunc(c.handlePutConfig)))
+	router.Methods("PATCH").Path("/api/v1/config").Name("PatchConfigAPI").
+		Handler(Logger(c, http.HandlerFunc(c.handlePatchConfig)))
+	router.Methods("POST").Path("/api/v1/config/test/mqtt").Name("TestMqttConfig").
+		Handler(Logger(c, http.HandlerFunc(c.handleTestMqtt)))
+	router.Methods("POST").Path("/api/v1/config/test/thingspeak").Name("TestThingspeakConfig").
+		Handler(Logger(c, http.HandlerFunc(c.handleTestThingspeak)))
+}
+
+func (c *ConfigAPIController) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := c.Srv.Config()
+	w.Header().Set("ETag", cfg.ETag())
+	if err := cfg.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing configuration. "+err.Error(), 500)
+	}
+}
+
+// handlePutConfig replaces the whole configuration.  Values that are left out are set to their defaults,
+// except for the secrets, which are kept unless they are sent.
+func (c *ConfigAPIController) handlePutConfig(w http.ResponseWriter, r *http.Request) {
+	nc := Config{}
+	c.copySecrets(&nc)
+	if err := decodeConfig(r.Body, &nc); err != nil {
+		c.writeDecodeError(w, err)
+		return
+	}
+	c.update(w, r, nc)
+}
+
+// handlePatchConfig changes only the configuration values that are in the request.
+func (c *ConfigAPIController) handlePatchConfig(w http.ResponseWriter, r *http.Request) {
+	// Take a deep copy so that maps and lists in the running configuration are not changed
+	nc := c.Srv.Config().Clone()
+	if err := decodeConfig(r.Body, &nc); err != nil {
+		c.writeDecodeError(w, err)
+		return
+	}
+	c.update(w, r, nc)
+}
+
+// update validates, applies and saves the new configuration.
+func (c *ConfigAPIController) update(w http.ResponseWriter, r *http.Request, nc Config) {
+	res, err := c.Srv.Applier.ApplyIfMatch(nc, r.Header.Get("If-Match"))
+	if errs, ok := err.(ValidationErrors); ok {
+		e := ConfigError{Message: "Configuration is not valid.", Errors: errs}
+		e.WriteTo(w, 400)
+		return
+	}
+	if err == ErrConfigChanged {
+		e := ConfigError{Message: "The configuration has been changed by someone else. Reload it and try again."}
+		e.WriteTo(w, 412)
+		return
+	}
+	if err != nil {
+		e := ConfigError{Message: "Failed to apply the configuration. " + err.Error(), RolledBack: res.RolledBack}
+		e.WriteTo(w, 500)
+		return
+	}
+
+	cfg := c.Srv.Config()
+	if err := cfg.WriteToFile("config.json"); err != nil {
+		e := ConfigError{Message: "Configuration was applied but could not be saved. " + err.Error()}
+		e.WriteTo(w, 500)
+		return
+	}
+	c.LogInfo("Configuration updated. Changed ", strings.Join(res.Changed, ", "))
+	w.Header().Set("ETag", cfg.ETag())
+	if err := res.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing result. "+err.Error(), 500)
+	}
+}
+
+// copySecrets copies the secrets of the running configuration, which are not serialized, to the configuration.
+func (c *ConfigAPIController) copySecrets(nc *Config) {
+	cfg := c.Srv.Config()
+	nc.ThingspeakID = cfg.ThingspeakID
+	nc.MqttPassword = cfg.MqttPassword
+}
+
+// writeDecodeError writes the error returned when the request could not be decoded.
+func (c *ConfigAPIController) writeDecodeError(w http.ResponseWriter, err error) {
+	e := ConfigError{Message: "Request is not a valid configuration.", Errors: ValidationErrors{}}
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &te):
+		e.Errors.add(te.Field, "must be a "+te.Type.String())
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		e.Errors.add(strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`), "is not a configuration value")
+	default:
+		e.Message = e.Message + " " + err.Error()
+	}
+	e.WriteTo(w, 400)
+}
+
+// handleTestMqtt tries the supplied MQTT settings without saving them.
+func (c *ConfigAPIController) handleTestMqtt(w http.ResponseWriter, r *http.Request) {
+	v, ok := c.decodeSettings(w, r)
+	if !ok {
+		return
+	}
+	t := CheckMqtt(v)
+	c.LogInfo("MQTT connection test to ", v.MqttHost, " succeeded: ", t.Success)
+	if err := t.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing test result. "+err.Error(), 500)
+	}
+}
+
+// handleTestThingspeak tries the supplied Thingspeak API ID without saving it.
+// The test is refused just after a measurement or another test was sent, as
+// Thingspeak would reject the update.
+func (c *ConfigAPIController) handleTestThingspeak(w http.ResponseWriter, r *http.Request) {
+	v, ok := c.decodeSettings(w, r)
+	if !ok {
+		return
+	}
+	t, wait := c.Srv.Monitor.TestThingspeak(v)
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		e := ConfigError{Message: "An update was sent to Thingspeak less than 15 seconds ago. Try again in a few seconds.", Errors: ValidationErrors{}}
+		e.WriteTo(w, http.StatusTooManyRequests)
+		return
+	}
+	c.LogInfo("Thingspeak connection test succeeded: ", t.Success)
+	if err := t.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing test result. "+err.Error(), 500)
+	}
+}
+
+// decodeSettings reads the settings to test, starting from the saved configuration
+// so that the secrets are kept when they are sent back as the mask.  The saved
+// MQTT password is only sent to the saved broker as the saved user, so that it
+// cannot be sent to another broker.
+func (c *ConfigAPIController) decodeSettings(w http.ResponseWriter, r *http.Request) (ConnectionSettings, bool) {
+	cfg := c.Srv.Config()
+	v := ConnectionSettings{
+		MqttHost:     cfg.MqttHost,
+		MqttUsername: cfg.MqttUsername,
+		MqttTopic:    cfg.MqttTopic,
+		ThingspeakID: cfg.ThingspeakID,
+	}
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&v); err != nil && err != io.EOF {
+		c.writeDecodeError(w, err)
+		return v, false
+	}
+	if v.MqttPassword == "" && cfg.MqttPassword != "" {
+		if v.MqttHost != cfg.MqttHost || v.MqttUsername != cfg.MqttUsername {
+			e := ConfigError{Message: "The MQTT password must be entered to test a different host or user.", Errors: ValidationErrors{}}
+			e.Errors.add("mqttPassword", "must be entered when the host or user is changed")
+			e.WriteTo(w, 400)
+			return v, false
+		}
+		v.MqttPassword = cfg.MqttPassword
+	}
+	return v, true
+}
+
+// decodeConfig decodes the json onto the configuration, rejecting unknown values.
+func decodeConfig(r io.Reader, c *Config) error {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		if err == io.EOF {
+			return errors.New("request body is empty")
+		}
+		return err
+	}
+	return nil
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *ConfigAPIController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("ConfigAPIController", LevelInfo, a)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigAPIReturnsFieldErrors(t *testing.T) {
+	c := &ConfigAPIController{Srv: newTestServer(&Config{})}
+	r := httptest.NewRequest("PATCH", "/api/v1/config", strings.NewReader(`{"enableThingspeak": true, "period": -1}`))
+	w := httptest.NewRecorder()
+	c.handlePatchConfig(w, r)
+	if w.Code != 400 {
+		t.Fatal("Expected 400 but got", w.Code)
+	}
+	e := ConfigError{}
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Errors) != 2 || e.Errors[0].Field != "period" || e.Errors[1].Field != "thingspeakID" {
+		t.Error("Expected errors for period and thingspeakID but got", e.Errors)
+	}
+	if c.Srv.Config().Period != 5 {
+		t.Error("Configuration should not have changed")
+	}
+}
+
+func TestConfigAPIRejectsUnknownAndMistypedValues(t *testing.T) {
+	c := &ConfigAPIController{Srv: newTestServer(&Config{})}
+	for _, x := range []struct {
+		body, field string
+	}{
+		{`{"periods": 10}`, "periods"},
+		{`{"period": "ten"}`, "period"},
+	} {
+		w := httptest.NewRecorder()
+		c.handlePatchConfig(w, httptest.NewRequest("PATCH", "/api/v1/config", strings.NewReader(x.body)))
+		e := ConfigError{}
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != 400 || len(e.Errors) != 1 || e.Errors[0].Field != x.field {
+			t.Error("Expected a 400 error for", x.field, "but got", w.Code, e)
+		}
+	}
+}
+
+func TestConfigAPIRejectsStaleETag(t *testing.T) {
+	c := &ConfigAPIController{Srv: newTestServer(&Config{ThingspeakID: "1111"})}
+	w := httptest.NewRecorder()
+	c.handleGetConfig(w, httptest.NewRequest("GET", "/api/v1/config", nil))
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag")
+	}
+
+	// Someone else changes the configuration
+	nc := *c.Srv.Config()
+	nc.ThingspeakID = "1234"
+	if _, err := c.Srv.Applier.Apply(nc); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("PATCH", "/api/v1/config", strings.NewReader(`{"thingspeakID": "5678"}`))
+	r.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	c.handlePatchConfig(w, r)
+	if w.Code != 412 {
+		t.Error("Expected 412 but got", w.Code)
+	}
+	if c.Srv.Config().ThingspeakID != "1234" {
+		t.Error("Configuration should not have been overwritten")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConfigApplier applies configuration changes to the running service.
+// The old and new configuration are compared and only the subsystems that
+// use the changed values are reinitialized.  If a subsystem fails to start
+// with the new values, the old configuration is restored.
+type ConfigApplier struct {
+	Srv  *Server    // Server instance
+	lock sync.Mutex // Makes sure only one change is applied at a time
+}
+
+// ConfigApplyResult holds the outcome of applying a configuration change.
+type ConfigApplyResult struct {
+	Changed    []string `json:"changed"`    // Configuration values that changed
+	Applied    []string `json:"applied"`    // Subsystems that were reinitialized
+	RolledBack bool     `json:"rolledBack"` // The old configuration was restored
+	Error      string   `json:"error"`      // Error that stopped the change being applied
+}
+
+// configSubsystem is a part of the service that must be reinitialized when
+// one of its configuration values changes.  Values not used by a subsystem
+// are read each time they are used, so take effect immediately.
+type configSubsystem struct {
+	Name   string                // Name of the subsystem
+	Fields []string              // Configuration values (json names) used by the subsystem
+	Apply  func(s *Server) error // Reinitializes the subsystem with the current configuration
+}
+
+// configSubsystems lists the subsystems in the order they are reinitialized.
+// The new values are checked by Config.Validate before any subsystem is changed.
+var configSubsystems = []configSubsystem{
+	{
+		Name:   "display",
+		Fields: []string{"profile"},
+		Apply: func(s *Server) error {
+			if s.LCD != nil {
+				s.LCD.SetItem("STATUS", s.Config().Profile, "")
+			}
+			return nil
+		},
+	},
+	{
+		Name:   "schedule",
+		Fields: []string{"period", "schedules", "windows", "quietHours"},
+		Apply: func(s *Server) error {
+			s.StartSchedule()
+			return nil
+		},
+	},
+	{
+		Name:   "mqtt",
+		Fields: []string{"enableMqtt", "mqttHost", "mqttUsername", "mqttPassword", "mqttTopic"},
+		Apply: func(s *Server) error {
+			if s.MqttClient == nil {
+				s.MqttClient = &Mqtt{Srv: s}
+			}
+			s.MqttClient.Close()
+			return s.MqttClient.Initialize()
+		},
+	},
+	{
+		Name:   "irrigation",
+		Fields: []string{"enableIrrigation", "irrigationPin"},
+		Apply: func(s *Server) error {
+			if s.Irrigation == nil {
+				return nil
+			}
+			s.Irrigation.Close()
+			return s.Irrigation.Open()
+		},
+	},
+}
+
+// ErrConfigChanged is returned when the configuration has been changed since it was read.
+var ErrConfigChanged = errors.New("configuration has been changed since it was read")
+
+// Apply replaces the running configuration with the new configuration and
+// reinitializes the affected subsystems.
+func (a *ConfigApplier) Apply(nc Config) (ConfigApplyResult, error) {
+	return a.ApplyIfMatch(nc, "")
+}
+
+// ApplyIfMatch applies the new configuration only if the running configuration
+// still has the ETag, so that changes made by someone else are not overwritten.
+// If the ETag is empty or "*", the configuration is always applied.
+// A configuration that is not valid returns the ValidationErrors.
+func (a *ConfigApplier) ApplyIfMatch(nc Config, etag string) (ConfigApplyResult, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	old := a.Srv.Config()
+	if etag != "" && etag != "*" && etag != old.ETag() {
+		return ConfigApplyResult{Changed: []string{}, Applied: []string{}}, ErrConfigChanged
+	}
+
+	// Every change is validated here, whichever way it was made
+	if errs := nc.Validate(); len(errs) != 0 {
+		return ConfigApplyResult{Changed: []string{}, Applied: []string{}, Error: errs.Error()}, errs
+	}
+	nc.setDefaults()
+	r := ConfigApplyResult{
+		Changed: DiffConfig(old, &nc),
+		Applied: []string{},
+	}
+	if len(r.Changed) == 0 {
+		return r, nil
+	}
+
+	subs := []configSubsystem{}
+	for _, sub := range configSubsystems {
+		if sub.isAffected(r.Changed) {
+			subs = append(subs, sub)
+		}
+	}
+
+	a.logInfo("Applying configuration changes to ", strings.Join(r.Changed, ", "))
+	// The running configuration is replaced, so readers holding the old one are not affected
+	cfg := nc.Clone()
+	cfg.version = old.version + 1
+	a.Srv.setConfig(&cfg)
+	for i, sub := range subs {
+		if sub.Apply == nil {
+			continue
+		}
+		a.logInfo("Reinitializing ", sub.Name)
+		if err := sub.Apply(a.Srv); err != nil {
+			r.Error = sub.Name + ": " + err.Error()
+			a.logError("Failed to apply the configuration. Rolling back.", "subsystem", sub.Name, "error", err)
+			a.rollback(old, subs[:i+1])
+			r.RolledBack = true
+			return r, errors.New(r.Error)
+		}
+		r.Applied = append(r.Applied, sub.Name)
+	}
+	a.Srv.Events.Publish(EventConfig, r)
+	return r, nil
+}
+
+// rollback restores the old configuration and reinitializes the subsystems with it.
+func (a *ConfigApplier) rollback(old *Config, subs []configSubsystem) {
+	a.Srv.setConfig(old)
+	for _, sub := range subs {
+		if sub.Apply == nil {
+			continue
+		}
+		if err := sub.Apply(a.Srv); err != nil {
+			a.logError("Failed to restore the configuration.", "subsystem", sub.Name, "error", err)
+		}
+	}
+}
+
+// ETag returns a tag that changes whenever any configuration value changes.
+// The secrets are serialized as a mask, so the version is included to change
+// the tag when only a secret changes, without the tag depending on the secrets.
+func (c *Config) ETag() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(append(b, strconv.FormatUint(c.version, 10)...))
+	return `"` + hex.EncodeToString(h[:8]) + `"`
+}
+
+// isAffected returns whether any of the subsystem values are in the list of changed values.
+func (sub *configSubsystem) isAffected(changed []string) bool {
+	for _, f := range sub.Fields {
+		for _, c := range changed {
+			if f == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DiffConfig returns the json names of the configuration values that are different.
+func DiffConfig(a *Config, b *Config) []string {
+	l := []string{}
+	va := reflect.ValueOf(a).Elem()
+	vb := reflect.ValueOf(b).Elem()
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			// Unexported fields are not configuration values
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			n := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if n == "" {
+				n = t.Field(i).Name
+			}
+			l = append(l, n)
+		}
+	}
+	return l
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (r *ConfigApplyResult) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+func (a *ConfigApplier) logInfo(v ...interface{}) {
+	s := fmt.Sprint(v...)
+	logEntry("ConfigApplier", LevelInfo, s)
+}
+
+func (a *ConfigApplier) logError(msg string, kv ...interface{}) {
+	logEntry("ConfigApplier", LevelError, msg, kv...)
+}
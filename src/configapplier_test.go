@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDiffConfigReturnsChangedValues(t *testing.T) {
+	a := Config{Period: 5, MqttHost: "tcp://broker:1883"}
+	b := a
+	b.Period = 10
+	b.CustomProfiles = []PlantProfile{{Name: "chilli"}}
+	d := DiffConfig(&a, &b)
+	if len(d) != 2 || d[0] != "period" || d[1] != "customProfiles" {
+		t.Error("Expected period and customProfiles but got", d)
+	}
+}
+
+func TestApplyConfigRejectsInvalidSchedule(t *testing.T) {
+	s := newTestServer(&Config{})
+	a := s.Applier
+
+	nc := *s.Config()
+	nc.Period = 10
+	nc.Schedules = []ScheduleRule{{Cron: "61 * * * *"}}
+	r, err := a.Apply(nc)
+	if err == nil {
+		t.Fatal("Expected an error for the invalid cron expression")
+	}
+	if r.RolledBack {
+		t.Error("Nothing should have been applied to roll back")
+	}
+	if s.Config().Period != 5 || len(s.Config().Schedules) != 0 {
+		t.Error("Configuration should not have changed")
+	}
+}
+
+func TestApplyConfigWithoutRestart(t *testing.T) {
+	s := newTestServer(&Config{})
+	a := s.Applier
+
+	nc := *s.Config()
+	nc.ThingspeakID = "1234"
+	r, err := a.Apply(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Applied) != 0 {
+		t.Error("No subsystems should have been restarted but got", r.Applied)
+	}
+	if s.Config().ThingspeakID != "1234" {
+		t.Error("Thingspeak ID was not applied")
+	}
+}
+
+func TestApplyConfigReplacesSnapshot(t *testing.T) {
+	s := newTestServer(&Config{})
+	a := s.Applier
+	old := s.Config()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c := s.Config()
+			_ = c.Period + len(c.ThingspeakID)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		nc := s.Config().Clone()
+		nc.ThingspeakID = Secret(fmt.Sprint(i + 1))
+		if _, err := a.Apply(nc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if old.ThingspeakID != "" {
+		t.Error("Configuration held by a reader was changed")
+	}
+	if s.Config().ThingspeakID != "10" {
+		t.Error("Thingspeak ID was not applied")
+	}
+}
+
+func TestETagChangesWithSecrets(t *testing.T) {
+	s := newTestServer(&Config{MqttPassword: "password"})
+	etag := s.Config().ETag()
+
+	nc := s.Config().Clone()
+	nc.MqttPassword = "hunter2"
+	if _, err := s.Applier.Apply(nc); err != nil {
+		t.Fatal(err)
+	}
+	if s.Config().ETag() == etag {
+		t.Error("ETag should change when only a secret changes")
+	}
+
+	// The tag must not depend on the secret, so that it cannot be used to guess it
+	c := s.Config().Clone()
+	c.MqttPassword = "password"
+	if c.ETag() != s.Config().ETag() {
+		t.Error("ETag should not depend on the secret values")
+	}
+}
@@ -23,57 +23,74 @@ type ConfigPageData struct {
 	MqttHost         string
 	MqttUsername     string
 	MqttPassword     string
+	MqttTopic        string
 	AirTempID        string
 	SoilTempID       string
+	Profile          string
+	Profiles         []PlantProfile
+	ETag             string
+	Mask             string
 }
 
 // AddController adds the controller routes to the router
 func (c *ConfigController) AddController(router *mux.Router, s *Server) {
 	c.Srv = s
-	router.Path("/config.html").Handler(http.HandlerFunc(c.handleConfigWebPage))
+	router.Path("/config.html").Name("ConfigWebPage").Handler(http.HandlerFunc(c.handleConfigWebPage))
 	router.Methods("GET").Path("/config/get").Name("GetConfig").
 		Handler(Logger(c, http.HandlerFunc(c.handleGetConfig)))
+	// Kept for older clients.  The configuration page uses the JSON API.
 	router.Methods("POST").Path("/config/set").Name("SetConfig").
 		Handler(Logger(c, http.HandlerFunc(c.handleSetConfig)))
+	router.Methods("GET").Path("/config/status").Name("GetConfigStatus").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetConfigStatus)))
 }
 
 func (c *ConfigController) handleConfigWebPage(w http.ResponseWriter, r *http.Request) {
 	t := template.Must(template.ParseFiles("./html/config.html"))
 
+	cfg := c.Srv.Config()
 	v := ConfigPageData{
-		Period:       c.Srv.Config.Period,
-		ThingspeakID: c.Srv.Config.ThingspeakID,
-		MqttHost:     c.Srv.Config.MqttHost,
-		MqttUsername: c.Srv.Config.MqttUsername,
-		MqttPassword: c.MaskValue(),
-		AirTempID:    c.Srv.Config.AirTempID,
-		SoilTempID:   c.Srv.Config.SoilTempID,
+		Period:       cfg.Period,
+		ThingspeakID: cfg.ThingspeakID.Redacted(),
+		MqttHost:     cfg.MqttHost,
+		MqttUsername: cfg.MqttUsername,
+		MqttPassword: cfg.MqttPassword.Redacted(),
+		MqttTopic:    cfg.MqttTopic,
+		AirTempID:    cfg.AirTempID,
+		SoilTempID:   cfg.SoilTempID,
+		Profile:      cfg.Profile,
+		Profiles:     cfg.Profiles(),
+		ETag:         cfg.ETag(),
+		Mask:         c.MaskValue(),
 	}
-	if c.Srv.Config.EnableThingspeak {
+	if cfg.EnableThingspeak {
 		v.EnableThingspeak = "checked"
 	}
-	if c.Srv.Config.EnableMqtt {
+	if cfg.EnableMqtt {
 		v.EnableMqtt = "checked"
 	}
 
 	t.Execute(w, v)
 }
 
-// MaskValue returns a string with 20 stars
+// MaskValue returns the mask shown in place of a secret
 func (c *ConfigController) MaskValue() string {
-	r := make([]rune, 20)
-	for i := range r {
-		r[i] = '*'
-	}
-	return string(r)
+	return secretMask
 }
 
 func (c *ConfigController) handleGetConfig(w http.ResponseWriter, r *http.Request) {
-	if err := c.Srv.Config.WriteTo(w); err != nil {
+	if err := c.Srv.Config().WriteTo(w); err != nil {
 		http.Error(w, "Error serializing configuration. "+err.Error(), 500)
 	}
 }
 
+func (c *ConfigController) handleGetConfigStatus(w http.ResponseWriter, r *http.Request) {
+	st := c.Srv.Watcher.Current()
+	if err := st.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing configuration status. "+err.Error(), 500)
+	}
+}
+
 func (c *ConfigController) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
@@ -86,55 +103,65 @@ func (c *ConfigController) handleSetConfig(w http.ResponseWriter, r *http.Reques
 	mhst := r.Form.Get("mqttHost")
 	musr := r.Form.Get("mqttUser")
 	mpwd := r.Form.Get("mqttPword")
+	mtop := r.Form.Get("mqttTopic")
 	mask := c.MaskValue()
 
 	aid := r.Form.Get("airTempID")
 	sid := r.Form.Get("soilTempID")
 
-	if ents == "on" && tsid == "" {
-		http.Error(w, "Thingspeak ID must be specified", 500)
-		return
-	}
-
-	if enmq == "on" && mhst == "" {
-		http.Error(w, "MQTT Host must be specified", 500)
-		return
-	}
+	prof := r.Form.Get("profile")
 
 	c.LogInfo("Setting new configuration values.")
 	v, err := strconv.Atoi(pd)
 	if err != nil {
-		http.Error(w, "Failed to convert "+pd+" to an integer.", 500)
+		e := ConfigError{Message: "Configuration is not valid."}
+		e.Errors.add("period", "failed to convert "+pd+" to an integer")
+		e.WriteTo(w, 400)
 		return
 	}
 
-	// Update the configuration values
-	c.Srv.Config.Period = v
+	// Update a copy of the configuration values
+	nc := c.Srv.Config().Clone()
+	nc.Period = v
 
-	c.Srv.Config.EnableThingspeak = (ents == "on")
-	c.Srv.Config.ThingspeakID = tsid
+	nc.EnableThingspeak = (ents == "on")
+	if tsid != mask {
+		nc.ThingspeakID = Secret(tsid)
+	}
 
-	c.Srv.Config.EnableMqtt = (enmq == "on")
-	c.Srv.Config.MqttHost = mhst
-	c.Srv.Config.MqttUsername = musr
+	nc.EnableMqtt = (enmq == "on")
+	nc.MqttHost = mhst
+	nc.MqttUsername = musr
 	if mpwd != mask {
-		c.Srv.Config.MqttPassword = mpwd
+		nc.MqttPassword = Secret(mpwd)
 	}
+	if mtop != "" {
+		nc.MqttTopic = mtop
+	}
+
+	nc.AirTempID = aid
+	nc.SoilTempID = sid
 
-	c.Srv.Config.AirTempID = aid
-	c.Srv.Config.SoilTempID = sid
+	if prof != "" {
+		nc.Profile = prof
+		if p, ok := nc.FindProfile(prof); ok {
+			nc.Profile = p.Name
+		}
+	}
 
-	c.Srv.Config.WriteToFile("config.json")
+	// Validate, apply and save the changes through the configuration API
+	api := ConfigAPIController{Srv: c.Srv}
+	api.update(w, r, nc)
 }
 
 // LogInfo is used to log information messages for this controller.
 func (c *ConfigController) LogInfo(v ...interface{}) {
 	a := fmt.Sprint(v...)
-	logger.Info("ConfigController: ", a)
+	logEntry("ConfigController", LevelInfo, a)
 }
 
 // LogError is used to log error messages for this controller.
 func (c *ConfigController) LogError(v ...interface{}) {
 	a := fmt.Sprint(v...)
-	logger.Error("ConfigController: ", a)
+	logEntry("ConfigController", LevelError, a)
 }
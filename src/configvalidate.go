@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// FieldError describes a configuration value that is not valid.
+type FieldError struct {
+	Field   string `json:"field"`   // Name (json) of the configuration value
+	Message string `json:"message"` // Why the value is not valid
+}
+
+// ValidationErrors holds the list of configuration values that are not valid.
+type ValidationErrors []FieldError
+
+// ConfigError holds the error returned by the configuration web methods.
+type ConfigError struct {
+	Message    string           `json:"message"`    // Description of the error
+	Errors     ValidationErrors `json:"errors"`     // Configuration values that are not valid
+	RolledBack bool             `json:"rolledBack"` // The previous configuration was restored
+}
+
+// Error returns the validation errors as a single string.
+func (v ValidationErrors) Error() string {
+	l := []string{}
+	for _, e := range v {
+		l = append(l, e.Field+": "+e.Message)
+	}
+	return strings.Join(l, "; ")
+}
+
+// add adds an error for the field.
+func (v *ValidationErrors) add(field string, msg string) {
+	*v = append(*v, FieldError{Field: field, Message: msg})
+}
+
+// addErr adds an error for the field if err is not nil.
+func (v *ValidationErrors) addErr(field string, err error) {
+	if err != nil {
+		v.add(field, err.Error())
+	}
+}
+
+// Validate checks every configuration value and returns the values that are not valid.
+// Zero values are allowed where the default is used in their place.
+func (c *Config) Validate() ValidationErrors {
+	v := ValidationErrors{}
+
+	if c.Period < 0 || c.Period > 1440 {
+		v.add("period", "must be between 1 and 1440 minutes")
+	}
+	if c.EnableThingspeak && strings.TrimSpace(string(c.ThingspeakID)) == "" {
+		v.add("thingspeakID", "must be specified when Thingspeak is enabled")
+	}
+	if c.EnableMqtt {
+		if strings.TrimSpace(c.MqttHost) == "" {
+			v.add("mqttHost", "must be specified when MQTT is enabled")
+		} else if strings.Contains(c.MqttHost, "://") {
+			u, err := url.Parse(c.MqttHost)
+			if err != nil || u.Host == "" {
+				v.add("mqttHost", "must be a host name or a broker URL such as tcp://host:1883")
+			} else {
+				switch u.Scheme {
+				case "tcp", "ssl", "tls", "ws", "wss", "mqtt", "mqtts":
+				default:
+					v.add("mqttHost", "scheme '"+u.Scheme+"' is not supported")
+				}
+			}
+		}
+		if strings.TrimSpace(c.MqttUsername) == "" {
+			v.add("mqttUsername", "must be specified when MQTT is enabled")
+		}
+		if c.MqttPassword == "" {
+			v.add("mqttPassword", "must be specified when MQTT is enabled")
+		}
+	}
+	if strings.ContainsAny(c.MqttTopic, "+#") || strings.HasPrefix(c.MqttTopic, "/") || strings.HasSuffix(c.MqttTopic, "/") {
+		v.add("mqttTopic", "must be a topic such as home/garden, without wildcards or a leading or trailing /")
+	}
+
+	for i, r := range c.AlertRules {
+		f := fmt.Sprintf("alertRules[%d]", i)
+		if strings.TrimSpace(r.Name) == "" {
+			v.add(f+".name", "must be specified")
+		}
+		if _, err := r.ParseCondition(); err != nil {
+			v.add(f+".condition", err.Error())
+		}
+		if r.Hysteresis < 0 {
+			v.add(f+".hysteresis", "must not be negative")
+		}
+	}
+
+	if (c.IrrigationPin != 0 && c.IrrigationPin < 2) || c.IrrigationPin > 27 {
+		v.add("irrigationPin", "must be a GPIO number between 2 and 27")
+	}
+	if c.TargetMoisture < 0 || c.TargetMoisture > 100 {
+		v.add("targetMoisture", "must be between 0 and 100")
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"waterDuration", c.WaterDuration},
+		{"soakTime", c.SoakTime},
+		{"waterCooldown", c.WaterCooldown},
+		{"maxDailyWater", c.MaxDailyWater},
+		{"frostLeadTime", c.FrostLeadTime},
+		{"frostWindow", c.FrostWindow},
+		{"sensorTimeout", c.SensorTimeout},
+		{"sensorBackoff", c.SensorBackoff},
+	} {
+		if f.value < 0 {
+			v.add(f.name, "must not be negative")
+		}
+	}
+	if _, err := ParseTimeWindows(c.WaterWindows); err != nil {
+		v.addErr("waterWindows", err)
+	}
+	for _, ts := range strings.Split(c.WaterSchedule, ",") {
+		if strings.TrimSpace(ts) == "" {
+			continue
+		}
+		if _, err := parseTimeOfDay(ts); err != nil {
+			v.addErr("waterSchedule", err)
+			break
+		}
+	}
+
+	if c.GddCap != 0 && c.GddCap <= c.GddBase {
+		v.add("gddCap", "must be more than the base temperature")
+	}
+	switch strings.ToLower(c.GddMethod) {
+	case "", GddAverage, GddTriangle:
+	default:
+		v.add("gddMethod", "must be '"+GddAverage+"' or '"+GddTriangle+"'")
+	}
+	if c.SeasonStart != "" {
+		if _, err := time.Parse("01-02", c.SeasonStart); err != nil {
+			v.add("seasonStart", "must be in the form MM-DD")
+		}
+	}
+	if c.DryThreshold < 0 || c.DryThreshold > 100 {
+		v.add("dryThreshold", "must be between 0 and 100")
+	}
+
+	names := map[string]bool{}
+	for _, p := range builtinProfiles {
+		names[strings.ToLower(p.Name)] = true
+	}
+	for i, p := range c.CustomProfiles {
+		f := fmt.Sprintf("customProfiles[%d]", i)
+		if err := p.Validate(); err != nil {
+			v.addErr(f, err)
+		} else if n := strings.ToLower(p.Name); names[n] {
+			// FindProfile must resolve each name to a single profile
+			v.add(f+".name", "profile '"+p.Name+"' already exists")
+		} else {
+			names[n] = true
+		}
+	}
+	if c.Profile != "" {
+		if _, ok := c.FindProfile(c.Profile); !ok {
+			v.add("profile", "plant profile '"+c.Profile+"' was not found")
+		}
+	}
+	for probe, n := range c.ProbeProfiles {
+		if !isProbe(probe) {
+			v.add("probeProfiles."+probe, "probe '"+probe+"' is not known. The probes are "+strings.Join(Probes, ", "))
+		} else if _, ok := c.FindProfile(n); !ok {
+			v.add("probeProfiles."+probe, "plant profile '"+n+"' was not found")
+		}
+	}
+
+	for i, p := range c.LightCurve {
+		if p.Raw < 0 || p.Raw > 100 || p.Lux < 0 {
+			v.add(fmt.Sprintf("lightCurve[%d]", i), "raw must be between 0 and 100 and lux must not be negative")
+		}
+	}
+	if c.PpfdFactor < 0 {
+		v.add("ppfdFactor", "must not be negative")
+	}
+	if c.DaylightLux < 0 {
+		v.add("daylightLux", "must not be negative")
+	}
+
+	for n, w := range c.Windows {
+		if _, err := ParseTimeWindows(w); err != nil {
+			v.addErr("windows."+n, err)
+		}
+	}
+	for i, r := range c.Schedules {
+		f := fmt.Sprintf("schedules[%d]", i)
+		if _, err := c.resolveWindow(r.Window, defaultDaylight); err != nil {
+			v.addErr(f+".window", err)
+		}
+		if r.Cron != "" {
+			if _, err := ParseCron(r.Cron); err != nil {
+				v.addErr(f+".cron", err)
+			}
+		} else if r.Every < 0 || r.Every > 1440 {
+			v.add(f+".every", "must be between 1 and 1440 minutes")
+		}
+	}
+	if _, err := c.resolveWindow(c.QuietHours, defaultDaylight); err != nil {
+		v.addErr("quietHours", err)
+	}
+
+	if c.HealthStaleAge < 0 {
+		v.add("healthStaleAge", "must not be negative")
+	}
+	if c.HealthMinDisk < 0 {
+		v.add("healthMinDisk", "must not be negative")
+	}
+	for n, r := range c.HealthRules {
+		if _, ok := defaultHealthRules[n]; !ok {
+			v.add("healthRules."+n, "is not a health check.  Valid checks are "+strings.Join(HealthChecks(), ", "))
+		}
+		switch r {
+		case HealthDegraded, HealthUnhealthy, HealthIgnore:
+		default:
+			v.add("healthRules."+n, "must be '"+HealthDegraded+"', '"+HealthUnhealthy+"' or '"+HealthIgnore+"'")
+		}
+	}
+	if c.StreamClients < 0 {
+		v.add("streamClients", "must not be negative")
+	}
+	if c.StreamHeartbeat < 0 {
+		v.add("streamHeartbeat", "must not be negative")
+	}
+	if c.DegradedCode != 0 && (c.DegradedCode < 200 || c.DegradedCode > 599) {
+		v.add("degradedCode", "must be an HTTP status code")
+	}
+
+	return v
+}
+
+// WriteTo serializes the entity and writes it to the http response with the status code
+func (e *ConfigError) WriteTo(w http.ResponseWriter, status int) error {
+	if e.Errors == nil {
+		e.Errors = ValidationErrors{}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ConfigWatcher watches the configuration file for external edits, such as
+// those made by provisioning tools, and applies valid changes to the running
+// service.  A SIGHUP signal forces the file to be reloaded.
+type ConfigWatcher struct {
+	Srv      *Server           // Server instance
+	FilePath string            // Path of the configuration file
+	Interval int               // Time (in seconds) between checks of the file.  Defaults to 5 seconds.
+	Status   ConfigWatchStatus // The result of the last reload
+	modTime  time.Time         // Modification time of the file when last checked
+	size     int64             // Size of the file when last checked
+	stop     chan struct{}     // Stops the watcher
+	lock     sync.Mutex        // Guards the watcher state
+}
+
+// ConfigWatchStatus holds the result of the last reload of the configuration file.
+type ConfigWatchStatus struct {
+	FilePath     string    `json:"filePath"`     // Path of the configuration file
+	Trigger      string    `json:"trigger"`      // What caused the last reload ("file" or "sighup")
+	LastChecked  time.Time `json:"lastChecked"`  // Time the file was last reloaded
+	LastModified time.Time `json:"lastModified"` // Modification time of the file
+	LastApplied  time.Time `json:"lastApplied"`  // Time a change from the file was last applied
+	Valid        bool      `json:"valid"`        // The file was valid and has been applied
+	Error        string    `json:"error"`        // Reason the file was rejected
+	Changed      []string  `json:"changed"`      // Configuration values changed by the last reload
+	Applied      []string  `json:"applied"`      // Subsystems reinitialized by the last reload
+}
+
+// Start starts watching the configuration file.
+func (cw *ConfigWatcher) Start() {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	if cw.stop != nil {
+		return
+	}
+	if cw.Interval <= 0 {
+		cw.Interval = 5
+	}
+	cw.Status = ConfigWatchStatus{FilePath: cw.FilePath, Valid: true}
+	if fi, err := os.Stat(cw.FilePath); err == nil {
+		cw.modTime = fi.ModTime()
+		cw.size = fi.Size()
+		cw.Status.LastModified = fi.ModTime()
+	}
+
+	cw.stop = make(chan struct{})
+	go cw.run(cw.stop)
+}
+
+// Stop stops watching the configuration file.
+func (cw *ConfigWatcher) Stop() {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	if cw.stop != nil {
+		close(cw.stop)
+		cw.stop = nil
+	}
+}
+
+// Current returns the result of the last reload.
+func (cw *ConfigWatcher) Current() ConfigWatchStatus {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	return cw.Status
+}
+
+// Reload reads the configuration file and applies it if it is valid.
+// An invalid file is rejected and the running configuration is kept.
+func (cw *ConfigWatcher) Reload(trigger string) ConfigWatchStatus {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	st := ConfigWatchStatus{
+		FilePath:    cw.FilePath,
+		Trigger:     trigger,
+		LastChecked: time.Now(),
+		LastApplied: cw.Status.LastApplied,
+		Changed:     []string{},
+		Applied:     []string{},
+	}
+	if fi, err := os.Stat(cw.FilePath); err == nil {
+		cw.modTime = fi.ModTime()
+		cw.size = fi.Size()
+		st.LastModified = fi.ModTime()
+	}
+
+	nc, plain, err := cw.readFile()
+	if err == nil {
+		var r ConfigApplyResult
+		r, err = cw.Srv.Applier.Apply(nc)
+		st.Changed = r.Changed
+		st.Applied = r.Applied
+		if err == nil && len(r.Changed) != 0 {
+			st.LastApplied = st.LastChecked
+			cw.logInfo("Applied configuration changes from ", cw.FilePath, ".")
+		}
+		if err == nil && plain {
+			// Secrets were edited into the file in plain text
+			if werr := cw.Srv.Config().WriteToFile(cw.FilePath); werr != nil {
+				cw.logError("Failed to encrypt the secrets.", "file", cw.FilePath, "error", werr)
+			} else if fi, serr := os.Stat(cw.FilePath); serr == nil {
+				cw.modTime = fi.ModTime()
+				cw.size = fi.Size()
+			}
+		}
+	}
+	if err != nil {
+		st.Error = err.Error()
+		cw.logError("Rejected the changes.", "file", cw.FilePath, "error", err)
+	}
+	st.Valid = err == nil
+	cw.Status = st
+	return st
+}
+
+// run checks the file for changes and listens for the SIGHUP signal.
+func (cw *ConfigWatcher) run(stop chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(time.Duration(cw.Interval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			cw.logInfo("Received SIGHUP. Reloading the configuration.")
+			cw.Reload("sighup")
+		case <-t.C:
+			if cw.hasChanged() {
+				cw.logInfo("Configuration file has changed. Reloading the configuration.")
+				cw.Reload("file")
+			}
+		}
+	}
+}
+
+// hasChanged returns whether the modification time or size of the file has changed.
+func (cw *ConfigWatcher) hasChanged() bool {
+	fi, err := os.Stat(cw.FilePath)
+	if err != nil {
+		return false
+	}
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	return !fi.ModTime().Equal(cw.modTime) || fi.Size() != cw.size
+}
+
+// readFile reads and parses the configuration file.
+// Unknown values are rejected so that typing mistakes are not silently ignored.
+// Returns whether any of the secrets were in plain text.
+func (cw *ConfigWatcher) readFile() (Config, bool, error) {
+	c := Config{}
+	b, err := ioutil.ReadFile(cw.FilePath)
+	if err != nil {
+		return c, false, err
+	}
+	plain, err := c.decodeFile(cw.FilePath, b, true)
+	if err != nil {
+		return c, false, err
+	}
+	c.setDefaults()
+	return c, plain, nil
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (st *ConfigWatchStatus) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+func (cw *ConfigWatcher) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("ConfigWatcher", LevelInfo, a)
+}
+
+func (cw *ConfigWatcher) logError(msg string, kv ...interface{}) {
+	logEntry("ConfigWatcher", LevelError, msg, kv...)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigWatcherRejectsInvalidFile(t *testing.T) {
+	d, err := ioutil.TempDir("", "soilmonitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	p := filepath.Join(d, "config.json")
+
+	s := newTestServer(&Config{})
+	cw := ConfigWatcher{Srv: s, FilePath: p}
+
+	// Invalid json is kept out
+	ioutil.WriteFile(p, []byte(`{"period": 10,`), 0600)
+	if st := cw.Reload("file"); st.Valid || st.Error == "" {
+		t.Error("Expected the file to be rejected")
+	}
+	if s.Config().Period != 5 {
+		t.Error("Period should not have changed")
+	}
+
+	// Unknown values are kept out
+	ioutil.WriteFile(p, []byte(`{"periods": 10}`), 0600)
+	if st := cw.Reload("file"); st.Valid {
+		t.Error("Expected the unknown value to be rejected")
+	}
+
+	// Values that are not valid are kept out
+	ioutil.WriteFile(p, []byte(`{"period": 5000, "mqttHost": "broker"}`), 0600)
+	if st := cw.Reload("sighup"); st.Valid || !strings.Contains(st.Error, "period") {
+		t.Error("Expected the invalid period to be rejected but got", st)
+	}
+	if s.Config().Period != 5 || s.Config().MqttHost != "" {
+		t.Error("Configuration should not have changed")
+	}
+
+	// Valid changes are applied
+	ioutil.WriteFile(p, []byte(`{"thingspeakID": "1234"}`), 0600)
+	st := cw.Reload("sighup")
+	if !st.Valid {
+		t.Fatal("Expected the file to be applied but got", st.Error)
+	}
+	if s.Config().ThingspeakID != "1234" {
+		t.Error("Thingspeak ID was not applied")
+	}
+	if cw.hasChanged() {
+		t.Error("File should not be reported as changed after a reload")
+	}
+}
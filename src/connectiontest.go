@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// connectionTestTimeout is the time allowed for each step of a connection test.
+const connectionTestTimeout = 10 * time.Second
+
+// thingspeakURL is the address of the Thingspeak API
+var thingspeakURL = "https://api.thingspeak.com"
+
+// thingspeakUpdateInterval is the time Thingspeak requires between updates to a channel.
+const thingspeakUpdateInterval = 15 * time.Second
+
+// ConnectionTest holds the result of testing the settings of an external service.
+type ConnectionTest struct {
+	Service string           `json:"service"` // Service that was tested (mqtt or thingspeak)
+	Success bool             `json:"success"` // All of the steps succeeded
+	Steps   []ConnectionStep `json:"steps"`   // Result of each step, in the order they were run.  The steps stop at the first failure.
+}
+
+// ConnectionStep holds the result of a single step of a connection test.
+type ConnectionStep struct {
+	Name     string  `json:"name"`     // Name of the step
+	Success  bool    `json:"success"`  // The step succeeded
+	Message  string  `json:"message"`  // Description of the result
+	Duration float64 `json:"duration"` // Time (in milliseconds) the step took
+}
+
+// ConnectionSettings holds the settings to test.  Secrets that are not
+// supplied, or are sent back as the mask, are taken from the saved configuration.
+// The saved MQTT password is only used with the saved host and user.
+type ConnectionSettings struct {
+	MqttHost     string `json:"mqttHost"`     // Host name of the MQTT Broker
+	MqttUsername string `json:"mqttUsername"` // MQTT Broker user name
+	MqttPassword Secret `json:"mqttPassword"` // MQTT Broker password
+	MqttTopic    string `json:"mqttTopic"`    // Prefix of the MQTT topics
+	ThingspeakID Secret `json:"thingspeakID"` // Thingspeak API ID
+}
+
+// CheckMqtt tries the MQTT settings: connects to the broker, publishes to the
+// test topic under the topic prefix, and disconnects.  Nothing is saved.
+func CheckMqtt(s ConnectionSettings) ConnectionTest {
+	t := ConnectionTest{Service: "mqtt", Steps: []ConnectionStep{}}
+	ok := t.step("settings", func() (string, error) {
+		switch {
+		case s.MqttHost == "":
+			return "", errors.New("host has not been configured")
+		case s.MqttUsername == "":
+			return "", errors.New("username has not been configured")
+		case s.MqttPassword == "":
+			return "", errors.New("password has not been configured")
+		}
+		return "settings are complete", nil
+	})
+	if !ok {
+		return t
+	}
+
+	id, _ := randomHex(4)
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(s.MqttHost)
+	opts.SetUsername(s.MqttUsername)
+	opts.SetPassword(string(s.MqttPassword))
+	opts.SetClientID("soilmonitor-test-" + id)
+	opts.SetConnectTimeout(connectionTestTimeout)
+	opts.SetAutoReconnect(false)
+	client := MQTT.NewClient(opts)
+
+	ok = t.step("connect", func() (string, error) {
+		if err := waitToken(client.Connect()); err != nil {
+			return "", err
+		}
+		return "connected to " + s.MqttHost, nil
+	})
+	if !ok {
+		return t
+	}
+	ok = t.step("publish", func() (string, error) {
+		topic := mqttTopic(&Config{MqttTopic: s.MqttTopic}, "test")
+		msg := "connection test at " + time.Now().Format(time.RFC3339)
+		if err := waitToken(client.Publish(topic, byte(0), false, msg)); err != nil {
+			return "", err
+		}
+		return "published to " + topic, nil
+	})
+	t.step("disconnect", func() (string, error) {
+		client.Disconnect(250)
+		return "disconnected", nil
+	})
+	t.Success = ok
+	return t
+}
+
+// CheckThingspeak tries the Thingspeak API ID with an authenticated call.
+// Thingspeak can only check a write key by writing, so the test adds a status
+// entry to the channel and takes up the update interval.  The settings are not saved.
+func CheckThingspeak(s ConnectionSettings) ConnectionTest {
+	t := ConnectionTest{Service: "thingspeak", Steps: []ConnectionStep{}}
+	key := string(s.ThingspeakID)
+	ok := t.step("settings", func() (string, error) {
+		if key == "" {
+			return "", errors.New("Thingspeak API ID has not been configured")
+		}
+		return "settings are complete", nil
+	})
+	if !ok {
+		return t
+	}
+
+	var body string
+	ok = t.step("request", func() (string, error) {
+		client := http.Client{Timeout: connectionTestTimeout}
+		v := url.Values{"api_key": {key}, "status": {"Soil Monitor connection test"}}
+		resp, err := client.PostForm(thingspeakURL+"/update.json", v)
+		if err != nil {
+			// Make sure the key is never shown
+			return "", errors.New(strings.Replace(err.Error(), key, secretMask, -1))
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body = strings.TrimSpace(string(b))
+		if resp.StatusCode != 200 {
+			return "", fmt.Errorf("Thingspeak returned %s", resp.Status)
+		}
+		return "Thingspeak responded", nil
+	})
+	if !ok {
+		return t
+	}
+	t.Success = t.step("authenticate", func() (string, error) {
+		v := struct {
+			EntryID int `json:"entry_id"`
+		}{}
+		// Thingspeak returns 0 or -1 rather than an entry when the key is rejected
+		if err := json.Unmarshal([]byte(body), &v); err != nil || v.EntryID <= 0 {
+			return "", errors.New("the API ID was rejected, or the channel was updated less than 15 seconds ago")
+		}
+		return fmt.Sprintf("API ID accepted, added entry %d", v.EntryID), nil
+	})
+	return t
+}
+
+// step runs a step of the test and records the result.  Returns whether the step succeeded.
+func (t *ConnectionTest) step(name string, f func() (string, error)) bool {
+	start := time.Now()
+	msg, err := f()
+	s := ConnectionStep{
+		Name:     name,
+		Success:  err == nil,
+		Message:  msg,
+		Duration: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		s.Message = err.Error()
+	}
+	t.Steps = append(t.Steps, s)
+	return s.Success
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (t *ConnectionTest) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// waitToken waits for the MQTT operation to complete, up to the test timeout.
+func waitToken(t MQTT.Token) error {
+	if !t.WaitTimeout(connectionTestTimeout) {
+		return errors.New("timed out waiting for the broker")
+	}
+	return t.Error()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCheckThingspeak(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path == "/update.json" && r.Form.Get("api_key") == "GOODKEY" {
+			w.Write([]byte(`{"channel_id":1,"entry_id":42}`))
+			return
+		}
+		w.Write([]byte("-1"))
+	}))
+	defer ts.Close()
+	old := thingspeakURL
+	thingspeakURL = ts.URL
+	defer func() { thingspeakURL = old }()
+
+	v := CheckThingspeak(ConnectionSettings{ThingspeakID: "GOODKEY"})
+	if !v.Success || len(v.Steps) != 3 || v.Steps[2].Message != "API ID accepted, added entry 42" {
+		t.Error("Expected the key to be accepted but got", v)
+	}
+	v = CheckThingspeak(ConnectionSettings{ThingspeakID: "BADKEY"})
+	if v.Success || len(v.Steps) != 3 || v.Steps[2].Success {
+		t.Error("Expected the key to be rejected but got", v)
+	}
+	v = CheckThingspeak(ConnectionSettings{})
+	if v.Success || len(v.Steps) != 1 {
+		t.Error("Expected the missing key to fail the settings step but got", v)
+	}
+
+	// The saved key is used when the mask is sent back
+	s := newTestServer(&Config{ThingspeakID: "GOODKEY"})
+	r := mux.NewRouter()
+	c := &ConfigAPIController{}
+	c.AddController(r, s)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config/test/thingspeak", bytes.NewBufferString(`{"thingspeakID":"`+secretMask+`"}`)))
+	v = ConnectionTest{}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil || !v.Success {
+		t.Error("Expected the saved key to be accepted but got", w.Body.String())
+	}
+	if s.Config().ThingspeakID != "GOODKEY" {
+		t.Error("Expected the configuration to be left alone")
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config/test/thingspeak", bytes.NewBufferString(`{"thingspeakKey":"x"}`)))
+	if w.Code != 400 {
+		t.Error("Expected an unknown value to be rejected but got", w.Code)
+	}
+
+	// A test has just been sent, so another test would take its update interval
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config/test/thingspeak", bytes.NewBufferString(`{}`)))
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Error("Expected the test to be refused after a test but got", w.Code)
+	}
+
+	// And the next measurement waits for it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Monitor.sendThingspeakUpdate(ctx, Measurement{}); err != context.Canceled {
+		t.Error("Expected the measurement to wait for the update interval but got", err)
+	}
+}
+
+func TestMqttTopicUsesPrefix(t *testing.T) {
+	if n := mqttTopic(&Config{MqttTopic: "farm/bed1/"}, "test"); n != "farm/bed1/test" {
+		t.Error("Expected farm/bed1/test but got", n)
+	}
+	if n := mqttTopic(&Config{}, "test"); n != "home/garden/test" {
+		t.Error("Expected the default prefix but got", n)
+	}
+}
+
+func TestCheckMqtt(t *testing.T) {
+	v := CheckMqtt(ConnectionSettings{MqttHost: "tcp://127.0.0.1:1", MqttUsername: "garden"})
+	if v.Success || len(v.Steps) != 1 || v.Steps[0].Message != "password has not been configured" {
+		t.Error("Expected the missing password to fail the settings step but got", v)
+	}
+
+	// Nothing listens on port 1, so the connection is refused
+	v = CheckMqtt(ConnectionSettings{MqttHost: "tcp://127.0.0.1:1", MqttUsername: "garden", MqttPassword: "secret"})
+	if v.Success || len(v.Steps) != 2 || v.Steps[1].Name != "connect" || v.Steps[1].Success {
+		t.Error("Expected the connect step to fail but got", v)
+	}
+}
+
+func TestCheckMqttKeepsSavedPasswordForSavedBroker(t *testing.T) {
+	s := newTestServer(&Config{MqttHost: "tcp://127.0.0.1:1", MqttUsername: "garden", MqttPassword: "secret"})
+	r := mux.NewRouter()
+	c := &ConfigAPIController{}
+	c.AddController(r, s)
+	test := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config/test/mqtt", bytes.NewBufferString(body)))
+		return w
+	}
+
+	// The saved password is used with the saved broker and user
+	w := test(`{"mqttHost":"tcp://127.0.0.1:1","mqttUsername":"garden","mqttPassword":"` + secretMask + `"}`)
+	v := ConnectionTest{}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil || len(v.Steps) != 2 || !v.Steps[0].Success {
+		t.Error("Expected the saved password to be used but got", w.Code, w.Body.String())
+	}
+
+	// Another broker or user needs the password
+	for _, b := range []string{
+		`{"mqttHost":"tcp://attacker.example:1883","mqttPassword":"` + secretMask + `"}`,
+		`{"mqttUsername":"someone"}`,
+	} {
+		if w := test(b); w.Code != 400 || !strings.Contains(w.Body.String(), "mqttPassword") {
+			t.Error("Expected the password to be required for", b, "but got", w.Code, w.Body.String())
+		}
+	}
+	w = test(`{"mqttHost":"tcp://127.0.0.1:1","mqttUsername":"someone","mqttPassword":"other"}`)
+	if w.Code != 200 {
+		t.Error("Expected a supplied password to be tested but got", w.Code, w.Body.String())
+	}
+}
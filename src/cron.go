@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronExpr holds a parsed cron expression in the standard 5 field form
+// "minute hour day-of-month month day-of-week".
+// Fields may be '*', numbers, ranges (1-5), lists (1,15,30) and steps (*/5 or 0-30/10).
+type CronExpr struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+	anyDom bool // Day of month is '*'
+	anyDow bool // Day of week is '*'
+}
+
+// ParseCron parses the cron expression.
+func ParseCron(s string) (*CronExpr, error) {
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, errors.New("cron expression '" + s + "' must have 5 fields")
+	}
+	c := &CronExpr{
+		anyDom: f[2] == "*",
+		anyDow: f[4] == "*",
+	}
+	if err := parseCronField(f[0], 0, 59, c.minute[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(f[1], 0, 23, c.hour[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(f[2], 1, 31, c.dom[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(f[3], 1, 12, c.month[:]); err != nil {
+		return nil, err
+	}
+	// Sunday can be 0 or 7
+	dow := make([]bool, 8)
+	if err := parseCronField(f[4], 0, 7, dow); err != nil {
+		return nil, err
+	}
+	copy(c.dow[:], dow)
+	c.dow[0] = c.dow[0] || dow[7]
+	return c, nil
+}
+
+// Matches returns whether the minute of the time matches the expression.
+// As with cron, if both the day of month and day of week are restricted,
+// the time matches if either of them match.
+func (c *CronExpr) Matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	d := c.dom[t.Day()]
+	w := c.dow[int(t.Weekday())]
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return w
+	case c.anyDow:
+		return d
+	}
+	return d || w
+}
+
+// parseCronField parses a single field and sets the matching values.
+func parseCronField(s string, first int, last int, v []bool) error {
+	for _, p := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(p, "/"); i >= 0 {
+			n, err := strconv.Atoi(p[i+1:])
+			if err != nil || n <= 0 {
+				return errors.New("invalid step in cron field '" + s + "'")
+			}
+			step = n
+			p = p[:i]
+		}
+		lo, hi := first, last
+		if p != "*" {
+			r := strings.SplitN(p, "-", 2)
+			n, err := strconv.Atoi(r[0])
+			if err != nil {
+				return errors.New("invalid value in cron field '" + s + "'")
+			}
+			lo, hi = n, n
+			if len(r) == 2 {
+				if hi, err = strconv.Atoi(r[1]); err != nil {
+					return errors.New("invalid range in cron field '" + s + "'")
+				}
+			} else if step > 1 {
+				hi = last
+			}
+		}
+		if lo < first || hi > last || lo > hi {
+			return errors.New("cron field '" + s + "' is out of range")
+		}
+		for i := lo; i <= hi; i = i + step {
+			v[i] = true
+		}
+	}
+	return nil
+}
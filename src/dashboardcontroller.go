@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// DashboardController handles the dashboard web page.
+type DashboardController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *DashboardController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/").Name("DashboardPage").Handler(http.HandlerFunc(c.handleDashboardPage))
+	router.Methods("GET").Path("/index.html").Name("DashboardIndexPage").Handler(http.HandlerFunc(c.handleDashboardPage))
+}
+
+// handleDashboardPage writes the dashboard.  The page reads its values from the
+// API and the event stream, so it is served as is.
+func (c *DashboardController) handleDashboardPage(w http.ResponseWriter, r *http.Request) {
+	s, err := ReadAllText("./html/index.html")
+	if err != nil {
+		http.Error(w, "Error reading the dashboard. "+err.Error(), 500)
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("cache-control", "no-cache")
+	w.Write([]byte(s))
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *DashboardController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("DashboardController", LevelInfo, a)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDashboardPage(t *testing.T) {
+	r := mux.NewRouter()
+	c := &DashboardController{}
+	c.AddController(r, newTestServer(&Config{}))
+
+	for _, p := range []string{"/", "/index.html"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		b := strings.Replace(w.Body.String(), "http://www.w3.org/2000/svg", "", -1)
+		if w.Code != 200 || !strings.Contains(b, "<title>Soil Monitor</title>") {
+			t.Error("Expected the dashboard for", p, "but got", w.Code)
+		}
+		// The page must work offline, so only the local assets are used
+		if strings.Contains(b, "http://") || strings.Contains(b, "https://") {
+			t.Error("Expected no external references in the dashboard")
+		}
+	}
+}
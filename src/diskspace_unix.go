@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// diskSpace returns the free and total space (in bytes) of the file system holding the path.
+func diskSpace(path string) (uint64, uint64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
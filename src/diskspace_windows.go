@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// diskSpace returns the free and total space (in bytes) of the file system holding the path.
+func diskSpace(path string) (uint64, uint64, error) {
+	return 0, 0, errors.New("disk space is not supported on windows")
+}
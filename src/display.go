@@ -1,89 +1,406 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	gopitools "github.com/brumawen/gopi-tools/src"
 )
 
-// Display manages the display of information on the 2x8 character LCD display
+// Display page priorities
+const (
+	PriorityNormal = 0 // Page is shown in turn with the other pages
+	PriorityAlert  = 1 // Page is shown immediately and pinned until it is acknowledged
+)
+
+// displayStopWait is the time allowed for the display to stop.
+const displayStopWait = 5 * time.Second
+
+// Display manages the display of information on the 2x8 character LCD display.
+// The display state is owned by a single goroutine, and is changed by sending
+// it messages, so the display can be updated safely from any goroutine.
+// Sending a message never blocks, so a display that is not responding cannot
+// hold up the callers.  Once stopped, the display cannot be started again.
 type Display struct {
-	Items     []*DisplayItem // The list of display items
-	ShowTime  int            // The amount of time (in secs) that each screen will display
-	isRunning bool           // Indicates if the display is running
-	idx       int            // The current index
+	ShowTime  int                    // The amount of time (in secs) that each screen will display
+	items     []*DisplayItem         // The list of display items
+	idx       int                    // The index of the item being shown, -1 if none
+	isRunning bool                   // Indicates if the display is cycling through the screens
+	isQuiet   bool                   // Indicates that the display is switched off for the quiet hours
+	shown     string                 // The message currently on the display
+	timer     *time.Timer            // Timer used to move to the next item
+	msgs      chan func()            // Messages to the display goroutine
+	quit      chan struct{}          // Closed when the display goroutine has stopped
+	exit      bool                   // The display goroutine stops after the current message
+	write     func(msg string) error // Writes the message to the display.  Defaults to the character display.
+	once      sync.Once              // Starts the display goroutine
 }
 
 // DisplayItem item holds the text that will be displayed on the LCD display
 type DisplayItem struct {
-	Name  string // The name of the item
-	Line1 string // Line 1 of the display
-	Line2 string // Line 2 of the display
+	Name     string    `json:"name"`     // The name of the item
+	Line1    string    `json:"line1"`    // Line 1 of the display
+	Line2    string    `json:"line2"`    // Line 2 of the display
+	Priority int       `json:"priority"` // Priority of the item.  Alert items are pinned until they are acknowledged.
+	Duration int       `json:"duration"` // The amount of time (in secs) the item is displayed.  Defaults to ShowTime.
+	Expires  time.Time `json:"expires"`  // Time the item is removed from the display.  Zero for never.
+}
+
+// DisplayItemList holds a list of display items.
+type DisplayItemList struct {
+	Current string        `json:"current"` // Name of the item being shown
+	Items   []DisplayItem `json:"items"`   // The display items, in the order they are shown
 }
 
 // Start will start the display cycling through the screens
 func (d *Display) Start() {
-	if d.isRunning {
-		return
-	}
-	d.isRunning = true
-	go func() {
+	d.send(func() {
+		if d.isRunning {
+			return
+		}
 		if d.ShowTime <= 0 {
 			d.ShowTime = 5
 		}
-		d.idx = -1
-		for d.isRunning {
-			d.ShowNextItem()
-			time.Sleep(time.Duration(d.ShowTime) * time.Second)
-		}
-	}()
+		d.isRunning = true
+		d.showNext()
+	})
 }
 
-// Stop will stop the display cycling through the screens.
+// Stop will stop the display cycling through the screens, clear the display
+// and stop the display goroutine.  Unlike the other messages, the stop waits a
+// while for room in the queue, so that it is not dropped behind the updates.
 func (d *Display) Stop() {
-	d.isRunning = false
-	cd := gopitools.CharDisplay{}
-	if err := cd.Clear(); err != nil {
-		d.logError("Error clearing the display.", err.Error())
+	done := make(chan struct{})
+	if !d.enqueue(func() {
+		d.isRunning = false
+		d.stopTimer()
+		d.render("")
+		d.exit = true
+		close(done)
+	}, displayStopWait) {
+		return
 	}
+	select {
+	case <-done:
+	case <-d.quit:
+	case <-time.After(displayStopWait):
+		d.logError("Display did not stop in time.")
+	}
+}
+
+// SetQuiet switches the display off or back on for the quiet hours.
+func (d *Display) SetQuiet(quiet bool) {
+	d.send(func() {
+		if d.isQuiet == quiet {
+			return
+		}
+		d.isQuiet = quiet
+		if quiet {
+			d.render("")
+		} else {
+			d.showCurrent()
+		}
+	})
 }
 
-// SetItem sets the display item ready to be displayed
+// SetItem sets the text of the display item ready to be displayed.
+// The priority, duration and expiry of an existing item are kept.
 func (d *Display) SetItem(name string, l1 string, l2 string) {
-	for _, x := range d.Items {
-		if x.Name == name {
-			x.Line1 = l1
-			x.Line2 = l2
-			d.RefreshCurrentItem()
+	d.send(func() {
+		if i := d.find(name); i >= 0 {
+			d.items[i].Line1 = l1
+			d.items[i].Line2 = l2
+			if i == d.idx {
+				d.showCurrent()
+			}
 			return
 		}
-	}
-	d.Items = append(d.Items, &DisplayItem{
-		Name:  name,
-		Line1: l1,
-		Line2: l2,
+		d.items = append(d.items, &DisplayItem{Name: name, Line1: l1, Line2: l2})
 	})
 }
 
-// ShowNextItem increments the display index and shows the next item.
-func (d *Display) ShowNextItem() {
-	d.idx = d.idx + 1
-	l := len(d.Items)
-	if d.idx >= l {
-		d.idx = 0
+// SetPage adds or replaces the display item.
+// An alert item is shown immediately.
+func (d *Display) SetPage(p DisplayItem) {
+	d.send(func() {
+		x := p
+		i := d.find(p.Name)
+		if i >= 0 {
+			d.items[i] = &x
+		} else {
+			d.items = append(d.items, &x)
+			i = len(d.items) - 1
+		}
+		if x.Priority > PriorityNormal {
+			// Show the alert immediately, unless a higher priority alert is being shown
+			if c := d.current(); c == nil || c.Priority <= x.Priority {
+				d.idx = i
+				d.showCurrent()
+				d.resetTimer()
+			}
+			return
+		}
+		if i == d.idx {
+			d.showCurrent()
+		}
+	})
+}
+
+// ShowAlert shows the alert on the display immediately and keeps it on the
+// display until it is acknowledged.
+func (d *Display) ShowAlert(name string, l1 string, l2 string) {
+	d.SetPage(DisplayItem{Name: name, Line1: l1, Line2: l2, Priority: PriorityAlert})
+}
+
+// Acknowledge removes the alert item from the display.
+// If the name is empty, all the alert items are removed.
+func (d *Display) Acknowledge(name string) bool {
+	found := false
+	d.call(func() {
+		for i := len(d.items) - 1; i >= 0; i-- {
+			it := d.items[i]
+			if it.Priority > PriorityNormal && (name == "" || it.Name == name) {
+				d.remove(i)
+				found = true
+			}
+		}
+	})
+	return found
+}
+
+// RemoveItem removes the display item.
+func (d *Display) RemoveItem(name string) {
+	d.send(func() {
+		if i := d.find(name); i >= 0 {
+			d.remove(i)
+		}
+	})
+}
+
+// Items returns a copy of the display items, with the highest priority first.
+func (d *Display) Items() DisplayItemList {
+	l := DisplayItemList{Items: []DisplayItem{}}
+	d.call(func() {
+		if c := d.current(); c != nil {
+			l.Current = c.Name
+		}
+		for _, it := range d.items {
+			l.Items = append(l.Items, *it)
+		}
+	})
+	sort.SliceStable(l.Items, func(i, j int) bool {
+		return l.Items[i].Priority > l.Items[j].Priority
+	})
+	return l
+}
+
+// send passes the message to the display goroutine.  The message is dropped
+// if the display has stopped, or is so far behind that the queue is full.
+// Returns whether the message was queued.
+func (d *Display) send(f func()) bool {
+	return d.enqueue(f, 0)
+}
+
+// enqueue passes the message to the display goroutine, waiting up to the
+// specified time for room in the queue.  Returns whether the message was queued.
+func (d *Display) enqueue(f func(), wait time.Duration) bool {
+	d.once.Do(func() {
+		d.idx = -1
+		d.msgs = make(chan func(), 20)
+		d.quit = make(chan struct{})
+		go d.run()
+	})
+	select {
+	case <-d.quit:
+		return false
+	case d.msgs <- f:
+		return true
+	default:
 	}
-	d.RefreshCurrentItem()
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-d.quit:
+			return false
+		case d.msgs <- f:
+			return true
+		case <-t.C:
+		}
+	}
+	d.logError("Display is not keeping up. Dropping the update.")
+	return false
 }
 
-// RefreshCurrentItem displays the item associtated with the current display index.
-func (d *Display) RefreshCurrentItem() {
-	i := d.Items[d.idx]
+// call passes the message to the display goroutine and waits for it to be handled.
+// It does not wait if the message was dropped or the display stops.
+func (d *Display) call(f func()) {
+	done := make(chan struct{})
+	if !d.send(func() {
+		f()
+		close(done)
+	}) {
+		return
+	}
+	select {
+	case <-done:
+	case <-d.quit:
+	}
+}
 
+// run handles the messages and moves to the next item when the timer fires.
+// This is the only goroutine that touches the display state.
+func (d *Display) run() {
+	defer close(d.quit)
+	for {
+		var tc <-chan time.Time
+		if d.timer != nil {
+			tc = d.timer.C
+		}
+		select {
+		case f := <-d.msgs:
+			f()
+			if d.exit {
+				return
+			}
+		case <-tc:
+			d.timer = nil
+			d.showNext()
+		}
+	}
+}
+
+// showNext moves to the next item and shows it.
+// While there are alert items, only the alert items are shown.
+func (d *Display) showNext() {
+	d.removeExpired()
+	if !d.isRunning {
+		return
+	}
+	if len(d.items) == 0 {
+		d.idx = -1
+		d.render("")
+		d.resetTimer()
+		return
+	}
+
+	pr := PriorityNormal
+	for _, it := range d.items {
+		if it.Priority > pr {
+			pr = it.Priority
+		}
+	}
+	for n := 1; n <= len(d.items); n++ {
+		i := (d.idx + n) % len(d.items)
+		if d.items[i].Priority == pr {
+			d.idx = i
+			break
+		}
+	}
+	d.showCurrent()
+	d.resetTimer()
+}
+
+// showCurrent shows the current item on the display.
+func (d *Display) showCurrent() {
+	if c := d.current(); c != nil {
+		d.render(c.GetMessage())
+	}
+}
+
+// render writes the message to the display, unless the display is stopped or quiet.
+func (d *Display) render(msg string) {
+	if msg != "" && (!d.isRunning || d.isQuiet) {
+		return
+	}
+	if msg == d.shown {
+		return
+	}
+	w := d.write
+	if w == nil {
+		w = writeCharDisplay
+	}
+	if err := w(msg); err != nil {
+		d.logError("Error setting display.", "error", err)
+		return
+	}
+	d.shown = msg
+}
+
+// resetTimer starts the timer for the current item.
+func (d *Display) resetTimer() {
+	d.stopTimer()
+	if !d.isRunning {
+		return
+	}
+	t := d.ShowTime
+	if c := d.current(); c != nil && c.Duration > 0 {
+		t = c.Duration
+	}
+	d.timer = time.NewTimer(time.Duration(t) * time.Second)
+}
+
+// stopTimer stops the timer for the current item.
+func (d *Display) stopTimer() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+// current returns the item being shown, or nil if there is none.
+func (d *Display) current() *DisplayItem {
+	if d.idx < 0 || d.idx >= len(d.items) {
+		return nil
+	}
+	return d.items[d.idx]
+}
+
+// find returns the index of the named item, or -1 if it is not found.
+func (d *Display) find(name string) int {
+	for i, it := range d.items {
+		if it.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove removes the item, moving on to the next item if it was being shown.
+func (d *Display) remove(i int) {
+	d.items = append(d.items[:i], d.items[i+1:]...)
+	switch {
+	case i < d.idx:
+		d.idx--
+	case i == d.idx:
+		d.idx--
+		d.showNext()
+	}
+}
+
+// removeExpired removes the items that have expired.
+func (d *Display) removeExpired() {
+	now := time.Now()
+	for i := len(d.items) - 1; i >= 0; i-- {
+		if e := d.items[i].Expires; !e.IsZero() && now.After(e) {
+			d.items = append(d.items[:i], d.items[i+1:]...)
+			if i <= d.idx {
+				d.idx--
+			}
+		}
+	}
+}
+
+// writeCharDisplay writes the message to the character display, clearing it if the message is empty.
+func writeCharDisplay(msg string) error {
 	cd := gopitools.CharDisplay{}
-	if err := cd.Message(i.GetMessage()); err != nil {
-		d.logError("Error setting display.", err.Error())
+	if msg == "" {
+		return cd.Clear()
 	}
+	return cd.Message(msg)
 }
 
 // GetMessage will return the display lines formatted for the Character Display
@@ -97,8 +414,18 @@ func (i *DisplayItem) GetMessage() string {
 	return i.Line1 + "\n" + i.Line2
 }
 
+// WriteTo serializes the entity and writes it to the http response
+func (l *DisplayItemList) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
 // logError logs an error message to the logger
-func (d *Display) logError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Error("Display: ", a)
+func (d *Display) logError(msg string, kv ...interface{}) {
+	logEntry("Display", LevelError, msg, kv...)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// displayRecorder records the messages written to the display.
+type displayRecorder struct {
+	msgs []string
+	lock sync.Mutex
+}
+
+func (r *displayRecorder) write(msg string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.msgs = append(r.msgs, msg)
+	return nil
+}
+
+func (r *displayRecorder) last() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.msgs) == 0 {
+		return ""
+	}
+	return r.msgs[len(r.msgs)-1]
+}
+
+func TestDisplayAlertIsPinnedUntilAcknowledged(t *testing.T) {
+	r := &displayRecorder{}
+	d := &Display{ShowTime: 1, write: r.write}
+	d.SetItem("IP", "No IP", "")
+	d.SetItem("LIGHT", "Light", "50")
+	d.Start()
+	if m := d.Items(); m.Current != "IP" {
+		t.Error("Expected IP to be shown but got", m.Current)
+	}
+
+	d.ShowAlert("ALERT:dry", "dry", "28.0")
+	if m := d.Items(); m.Current != "ALERT:dry" || m.Items[0].Name != "ALERT:dry" {
+		t.Error("Expected the alert to be shown first but got", m)
+	}
+	if r.last() != "dry\n28.0" {
+		t.Error("Expected the alert on the display but got", r.last())
+	}
+
+	// Updating the other items must not replace the alert
+	d.SetItem("LIGHT", "Light", "60")
+	if r.last() != "dry\n28.0" {
+		t.Error("Expected the alert to stay on the display but got", r.last())
+	}
+
+	if !d.Acknowledge("ALERT:dry") {
+		t.Error("Expected the alert to be acknowledged")
+	}
+	if m := d.Items(); m.Current == "ALERT:dry" || len(m.Items) != 2 {
+		t.Error("Expected the alert to be removed but got", m)
+	}
+	d.Stop()
+	if r.last() != "" {
+		t.Error("Expected the display to be cleared")
+	}
+}
+
+func TestDisplayItemsExpire(t *testing.T) {
+	d := &Display{ShowTime: 1, write: (&displayRecorder{}).write}
+	d.SetItem("IP", "No IP", "")
+	d.SetPage(DisplayItem{Name: "MSG", Line1: "Hello", Duration: 1, Expires: time.Now().Add(500 * time.Millisecond)})
+	d.Start()
+	time.Sleep(1500 * time.Millisecond)
+	if l := d.Items(); len(l.Items) != 1 || l.Items[0].Name != "IP" {
+		t.Error("Expected the message to have expired but got", l.Items)
+	}
+	d.Stop()
+}
+
+func TestDisplayRefreshBeforeStartDoesNotPanic(t *testing.T) {
+	d := &Display{write: (&displayRecorder{}).write}
+	d.SetQuiet(false)
+	d.SetItem("IP", "No IP", "")
+	d.SetItem("IP", "10.0.", "0.1")
+	if l := d.Items(); l.Current != "" || len(l.Items) != 1 {
+		t.Error("Expected nothing to be shown before starting but got", l)
+	}
+}
+
+func TestDisplayDoesNotBlockWhenNotResponding(t *testing.T) {
+	hung := make(chan struct{})
+	d := &Display{ShowTime: 60, write: func(msg string) error {
+		<-hung
+		return nil
+	}}
+	d.SetItem("IP", "No IP", "")
+	d.Start()
+
+	// The display is stuck writing, so the updates must be dropped rather than wait
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			d.SetItem("LIGHT", "Light", "50")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Updating the display blocked while the display was not responding.")
+	}
+
+	close(hung)
+	d.Stop()
+	select {
+	case <-d.quit:
+	case <-time.After(time.Second):
+		t.Fatal("Display goroutine did not stop.")
+	}
+	// Nothing is waiting for messages after the stop
+	d.SetItem("IP", "No IP", "")
+	d.Items()
+}
+
+func TestDisplayClearsWhenLastItemIsRemoved(t *testing.T) {
+	r := &displayRecorder{}
+	d := &Display{ShowTime: 60, write: r.write}
+	d.SetItem("IP", "No IP", "")
+	d.Start()
+	d.Items()
+	if r.last() != "No IP" {
+		t.Fatal("Expected the item on the display but got", r.last())
+	}
+
+	d.RemoveItem("IP")
+	if l := d.Items(); len(l.Items) != 0 || r.last() != "" {
+		t.Error("Expected the display to be cleared but got", r.last())
+	}
+	d.Stop()
+}
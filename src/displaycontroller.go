@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// DisplayController handles the Web Methods for the LCD display.
+type DisplayController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *DisplayController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/display/get").Name("GetDisplay").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetDisplay)))
+	router.Methods("POST").Path("/display/ack").Name("AcknowledgeDisplay").
+		Handler(Logger(c, http.HandlerFunc(c.handleAcknowledge)))
+}
+
+func (c *DisplayController) handleGetDisplay(w http.ResponseWriter, r *http.Request) {
+	l := c.Srv.LCD.Items()
+	if err := l.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing display items. "+err.Error(), 500)
+	}
+}
+
+func (c *DisplayController) handleAcknowledge(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	// Acknowledges all the alerts if no name is specified
+	n := r.Form.Get("name")
+	if !c.Srv.LCD.Acknowledge(n) && n != "" {
+		http.Error(w, "Alert '"+n+"' is not on the display.", 404)
+		return
+	}
+	c.LogInfo("Acknowledged display alert ", n)
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *DisplayController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("DisplayController", LevelInfo, a)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	rewetJump          = 3.0            // Rise in moisture (%) between readings that is treated as a wetting event
+	maxDryingWindow    = 48 * time.Hour // Maximum age of the readings used to fit the drying rate
+	dryingTempFactor   = 0.05           // Change in drying demand per degree (C) of air temperature from 20C
+	dryingLightFactor  = 0.01           // Change in drying demand per % of light from 50%
+	minDryingDemand    = 0.2            // Minimum drying demand, so that cold dark nights still dry slowly
+	dryingConfidenceSE = 2.0            // Number of standard errors used for the confidence band
+)
+
+// DryingModel estimates when the soil will dry out to the threshold by fitting
+// the decay of the moisture since the soil was last wetted.
+// The drying is weighted by an evaporative demand calculated from the air
+// temperature and light, so that hot bright hours count for more than cold dark hours.
+type DryingModel struct {
+	Srv      *Server        // Server instance
+	Forecast DryingForecast // The latest forecast
+	readings []Measurement  // Successful measurements since the soil was last wetted
+	wettedAt time.Time      // Time the soil was last wetted
+	lock     sync.Mutex     // Guards the model state
+}
+
+// DryingForecast holds the estimated time until the soil reaches the dry threshold.
+type DryingForecast struct {
+	Valid         bool      `json:"valid"`         // There are enough readings to estimate the drying rate
+	Moisture      float64   `json:"moisture"`      // Current moisture
+	Threshold     float64   `json:"threshold"`     // Moisture at which the soil is dry
+	RatePerHour   float64   `json:"ratePerHour"`   // Average moisture lost per hour
+	HoursUntilDry float64   `json:"hoursUntilDry"` // Estimated hours until the soil is dry
+	HoursLow      float64   `json:"hoursLow"`      // Lower bound of the estimate
+	HoursHigh     float64   `json:"hoursHigh"`     // Upper bound of the estimate.  -1 if the soil may not dry out.
+	DryAt         time.Time `json:"dryAt"`         // Time the soil is estimated to be dry
+	WettedAt      time.Time `json:"wettedAt"`      // Time the soil was last wetted
+	Readings      int       `json:"readings"`      // Number of readings used
+	UpdatedAt     time.Time `json:"updatedAt"`     // Time the forecast was calculated
+}
+
+// Evaluate adds the measurement to the model and updates the forecast.
+func (d *DryingModel) Evaluate(v Measurement) DryingForecast {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !v.Success {
+		return d.Forecast
+	}
+
+	// Start again if the soil has been rewetted
+	if l := len(d.readings); l != 0 {
+		last := d.readings[l-1]
+		watered := false
+		if d.Srv.Irrigation != nil {
+			watered = d.Srv.Irrigation.Status().StoppedAt.After(last.DateMeasured)
+		}
+		if watered || v.Moisture-last.Moisture >= rewetJump {
+			d.logInfo("Soil has been rewetted. Resetting the drying rate.")
+			d.readings = nil
+		}
+	}
+	if len(d.readings) == 0 {
+		d.wettedAt = v.DateMeasured
+	}
+	if l := len(d.readings); l != 0 && !v.Has("airTemp") {
+		// Carry the last air temperature forward, so a missing probe does not look like a cold spell
+		v.AirTemp = d.readings[l-1].AirTemp
+	}
+	d.readings = append(d.readings, v)
+	from := v.DateMeasured.Add(-maxDryingWindow)
+	for len(d.readings) > 0 && d.readings[0].DateMeasured.Before(from) {
+		d.readings = d.readings[1:]
+	}
+
+	d.Forecast = PredictDrying(d.readings, d.Srv.Config().DryThreshold, v.DateMeasured)
+	d.Forecast.WettedAt = d.wettedAt
+
+	if d.Forecast.Valid {
+		d.Srv.LCD.SetItem("DRY", "Dry in", fmt.Sprintf("%.1fh", d.Forecast.HoursUntilDry))
+	} else {
+		d.Srv.LCD.SetItem("DRY", "Dry in", "?")
+	}
+	if d.Srv.MqttClient != nil {
+		fc := d.Forecast
+		d.Srv.MqttClient.Async(func() {
+			if err := d.Srv.MqttClient.SendDryingForecast(fc); err != nil {
+				d.logError("Error sending drying forecast to MQTT broker.", "error", err)
+			}
+		})
+	}
+	return d.Forecast
+}
+
+// Current returns the latest forecast.
+func (d *DryingModel) Current() DryingForecast {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.Forecast
+}
+
+// DryingDemand returns the relative evaporative demand for the air temperature and light.
+func DryingDemand(airTemp float64, light float64) float64 {
+	return math.Max(minDryingDemand, 1+dryingTempFactor*(airTemp-20)+dryingLightFactor*(light-50))
+}
+
+// PredictDrying fits the moisture of the readings against the accumulated
+// drying demand, and extrapolates it to the threshold using the average demand.
+func PredictDrying(l []Measurement, threshold float64, now time.Time) DryingForecast {
+	fc := DryingForecast{
+		Threshold: threshold,
+		Readings:  len(l),
+		UpdatedAt: now,
+	}
+	if len(l) == 0 {
+		return fc
+	}
+	fc.Moisture = l[len(l)-1].Moisture
+	if fc.Moisture <= threshold {
+		fc.Valid = true
+		fc.DryAt = now
+		return fc
+	}
+
+	// Need at least an hour of readings to get a meaningful rate
+	hrs := l[len(l)-1].DateMeasured.Sub(l[0].DateMeasured).Hours()
+	if len(l) < 3 || hrs < 1 {
+		return fc
+	}
+
+	// Accumulate the demand weighted hours since the first reading
+	x := make([]float64, len(l))
+	y := make([]float64, len(l))
+	y[0] = l[0].Moisture
+	for i := 1; i < len(l); i++ {
+		dt := l[i].DateMeasured.Sub(l[i-1].DateMeasured).Hours()
+		dm := (DryingDemand(l[i-1].AirTemp, l[i-1].Light) + DryingDemand(l[i].AirTemp, l[i].Light)) / 2
+		x[i] = x[i-1] + dt*dm
+		y[i] = l[i].Moisture
+	}
+	fit, ok := FitLine(x, y)
+	if !ok || fit.Slope >= 0 {
+		return fc
+	}
+
+	// Use the average demand per hour to convert back to real hours
+	avg := x[len(x)-1] / hrs
+	k := -fit.Slope
+	fc.Valid = true
+	fc.RatePerHour = k * avg
+	fc.HoursUntilDry = (fc.Moisture - threshold) / fc.RatePerHour
+	fc.DryAt = now.Add(time.Duration(fc.HoursUntilDry * float64(time.Hour)))
+
+	se := dryingConfidenceSE * fit.SlopeErr
+	fc.HoursLow = (fc.Moisture - threshold) / ((k + se) * avg)
+	if k-se > 0 {
+		fc.HoursHigh = (fc.Moisture - threshold) / ((k - se) * avg)
+	} else {
+		fc.HoursHigh = -1
+	}
+	return fc
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (fc *DryingForecast) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// Serialize serializes the entity and returns the serialized string
+func (fc *DryingForecast) Serialize() (string, error) {
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *DryingModel) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("DryingModel", LevelInfo, a)
+}
+
+func (d *DryingModel) logError(msg string, kv ...interface{}) {
+	logEntry("DryingModel", LevelError, msg, kv...)
+}
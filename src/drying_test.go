@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCanPredictDrying(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)
+	l := []Measurement{}
+	// Losing 1% an hour at a neutral drying demand, reaching 40% now
+	for i := 6; i >= 0; i-- {
+		l = append(l, Measurement{
+			Moisture:     40 + float64(i),
+			AirTemp:      20,
+			Light:        50,
+			DateMeasured: now.Add(-time.Duration(i) * time.Hour),
+			Success:      true,
+		})
+	}
+
+	fc := PredictDrying(l, 30, now)
+	if !fc.Valid {
+		t.Fatal("Forecast is not valid.", fc)
+	}
+	if fc.HoursUntilDry < 9.9 || fc.HoursUntilDry > 10.1 {
+		t.Error("Expected 10 hours until dry but got", fc.HoursUntilDry)
+	}
+	if fc.HoursLow > fc.HoursUntilDry || (fc.HoursHigh != -1 && fc.HoursHigh < fc.HoursUntilDry) {
+		t.Error("Estimate is outside of the confidence band.", fc)
+	}
+}
+
+func TestDryingDemandWeighting(t *testing.T) {
+	if d := DryingDemand(20, 50); d != 1 {
+		t.Error("Expected a neutral demand of 1 but got", d)
+	}
+	if d := DryingDemand(30, 80); math.Abs(d-1.8) > 1e-9 {
+		t.Error("Expected a demand of 1.8 for a hot bright hour but got", d)
+	}
+	if d := DryingDemand(-10, 0); d != minDryingDemand {
+		t.Error("Expected the minimum demand for a cold dark hour but got", d)
+	}
+
+	// Three hot hours at twice the demand, followed by three neutral hours.
+	// The soil loses 1% per unit of demand, so it dries twice as fast while hot.
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)
+	l := []Measurement{}
+	x := 0.0
+	for i := 0; i <= 6; i++ {
+		v := Measurement{AirTemp: 40, Light: 50, DateMeasured: now.Add(time.Duration(i-6) * time.Hour), Success: true}
+		if i > 3 {
+			v.AirTemp = 20
+		}
+		if i > 0 {
+			x = x + (DryingDemand(l[i-1].AirTemp, l[i-1].Light)+DryingDemand(v.AirTemp, v.Light))/2
+		}
+		v.Moisture = 50 - x
+		l = append(l, v)
+	}
+
+	fc := PredictDrying(l, 30, now)
+	if !fc.Valid {
+		t.Fatal("Forecast is not valid.", fc)
+	}
+	// The average demand was 9.5 units over 6 hours
+	if math.Abs(fc.RatePerHour-9.5/6) > 0.01 {
+		t.Error("Expected a rate of 1.58 per hour but got", fc.RatePerHour)
+	}
+	if fc.HoursHigh-fc.HoursLow > 0.01 {
+		t.Error("Weighted readings should fit exactly.", fc)
+	}
+}
+
+func TestDryingResetsWhenRewetted(t *testing.T) {
+	s := newTestServer(&Config{DryThreshold: 30})
+	s.LCD = &Display{write: (&displayRecorder{}).write}
+	d := DryingModel{Srv: s}
+	st := time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)
+	m := func(h int, moisture float64) Measurement {
+		return Measurement{Moisture: moisture, AirTemp: 20, Light: 50, DateMeasured: st.Add(time.Duration(h) * time.Hour), Success: true}
+	}
+
+	d.Evaluate(m(0, 50))
+	d.Evaluate(m(1, 49))
+	d.Evaluate(m(2, 48))
+	// A small rise is noise, not a wetting
+	if fc := d.Evaluate(m(3, 50.9)); fc.Readings != 4 || !fc.WettedAt.Equal(st) {
+		t.Fatal("Drying was reset by a rise of less than 3%.", fc)
+	}
+	if fc := d.Evaluate(m(4, 54)); fc.Readings != 1 || !fc.WettedAt.Equal(m(4, 0).DateMeasured) {
+		t.Fatal("Drying was not reset by a rise of 3%.", fc)
+	}
+
+	// A watering since the last reading resets it, even without a rise
+	d.Evaluate(m(5, 53.5))
+	s.Irrigation = &Irrigator{Srv: s, StoppedAt: st.Add(5*time.Hour + 30*time.Minute)}
+	if fc := d.Evaluate(m(6, 52)); fc.Readings != 1 || !fc.WettedAt.Equal(m(6, 0).DateMeasured) {
+		t.Error("Drying was not reset after irrigation.", fc)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventMeasurement = "measurement" // A measurement was taken
+	EventAlert       = "alert"       // An alert started firing or was resolved
+	EventIrrigation  = "irrigation"  // Watering started or stopped
+	EventConfig      = "config"      // The configuration was changed
+	EventHeartbeat   = "heartbeat"   // Sent periodically so that clients can detect a dead connection
+	EventReset       = "reset"       // Events were missed, so the client must reload its state
+)
+
+const (
+	eventHistory    = 100 // Number of events kept so that clients can resume
+	eventClientSize = 32  // Number of events queued for a client before it is dropped
+)
+
+// ErrTooManyClients is returned when the maximum number of stream clients are connected.
+var ErrTooManyClients = errors.New("too many stream clients are connected")
+
+// Event holds a single event sent to the stream clients.
+type Event struct {
+	ID   uint64          `json:"id"`   // Sequence number of the event.  0 for heartbeats.
+	Type string          `json:"type"` // Type of event
+	Time time.Time       `json:"time"` // Time the event happened
+	Data json.RawMessage `json:"data"` // The event data
+}
+
+// EventHub fans the events out to the clients connected to the live stream.
+// The most recent events are kept so that a client that reconnects can resume
+// from the last event it saw.  Clients that fall behind are dropped rather
+// than holding up the rest of the service.
+type EventHub struct {
+	Srv     *Server                   // Server instance
+	nextID  uint64                    // Sequence number of the next event
+	history []Event                   // The most recent events, oldest first
+	clients map[*EventClient]struct{} // Connected clients
+	lock    sync.Mutex                // Guards the hub state
+}
+
+// eventEpoch returns the sequence number the events start after.  It is taken
+// from the start time, so that the IDs after a restart are higher than any a
+// client saw before, and a client resuming from an old ID is sent a reset.
+func eventEpoch(t time.Time) uint64 {
+	return uint64(t.UnixNano()/int64(time.Millisecond)) * 1000
+}
+
+// EventClient receives the events for a single stream connection.
+type EventClient struct {
+	C      chan Event      // The events.  Closed when the client is dropped or the hub is closed.
+	types  map[string]bool // Event types the client wants.  Empty for all.
+	closed bool            // C has been closed
+}
+
+// Publish sends the event to the connected clients.  It never blocks.
+func (h *EventHub) Publish(typ string, v interface{}) {
+	if h == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		h.logError("Error serializing event.", "type", typ, "error", err)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.nextID++
+	e := Event{ID: h.nextID, Type: typ, Time: time.Now(), Data: b}
+	h.history = append(h.history, e)
+	if len(h.history) > eventHistory {
+		h.history = h.history[len(h.history)-eventHistory:]
+	}
+	for c := range h.clients {
+		if !c.wants(typ) {
+			continue
+		}
+		select {
+		case c.C <- e:
+		default:
+			logEntry("EventHub", LevelWarning, "Dropping a stream client that has fallen behind.")
+			h.drop(c)
+		}
+	}
+}
+
+// Subscribe connects a client, and returns the events after lastID that it
+// missed.  If those events are no longer kept, or the ID is from before a
+// restart, a reset event is returned first.
+// types limits the event types sent to the client; empty for all types.
+func (h *EventHub) Subscribe(lastID uint64, types []string) (*EventClient, []Event, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	max := 5
+	if h.Srv != nil {
+		if n := h.Srv.Config().StreamClients; n > 0 {
+			max = n
+		}
+	}
+	if len(h.clients) >= max {
+		return nil, nil, ErrTooManyClients
+	}
+
+	c := &EventClient{C: make(chan Event, eventClientSize), types: map[string]bool{}}
+	for _, t := range types {
+		if t != "" {
+			c.types[t] = true
+		}
+	}
+	if h.clients == nil {
+		h.clients = map[*EventClient]struct{}{}
+	}
+	h.clients[c] = struct{}{}
+
+	missed := []Event{}
+	if lastID > h.nextID {
+		// The ID was not given out by this hub, so the service has restarted
+		missed = append(missed, Event{Type: EventReset, Time: time.Now(), Data: json.RawMessage("{}")})
+	} else if lastID > 0 && lastID < h.nextID {
+		if len(h.history) == 0 || h.history[0].ID > lastID+1 {
+			missed = append(missed, Event{Type: EventReset, Time: time.Now(), Data: json.RawMessage("{}")})
+		}
+		for _, e := range h.history {
+			if e.ID > lastID && c.wants(e.Type) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	return c, missed, nil
+}
+
+// Unsubscribe disconnects the client.
+func (h *EventHub) Unsubscribe(c *EventClient) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.drop(c)
+}
+
+// Clients returns the number of connected clients.
+func (h *EventHub) Clients() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.clients)
+}
+
+// Close disconnects all the clients, so that the streams end.
+func (h *EventHub) Close() {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for c := range h.clients {
+		h.drop(c)
+	}
+}
+
+// drop removes the client and closes its channel.  The lock must be held.
+func (h *EventHub) drop(c *EventClient) {
+	delete(h.clients, c)
+	if !c.closed {
+		c.closed = true
+		close(c.C)
+	}
+}
+
+// heartbeatInterval returns the time between heartbeat events.
+func (h *EventHub) heartbeatInterval() time.Duration {
+	if h.Srv != nil {
+		if n := h.Srv.Config().StreamHeartbeat; n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return 15 * time.Second
+}
+
+// wants returns whether the client wants events of the type.
+func (c *EventClient) wants(typ string) bool {
+	return len(c.types) == 0 || c.types[typ]
+}
+
+// newHeartbeat returns a heartbeat event.
+func newHeartbeat() Event {
+	return Event{Type: EventHeartbeat, Time: time.Now(), Data: json.RawMessage("{}")}
+}
+
+// WriteSSE writes the event in the Server-Sent Events format.
+func (e *Event) WriteSSE(w http.ResponseWriter) error {
+	s := ""
+	if e.ID > 0 {
+		s = fmt.Sprintf("id: %d\n", e.ID)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%sevent: %s\ndata: %s\n\n", s, e.Type, b)
+	return err
+}
+
+func (h *EventHub) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("EventHub", LevelInfo, a)
+}
+
+func (h *EventHub) logError(msg string, kv ...interface{}) {
+	logEntry("EventHub", LevelError, msg, kv...)
+}
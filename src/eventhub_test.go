@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestEventHubResume(t *testing.T) {
+	s := newTestServer(&Config{})
+	h := s.Events
+	for i := 0; i < 3; i++ {
+		h.Publish(EventMeasurement, Measurement{Moisture: float64(i)})
+	}
+	h.Publish(EventAlert, Alert{Rule: "dry"})
+
+	c, missed, err := h.Subscribe(1, []string{EventMeasurement})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Unsubscribe(c)
+	if len(missed) != 2 || missed[0].ID != 2 || missed[1].ID != 3 {
+		t.Error("Expected measurements 2 and 3 but got", missed)
+	}
+
+	// Events that are no longer kept need a reset
+	for i := 0; i < eventHistory; i++ {
+		h.Publish(EventConfig, ConfigApplyResult{})
+	}
+	c2, missed, _ := h.Subscribe(2, nil)
+	defer h.Unsubscribe(c2)
+	if len(missed) == 0 || missed[0].Type != EventReset {
+		t.Error("Expected a reset event first")
+	}
+}
+
+func TestEventHubResumeAfterRestart(t *testing.T) {
+	st := time.Now()
+	h := &EventHub{nextID: eventEpoch(st)}
+	h.Publish(EventMeasurement, Measurement{})
+	h.Publish(EventMeasurement, Measurement{})
+	last := h.history[1].ID
+
+	// The restarted hub has already published as many events as the client saw
+	h = &EventHub{nextID: eventEpoch(st.Add(time.Second))}
+	h.Publish(EventMeasurement, Measurement{})
+	h.Publish(EventMeasurement, Measurement{})
+	c, missed, _ := h.Subscribe(last, nil)
+	defer h.Unsubscribe(c)
+	if len(missed) == 0 || missed[0].Type != EventReset {
+		t.Error("Expected a reset event first but got", missed)
+	}
+
+	// An ID the hub has not reached yet also needs a reset
+	h = &EventHub{}
+	h.Publish(EventMeasurement, Measurement{})
+	c2, missed, _ := h.Subscribe(5, nil)
+	defer h.Unsubscribe(c2)
+	if len(missed) != 1 || missed[0].Type != EventReset {
+		t.Error("Expected only a reset event but got", missed)
+	}
+}
+
+func TestEventHubLimits(t *testing.T) {
+	s := newTestServer(&Config{})
+	changeTestConfig(s, func(c *Config) { c.StreamClients = 2 })
+	h := s.Events
+	a, _, _ := h.Subscribe(0, nil)
+	h.Subscribe(0, []string{EventAlert})
+	if _, _, err := h.Subscribe(0, nil); err != ErrTooManyClients {
+		t.Error("Expected too many clients but got", err)
+	}
+
+	// A client that does not read is dropped, and does not hold up the others
+	for i := 0; i <= eventClientSize; i++ {
+		h.Publish(EventMeasurement, Measurement{})
+	}
+	if _, ok := <-a.C; !ok {
+		t.Fatal("Expected the queued events before the channel is closed")
+	}
+	for range a.C {
+	}
+	if h.Clients() != 1 {
+		t.Error("Expected the slow client to be dropped but there are", h.Clients())
+	}
+	h.Close()
+	if h.Clients() != 0 {
+		t.Error("Expected all the clients to be closed")
+	}
+}
+
+func TestEventStreamSSE(t *testing.T) {
+	s := newTestServer(&Config{})
+	r := mux.NewRouter()
+	c := &StreamController{}
+	c.AddController(r, s)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	s.Events.Publish(EventMeasurement, Measurement{Moisture: 40})
+	s.Events.Publish(EventMeasurement, Measurement{Moisture: 41})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL+"/stream/events", nil)
+	req = req.WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("content-type"); ct != "text/event-stream" {
+		t.Fatal("Unexpected content type", ct)
+	}
+
+	s.Events.Publish(EventAlert, Alert{Rule: "dry"})
+	sc := bufio.NewScanner(resp.Body)
+	ids := []string{}
+	for sc.Scan() && len(ids) < 2 {
+		if l := sc.Text(); strings.HasPrefix(l, "id: ") {
+			ids = append(ids, strings.TrimPrefix(l, "id: "))
+		}
+	}
+	if strings.Join(ids, ",") != "2,3" {
+		t.Error("Expected events 2 and 3 but got", ids)
+	}
+}
+
+func TestEventStreamWebSocket(t *testing.T) {
+	s := newTestServer(&Config{})
+	r := mux.NewRouter()
+	c := &StreamController{}
+	c.AddController(r, s)
+	changeTestConfig(s, func(c *Config) { c.StreamHeartbeat = 1 })
+	// The server does not wait for a hijacked connection to finish, so wait for the handler here
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r2 *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		r.ServeHTTP(w, r2)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stream/ws?types=irrigation", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for s.Events.Clients() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Events.Publish(EventMeasurement, Measurement{})
+	s.Events.Publish(EventIrrigation, WateringEvent{Trigger: "manual"})
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	e := Event{}
+	if err := ws.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	we := WateringEvent{}
+	json.Unmarshal(e.Data, &we)
+	if e.Type != EventIrrigation || e.ID != 2 || we.Trigger != "manual" {
+		t.Error("Expected the irrigation event but got", e)
+	}
+	if err := ws.ReadJSON(&e); err != nil || e.Type != EventHeartbeat {
+		t.Error("Expected a heartbeat but got", e, err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ForecastController handles the Web Methods for reading the forecasts.
+type ForecastController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *ForecastController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/forecast/frost").Name("GetFrostForecast").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetFrost)))
+	router.Methods("GET").Path("/forecast/drying").Name("GetDryingForecast").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetDrying)))
+}
+
+func (c *ForecastController) handleGetFrost(w http.ResponseWriter, r *http.Request) {
+	v := c.Srv.Frost.Current()
+	if err := v.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing frost forecast. "+err.Error(), 500)
+	}
+}
+
+func (c *ForecastController) handleGetDrying(w http.ResponseWriter, r *http.Request) {
+	v := c.Srv.Drying.Current()
+	if err := v.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing drying forecast. "+err.Error(), 500)
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *ForecastController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("ForecastController", LevelInfo, a)
+}
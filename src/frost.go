@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	frostAlertName  = "frost"     // Name of the alert raised for a frost warning
+	frostHysteresis = 1.0         // Amount (C) the predicted minimum must rise above the threshold before the warning clears
+	frostStep       = time.Minute // Step used to search the fitted curve for the minimum and the crossing
+)
+
+// FrostPredictor estimates when the air temperature will drop below the
+// frost threshold by fitting a curve through the recent air temperatures.
+type FrostPredictor struct {
+	Srv      *Server       // Server instance
+	Forecast FrostForecast // The latest forecast
+	readings []Measurement // Recent successful measurements
+	lock     sync.Mutex    // Guards the predictor state
+}
+
+// FrostForecast holds the result of a frost prediction.
+type FrostForecast struct {
+	Warning        bool      `json:"warning"`        // Frost is expected within the lead time
+	Threshold      float64   `json:"threshold"`      // Frost threshold temperature
+	Current        float64   `json:"current"`        // Current air temperature
+	Trend          float64   `json:"trend"`          // Rate of change of the air temperature (C per hour)
+	PredictedMin   float64   `json:"predictedMin"`   // Predicted minimum air temperature within the lead time, up to the sunrise
+	PredictedMinAt time.Time `json:"predictedMinAt"` // Time the predicted minimum is expected
+	CrossingAt     time.Time `json:"crossingAt"`     // Time the threshold is expected to be crossed.  Zero if not expected.
+	Readings       int       `json:"readings"`       // Number of readings used for the trend
+	UpdatedAt      time.Time `json:"updatedAt"`      // Time the forecast was calculated
+}
+
+// Evaluate adds the measurement to the recent readings, updates the forecast
+// and raises or clears the frost warning.
+func (f *FrostPredictor) Evaluate(v Measurement) FrostForecast {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	c := f.Srv.Config()
+	if !c.EnableFrost {
+		// The alert may have been loaded from a previous run, so it is always cleared
+		f.Forecast.Warning = false
+		f.Srv.Alerts.Clear(frostAlertName, f.Forecast.PredictedMin)
+		return f.Forecast
+	}
+	if !v.Success || !v.Has("airTemp") {
+		// Without the air temperature there is nothing to add to the trend
+		return f.Forecast
+	}
+
+	// Only keep the readings inside the trend window
+	f.readings = append(f.readings, v)
+	from := v.DateMeasured.Add(-time.Duration(c.FrostWindow) * time.Minute)
+	for len(f.readings) > 0 && f.readings[0].DateMeasured.Before(from) {
+		f.readings = f.readings[1:]
+	}
+
+	was := f.Forecast.Warning
+	f.Forecast = PredictFrost(f.readings, c.FrostThreshold, time.Duration(c.FrostLeadTime)*time.Hour, f.nextSunrise(v.DateMeasured), v.DateMeasured)
+	if was && !f.Forecast.Warning && f.Forecast.PredictedMin < c.FrostThreshold+frostHysteresis {
+		// Keep the warning until the prediction is clear of the threshold
+		f.Forecast.Warning = true
+	}
+
+	if f.Forecast.Warning {
+		msg := fmt.Sprintf("Frost expected. Predicted minimum %.1fC at %s", f.Forecast.PredictedMin, f.Forecast.PredictedMinAt.Format("15:04"))
+		if !f.Forecast.CrossingAt.IsZero() {
+			msg = msg + fmt.Sprintf(", below %.1fC from %s", c.FrostThreshold, f.Forecast.CrossingAt.Format("15:04"))
+		}
+		f.Srv.Alerts.Raise(frostAlertName, msg, f.Forecast.PredictedMin)
+	} else {
+		f.Srv.Alerts.Clear(frostAlertName, f.Forecast.PredictedMin)
+	}
+
+	if f.Srv.MqttClient != nil {
+		fc := f.Forecast
+		f.Srv.MqttClient.Async(func() {
+			if err := f.Srv.MqttClient.SendFrostForecast(fc); err != nil {
+				f.logError("Error sending frost forecast to MQTT broker.", "error", err)
+			}
+		})
+	}
+	return f.Forecast
+}
+
+// Current returns the latest forecast.
+func (f *FrostPredictor) Current() FrostForecast {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.Forecast
+}
+
+// nextSunrise returns the next sunrise seen by the light sensor, defaulting to 06:00.
+func (f *FrostPredictor) nextSunrise(now time.Time) time.Time {
+	m := defaultDaylight.Start
+	if f.Srv.Light != nil {
+		if w, ok := f.Srv.Light.Daylight(); ok {
+			m = w.Start
+		}
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Add(time.Duration(m) * time.Minute)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// PredictFrost fits a curve through the air temperatures of the readings and finds
+// its minimum up to the lead time from now.  The air warms again after the sunrise,
+// so the curve is not followed past it.  The cooling slows down through the night,
+// so a quadratic is used when it fits that shape, and a straight line otherwise.
+func PredictFrost(l []Measurement, threshold float64, lead time.Duration, sunrise time.Time, now time.Time) FrostForecast {
+	fc := FrostForecast{
+		Threshold: threshold,
+		Readings:  len(l),
+		UpdatedAt: now,
+	}
+	if len(l) == 0 {
+		return fc
+	}
+	fc.Current = l[len(l)-1].AirTemp
+	fc.PredictedMin = fc.Current
+	fc.PredictedMinAt = now
+
+	// Need at least 30 minutes of readings to get a meaningful trend
+	if len(l) < 3 || l[len(l)-1].DateMeasured.Sub(l[0].DateMeasured) < 30*time.Minute {
+		fc.Warning = fc.Current <= threshold
+		return fc
+	}
+
+	x := make([]float64, len(l))
+	y := make([]float64, len(l))
+	for i, v := range l {
+		x[i] = v.DateMeasured.Sub(now).Hours()
+		y[i] = v.AirTemp
+	}
+	fit, ok := FitLine(x, y)
+	if !ok {
+		return fc
+	}
+	fc.Trend = fit.Slope
+	curve := fit.At
+	if q, ok := FitQuadratic(x, y); ok && len(l) > 3 && q.A > 0 {
+		curve = q.At
+	}
+
+	end := now.Add(lead)
+	if !sunrise.IsZero() && sunrise.Before(end) {
+		end = sunrise
+	}
+	if fc.Current <= threshold {
+		fc.CrossingAt = now
+	}
+	prev := fc.Current
+	for t := now.Add(frostStep); !t.After(end); t = t.Add(frostStep) {
+		v := curve(t.Sub(now).Hours())
+		if v < fc.PredictedMin {
+			fc.PredictedMin = v
+			fc.PredictedMinAt = t
+		}
+		if fc.CrossingAt.IsZero() && v <= threshold {
+			// Interpolate the crossing time within the step
+			f := (prev - threshold) / (prev - v)
+			fc.CrossingAt = t.Add(-frostStep).Add(time.Duration(f * float64(frostStep)))
+		}
+		prev = v
+	}
+	fc.Warning = fc.PredictedMin <= threshold || fc.Current <= threshold
+	return fc
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (fc *FrostForecast) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// Serialize serializes the entity and returns the serialized string
+func (fc *FrostForecast) Serialize() (string, error) {
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (f *FrostPredictor) logError(msg string, kv ...interface{}) {
+	logEntry("FrostPredictor", LevelError, msg, kv...)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCanPredictFrost(t *testing.T) {
+	now := time.Date(2020, 6, 1, 21, 0, 0, 0, time.Local)
+	l := []Measurement{}
+	// Cooling by 1C an hour, reaching 5C now
+	for i := 12; i >= 0; i-- {
+		l = append(l, Measurement{
+			AirTemp:      5 + float64(i)/6,
+			DateMeasured: now.Add(-time.Duration(i*10) * time.Minute),
+			Success:      true,
+		})
+	}
+
+	fc := PredictFrost(l, 0, 6*time.Hour, time.Time{}, now)
+	if !fc.Warning {
+		t.Fatal("Frost warning was not raised.", fc)
+	}
+	if fc.CrossingAt.Sub(now).Round(time.Minute) != 5*time.Hour {
+		t.Error("Expected crossing in 5 hours but got", fc.CrossingAt.Sub(now))
+	}
+	if fc.PredictedMin > -0.9 || fc.PredictedMin < -1.1 {
+		t.Error("Expected predicted minimum of -1 but got", fc.PredictedMin)
+	}
+
+	fc = PredictFrost(l, 0, 4*time.Hour, time.Time{}, now)
+	if fc.Warning {
+		t.Error("Frost warning was raised outside the lead time.", fc)
+	}
+}
+
+func TestCoolingEveningDoesNotPredictFrost(t *testing.T) {
+	now := time.Date(2020, 6, 1, 21, 0, 0, 0, time.Local)
+	l := []Measurement{}
+	// Cooling quickly after the sunset and levelling off towards 6C
+	for i := 18; i >= 0; i-- {
+		h := 3 - float64(i)/6
+		l = append(l, Measurement{
+			AirTemp:      6 + 10*math.Exp(-h/2),
+			DateMeasured: now.Add(-time.Duration(i*10) * time.Minute),
+			Success:      true,
+		})
+	}
+
+	fc := PredictFrost(l, 0, 6*time.Hour, time.Time{}, now)
+	if fc.Warning {
+		t.Error("Frost warning was raised for an ordinary cooling evening.", fc)
+	}
+	if fc.Trend >= 0 || fc.PredictedMin < 4 || !fc.PredictedMinAt.Before(now.Add(6*time.Hour)) {
+		t.Error("Expected the minimum of the cooling curve before the end of the lead time but got", fc)
+	}
+}
+
+func TestFrostPredictionStopsAtSunrise(t *testing.T) {
+	now := time.Date(2020, 6, 1, 2, 0, 0, 0, time.Local)
+	l := []Measurement{}
+	// Cooling by 1C an hour, reaching 4C now
+	for i := 12; i >= 0; i-- {
+		l = append(l, Measurement{
+			AirTemp:      4 + float64(i)/6,
+			DateMeasured: now.Add(-time.Duration(i*10) * time.Minute),
+			Success:      true,
+		})
+	}
+
+	sunrise := time.Date(2020, 6, 1, 5, 0, 0, 0, time.Local)
+	fc := PredictFrost(l, 0, 6*time.Hour, sunrise, now)
+	if fc.Warning {
+		t.Error("Frost warning was raised for after the sunrise.", fc)
+	}
+	if !fc.PredictedMinAt.Equal(sunrise) || math.Abs(fc.PredictedMin-1) > 0.01 {
+		t.Error("Expected a minimum of 1C at the sunrise but got", fc.PredictedMin, fc.PredictedMinAt)
+	}
+
+	f := FrostPredictor{Srv: newTestServer(&Config{})}
+	if n := f.nextSunrise(time.Date(2020, 6, 1, 21, 0, 0, 0, time.Local)); !n.Equal(time.Date(2020, 6, 2, 6, 0, 0, 0, time.Local)) {
+		t.Error("Expected the next sunrise at 06:00 the next day but got", n)
+	}
+}
+
+func TestFrostAlertClearsAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	s := newTestServer(&Config{EnableFrost: true, FrostThreshold: 0, FrostWindow: 120, FrostLeadTime: 6})
+	s.Alerts = &AlertManager{Srv: s, FilePath: path}
+	s.Alerts.Raise(frostAlertName, "Frost expected.", -1)
+
+	// A new predictor, with the firing alert loaded from the file
+	s.Alerts = &AlertManager{Srv: s, FilePath: path}
+	if err := s.Alerts.Load(); err != nil {
+		t.Fatal(err)
+	}
+	f := FrostPredictor{Srv: s}
+	f.Evaluate(Measurement{Success: true, AirTemp: 15, DateMeasured: time.Now()})
+	if l := s.Alerts.Active(); len(l) != 0 {
+		t.Error("Frost alert was not cleared after the restart.", l)
+	}
+
+	// Also when frost prediction has been disabled
+	s.Alerts.Raise(frostAlertName, "Frost expected.", -1)
+	changeTestConfig(s, func(c *Config) { c.EnableFrost = false })
+	f = FrostPredictor{Srv: s}
+	f.Evaluate(Measurement{Success: true, AirTemp: 15, DateMeasured: time.Now()})
+	if l := s.Alerts.Active(); len(l) != 0 {
+		t.Error("Frost alert was not cleared when disabled.", l)
+	}
+}
+
+func TestFrostSkipsMissingAirTemperature(t *testing.T) {
+	s := newTestServer(&Config{EnableFrost: true, FrostThreshold: 0, FrostWindow: 120, FrostLeadTime: 6})
+	s.Alerts = &AlertManager{Srv: s}
+	f := FrostPredictor{Srv: s}
+
+	// The air temperature probe is disconnected, so the 0C reading is not real
+	fc := f.Evaluate(Measurement{Success: true, Moisture: 40, Missing: []string{"airTemp"}, DateMeasured: time.Now()})
+	if fc.Warning || fc.Readings != 0 {
+		t.Error("Missing air temperature was added to the trend.", fc)
+	}
+	if l := s.Alerts.Active(); len(l) != 0 {
+		t.Error("Frost alert was raised for a missing air temperature.", l)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Health statuses
+const (
+	HealthHealthy   = "healthy"   // Everything is working
+	HealthDegraded  = "degraded"  // The unit is working, but something needs attention
+	HealthUnhealthy = "unhealthy" // The unit is not doing its job
+	HealthIgnore    = "ignore"    // A failing check does not change the status of the unit
+)
+
+// defaultHealthRules holds the status a failing check gives the unit, keyed by check name.
+// The rules can be changed with the healthRules configuration value.
+var defaultHealthRules = map[string]string{
+	"measurement": HealthUnhealthy,
+	"sensors":     HealthDegraded,
+	"mqtt":        HealthDegraded,
+	"thingspeak":  HealthDegraded,
+	"finder":      HealthDegraded,
+	"scheduler":   HealthUnhealthy,
+	"disk":        HealthDegraded,
+}
+
+// HealthCheck holds the result of a single health check.
+type HealthCheck struct {
+	Name    string `json:"name"`    // Name of the check
+	Status  string `json:"status"`  // Status the check gives the unit
+	Message string `json:"message"` // Description of the result
+}
+
+// HealthReport holds the health of the unit and each of its subsystems.
+type HealthReport struct {
+	Status          string             `json:"status"`          // Overall status ("healthy", "degraded" or "unhealthy")
+	Checks          []HealthCheck      `json:"checks"`          // Result of each check
+	Started         time.Time          `json:"started"`         // Time the service started
+	Uptime          float64            `json:"uptime"`          // Time (in seconds) since the service started
+	LastMeasurement time.Time          `json:"lastMeasurement"` // Time of the last successful measurement
+	MeasurementAge  float64            `json:"measurementAge"`  // Time (in seconds) since the last successful measurement.  -1 if there is none.
+	Sensors         []SensorStatus     `json:"sensors"`         // State of each sensor
+	Mqtt            MqttStatus         `json:"mqtt"`            // State of the MQTT connection
+	Thingspeak      ThingspeakStatus   `json:"thingspeak"`      // Result of the last send to Thingspeak
+	Finder          RegistrationStatus `json:"finder"`          // State of the Finder registration
+	NextRun         time.Time          `json:"nextRun"`         // Time of the next scheduled measurement
+	DiskFree        uint64             `json:"diskFree"`        // Free disk space (in bytes)
+	DiskTotal       uint64             `json:"diskTotal"`       // Total disk space (in bytes)
+}
+
+// ReadyReport holds whether the unit is ready to serve requests.
+type ReadyReport struct {
+	Ready   bool     `json:"ready"`   // The unit is ready
+	Reasons []string `json:"reasons"` // Why the unit is not ready
+}
+
+// staleAge returns how long after the time a measurement is stale.  Unless it
+// has been configured, three of the scheduled runs that follow may be missed.
+func (s *Server) staleAge(c *Config, after time.Time) time.Duration {
+	if c.HealthStaleAge > 0 {
+		return time.Duration(c.HealthStaleAge) * time.Minute
+	}
+	// Step from run to run, as a measurement taken from the web falls between them
+	n := after
+	for i := 0; i < 3; i++ {
+		n = n.Add(s.sampleInterval(n))
+	}
+	return n.Sub(after)
+}
+
+// Health checks each of the subsystems and returns the health of the unit.
+func (s *Server) Health() HealthReport {
+	now := time.Now()
+	c := s.Config()
+	r := HealthReport{
+		Status:         HealthHealthy,
+		Checks:         []HealthCheck{},
+		Started:        s.started,
+		Uptime:         now.Sub(s.started).Seconds(),
+		MeasurementAge: -1,
+		Sensors:        s.Monitor.Sensors(),
+		Thingspeak:     s.Monitor.Thingspeak(),
+		Finder:         s.Registration(),
+	}
+
+	// Last successful measurement
+	_, last := s.Monitor.Last()
+	r.LastMeasurement = last.DateMeasured
+	switch {
+	case !last.DateMeasured.IsZero():
+		age := now.Sub(last.DateMeasured)
+		r.MeasurementAge = age.Seconds()
+		r.check(c, "measurement", age <= s.staleAge(c, last.DateMeasured), fmt.Sprintf("last successful measurement was %s ago", age.Round(time.Second)))
+	case now.Sub(s.started) < s.staleAge(c, s.started):
+		r.check(c, "measurement", true, "waiting for the first measurement")
+	default:
+		r.check(c, "measurement", false, "no successful measurement has been taken")
+	}
+
+	// Sensors
+	failed := []string{}
+	for _, st := range r.Sensors {
+		if !st.Reading {
+			failed = append(failed, st.Name+" "+st.Error)
+		}
+	}
+	switch {
+	case len(r.Sensors) == 0:
+		r.check(c, "sensors", true, "sensors have not been read yet")
+	case len(failed) != 0:
+		r.check(c, "sensors", false, strings.Join(failed, "; "))
+	default:
+		r.check(c, "sensors", true, "all sensors are reading")
+	}
+
+	// MQTT
+	if s.MqttClient != nil {
+		r.Mqtt = s.MqttClient.Status()
+	}
+	switch {
+	case !r.Mqtt.Enabled:
+		r.check(c, "mqtt", true, "disabled")
+	case !r.Mqtt.Connected:
+		r.check(c, "mqtt", false, "not connected to the broker")
+	case r.Mqtt.LastUpdateAttempt.After(r.Mqtt.LastUpdate):
+		r.check(c, "mqtt", false, "last update failed")
+	default:
+		r.check(c, "mqtt", true, "connected")
+	}
+
+	// Thingspeak
+	switch {
+	case !r.Thingspeak.Enabled:
+		r.check(c, "thingspeak", true, "disabled")
+	case r.Thingspeak.Error != "":
+		r.check(c, "thingspeak", false, "last send failed. "+r.Thingspeak.Error)
+	default:
+		r.check(c, "thingspeak", true, "last send succeeded")
+	}
+
+	// Finder
+	switch {
+	case r.Finder.Registered:
+		r.check(c, "finder", true, "registered")
+	case r.Finder.Error != "":
+		r.check(c, "finder", false, "registration failed. "+r.Finder.Error)
+	default:
+		r.check(c, "finder", true, "waiting for other devices")
+	}
+
+	// Scheduler
+	sc := s.Scheduler()
+	if sc != nil {
+		r.NextRun = sc.Status(0).NextRun
+	}
+	switch {
+	case sc == nil || r.NextRun.IsZero():
+		r.check(c, "scheduler", false, "not running")
+	case now.Sub(r.NextRun) > 2*time.Minute:
+		r.check(c, "scheduler", false, "next run is overdue")
+	default:
+		r.check(c, "scheduler", true, "next run at "+r.NextRun.Format("15:04"))
+	}
+
+	// Disk space
+	free, total, err := diskSpace(".")
+	r.DiskFree = free
+	r.DiskTotal = total
+	switch {
+	case err != nil:
+		r.check(c, "disk", true, err.Error())
+	default:
+		min := uint64(c.HealthMinDisk) * 1024 * 1024
+		r.check(c, "disk", free >= min, fmt.Sprintf("%d MB free", free/1024/1024))
+	}
+
+	return r
+}
+
+// Ready returns whether the unit is ready: it has finished starting up and
+// taken its first measurement, and is not shutting down.
+func (s *Server) Ready() ReadyReport {
+	r := ReadyReport{Reasons: []string{}}
+	if s.Config() == nil || s.Applier == nil {
+		r.Reasons = append(r.Reasons, "configuration has not been loaded")
+	}
+	if lr, _ := s.Monitor.Last(); lr.IsZero() {
+		r.Reasons = append(r.Reasons, "first measurement has not been taken")
+	}
+	if s.Scheduler() == nil {
+		r.Reasons = append(r.Reasons, "scheduler has not been started")
+	}
+	if s.stopping() {
+		r.Reasons = append(r.Reasons, "service is shutting down")
+	}
+	r.Ready = len(r.Reasons) == 0
+	return r
+}
+
+// HTTPStatus returns the HTTP status code for the health of the unit.
+func (r *HealthReport) HTTPStatus(c *Config) int {
+	switch r.Status {
+	case HealthUnhealthy:
+		return http.StatusServiceUnavailable
+	case HealthDegraded:
+		if c.DegradedCode > 0 {
+			return c.DegradedCode
+		}
+	}
+	return http.StatusOK
+}
+
+// check adds the result of the check, and lowers the status of the unit if the
+// check failed, according to the health rules.
+func (r *HealthReport) check(c *Config, name string, ok bool, msg string) {
+	hc := HealthCheck{Name: name, Status: HealthHealthy, Message: msg}
+	if !ok {
+		hc.Status = defaultHealthRules[name]
+		if rule, found := c.HealthRules[name]; found {
+			hc.Status = rule
+		}
+	}
+	r.Checks = append(r.Checks, hc)
+	if healthRank(hc.Status) > healthRank(r.Status) {
+		r.Status = hc.Status
+	}
+}
+
+// healthRank orders the statuses from best to worst.
+func healthRank(st string) int {
+	switch st {
+	case HealthDegraded:
+		return 1
+	case HealthUnhealthy:
+		return 2
+	}
+	return 0
+}
+
+// HealthChecks returns the names of the health checks.
+func HealthChecks() []string {
+	l := []string{}
+	for n := range defaultHealthRules {
+		l = append(l, n)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// WriteTo serializes the entity and writes it to the http response with the status code
+func (r *HealthReport) WriteTo(w http.ResponseWriter, status int) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b)
+	return nil
+}
+
+// WriteTo serializes the entity and writes it to the http response with the status code
+func (r *ReadyReport) WriteTo(w http.ResponseWriter, status int) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b)
+	return nil
+}
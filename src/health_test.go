@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newHealthTest returns a server that has been running for an hour with all its sensors reading.
+func newHealthTest() *Server {
+	s := newTestServer(&Config{})
+	s.started = time.Now().Add(-time.Hour)
+	s.scheduler = &Scheduler{Srv: s, NextRun: time.Now().Add(time.Minute)}
+	s.Monitor.addMeasurement(Measurement{Success: true, DateMeasured: time.Now().Add(-time.Minute)})
+	s.Monitor.setSensor("airTemp", true, nil)
+	s.Monitor.setSensor("soilTemp", true, nil)
+	return s
+}
+
+func findHealthCheck(r HealthReport, name string) HealthCheck {
+	for _, c := range r.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	return HealthCheck{}
+}
+
+func TestHealthIsHealthy(t *testing.T) {
+	s := newHealthTest()
+	r := s.Health()
+	if r.Status != HealthHealthy || r.HTTPStatus(s.Config()) != 200 {
+		t.Error("Expected healthy but got", r.Status, r.Checks)
+	}
+	if r.MeasurementAge < 60 || len(r.Sensors) != 2 {
+		t.Error("Unexpected report", r.MeasurementAge, r.Sensors)
+	}
+}
+
+func TestHealthFailingChecks(t *testing.T) {
+	s := newHealthTest()
+	s.Monitor.setSensor("soilTemp", false, nil)
+	r := s.Health()
+	if r.Status != HealthDegraded || findHealthCheck(r, "sensors").Status != HealthDegraded {
+		t.Error("Expected degraded for a missing sensor but got", r.Status)
+	}
+
+	// The rules decide the status of a failing check
+	changeTestConfig(s, func(c *Config) { c.HealthRules = map[string]string{"sensors": HealthUnhealthy} })
+	r = s.Health()
+	if r.Status != HealthUnhealthy || r.HTTPStatus(s.Config()) != 503 {
+		t.Error("Expected unhealthy but got", r.Status, r.HTTPStatus(s.Config()))
+	}
+	changeTestConfig(s, func(c *Config) { c.HealthRules = map[string]string{"sensors": HealthIgnore} })
+	if r = s.Health(); r.Status != HealthHealthy {
+		t.Error("Expected the failing check to be ignored but got", r.Status)
+	}
+
+	// A stale measurement makes the unit unhealthy
+	s.Monitor.addMeasurement(Measurement{Success: true, DateMeasured: time.Now().Add(-time.Hour)})
+	if r = s.Health(); r.Status != HealthUnhealthy || findHealthCheck(r, "measurement").Status != HealthUnhealthy {
+		t.Error("Expected unhealthy for a stale measurement but got", r.Status)
+	}
+}
+
+func TestHealthStaleAgeFollowsSchedule(t *testing.T) {
+	s := newHealthTest()
+	changeTestConfig(s, func(c *Config) { c.Schedules = []ScheduleRule{{Cron: "0 */6 * * *"}} })
+
+	// Measured every six hours, so a reading from two hours ago is not stale
+	s.Monitor.addMeasurement(Measurement{Success: true, DateMeasured: time.Now().Add(-2 * time.Hour)})
+	if r := s.Health(); findHealthCheck(r, "measurement").Status != HealthHealthy {
+		t.Error("Expected a fresh measurement but got", findHealthCheck(r, "measurement"))
+	}
+	s.Monitor.addMeasurement(Measurement{Success: true, DateMeasured: time.Now().Add(-25 * time.Hour)})
+	if r := s.Health(); findHealthCheck(r, "measurement").Status == HealthHealthy {
+		t.Error("Expected a stale measurement after three missed runs")
+	}
+
+	// A configured age is used as is
+	changeTestConfig(s, func(c *Config) { c.HealthStaleAge = 60 })
+	s.Monitor.addMeasurement(Measurement{Success: true, DateMeasured: time.Now().Add(-2 * time.Hour)})
+	if r := s.Health(); findHealthCheck(r, "measurement").Status == HealthHealthy {
+		t.Error("Expected the configured age to make the measurement stale")
+	}
+}
+
+func TestHealthStaleAgeAfterMeasurementFromWeb(t *testing.T) {
+	s := newHealthTest()
+
+	// Measured a second before a scheduled run, so three runs later is ten minutes on
+	after := time.Now().Truncate(5 * time.Minute).Add(-time.Second)
+	if d := s.staleAge(s.Config(), after); d != 10*time.Minute+time.Second {
+		t.Error("Expected 10m1s but got", d)
+	}
+}
+
+func TestHealthDegradedStatusCode(t *testing.T) {
+	s := newHealthTest()
+	changeTestConfig(s, func(c *Config) { c.EnableThingspeak = true })
+	s.Monitor.setThingspeak(errors.New("timeout"))
+	changeTestConfig(s, func(c *Config) { c.DegradedCode = 429 })
+	r := s.Health()
+	if r.Status != HealthDegraded || r.HTTPStatus(s.Config()) != 429 {
+		t.Error("Expected the degraded status code but got", r.Status, r.HTTPStatus(s.Config()))
+	}
+}
+
+func TestReady(t *testing.T) {
+	s := newTestServer(&Config{})
+	if r := s.Ready(); r.Ready || len(r.Reasons) != 2 {
+		t.Error("Expected not ready but got", r)
+	}
+	s = newHealthTest()
+	if r := s.Ready(); !r.Ready {
+		t.Error("Expected ready but got", r.Reasons)
+	}
+}
+
+func TestValidateHealthRules(t *testing.T) {
+	c := Config{HealthRules: map[string]string{"sensor": HealthDegraded, "mqtt": "broken"}}
+	if errs := c.Validate(); len(errs) != 2 {
+		t.Error("Expected 2 errors but got", errs)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HealthController handles the Web Methods used by monitoring tools.
+type HealthController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *HealthController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/health").Name("GetHealth").
+		Handler(http.HandlerFunc(c.handleGetHealth))
+	router.Methods("GET").Path("/ready").Name("GetReady").
+		Handler(http.HandlerFunc(c.handleGetReady))
+}
+
+// handleGetHealth returns 200 when the unit is healthy, 503 when it is unhealthy,
+// and the configured status code when it is degraded.
+func (c *HealthController) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	h := c.Srv.Health()
+	if err := h.WriteTo(w, h.HTTPStatus(c.Srv.Config())); err != nil {
+		http.Error(w, "Error serializing health. "+err.Error(), 500)
+	}
+}
+
+// handleGetReady returns 200 when the unit is ready and 503 when it is not.
+func (c *HealthController) handleGetReady(w http.ResponseWriter, r *http.Request) {
+	rd := c.Srv.Ready()
+	st := http.StatusOK
+	if !rd.Ready {
+		st = http.StatusServiceUnavailable
+	}
+	if err := rd.WriteTo(w, st); err != nil {
+		http.Error(w, "Error serializing readiness. "+err.Error(), 500)
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *HealthController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("HealthController", LevelInfo, a)
+}
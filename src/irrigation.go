@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	gopitools "github.com/brumawen/gopi-tools/src"
+)
+
+// Irrigation triggers
+const (
+	TriggerRule     = "rule"     // Watering was started because the moisture dropped below the target
+	TriggerManual   = "manual"   // Watering was started through the web methods
+	TriggerSchedule = "schedule" // Watering was started at a scheduled time
+)
+
+// ErrInvalidDuration is returned when a watering is started with a duration that is not positive.
+var ErrInvalidDuration = errors.New("duration must be greater than zero")
+
+// Irrigator controls the irrigation valve relay using the moisture readings.
+type Irrigator struct {
+	Srv          *Server           // Server instance
+	HistoryPath  string            // Path of the file used to persist the watering history
+	IsWatering   bool              // Indicates that the valve is open
+	Trigger      string            // What started the current watering
+	StartedAt    time.Time         // Time the current or last watering started
+	StopAt       time.Time         // Time the current watering will stop
+	StoppedAt    time.Time         // Time the last watering stopped
+	LastAutoRun  time.Time         // Time the last automatic watering started
+	Day          string            // The day the daily total applies to
+	DailySeconds float64           // Number of seconds watered on the day
+	pin          valve             // Valve relay pin
+	timer        *time.Timer       // Timer used to close the valve
+	run          int               // Counts the waterings, so that a timer only stops the watering it was started for
+	history      IrrigationHistory // Watering history
+	event        WateringEvent     // The current watering event
+	lastReading  Measurement       // Last successful measurement
+	lastSchedule string            // Last scheduled watering time that was run
+	done         chan struct{}     // Stops the schedule checks
+	lock         sync.Mutex        // Guards the irrigator state
+}
+
+// valve is the relay that opens and closes the valve.
+type valve interface {
+	On() error
+	Off() error
+	Close()
+}
+
+// IrrigationStatus holds the current state of the irrigation.
+type IrrigationStatus struct {
+	Enabled        bool      `json:"enabled"`        // Automatic irrigation is enabled
+	IsWatering     bool      `json:"isWatering"`     // The valve is open
+	Trigger        string    `json:"trigger"`        // What started the current watering
+	StartedAt      time.Time `json:"startedAt"`      // Time the current or last watering started
+	StopAt         time.Time `json:"stopAt"`         // Time the current watering will stop
+	StoppedAt      time.Time `json:"stoppedAt"`      // Time the last watering stopped
+	DailyMinutes   float64   `json:"dailyMinutes"`   // Minutes watered today
+	TargetMoisture float64   `json:"targetMoisture"` // Moisture below which watering starts
+}
+
+// Initialize loads the watering history and, if irrigation is enabled, opens
+// the valve relay.
+func (i *Irrigator) Initialize() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.HistoryPath != "" {
+		if err := i.history.ReadFromFile(i.HistoryPath); err != nil {
+			i.logError("Error loading the watering history.", "error", err)
+		}
+	}
+	i.Day = time.Now().Format("2006-01-02")
+	i.DailySeconds = i.history.DailyMinutes(i.Day) * 60
+
+	return i.open()
+}
+
+// Open makes sure that the valve is closed and starts checking the watering
+// schedule, if irrigation is enabled.  The relay pin is not touched if it is
+// not, as it may be wired to something else.
+func (i *Irrigator) Open() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.open()
+}
+
+// open opens the valve relay and starts the schedule checks.  The lock must be held.
+// This will also close the valve if it was left open by a previous crash.
+func (i *Irrigator) open() error {
+	c := i.Srv.Config()
+	if !c.EnableIrrigation {
+		i.logInfo("Irrigation has been disabled")
+		return nil
+	}
+
+	i.pin = &gopitools.Pin{GpioNo: c.IrrigationPin, TurnOffOnClose: true}
+	err := i.pin.Off()
+	if err != nil {
+		i.logError("Error closing the valve.", "error", err)
+	}
+
+	done := make(chan struct{})
+	i.done = done
+	go func() {
+		t := time.NewTicker(20 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case n := <-t.C:
+				i.checkSchedule(n)
+			}
+		}
+	}()
+	return err
+}
+
+// Evaluate decides whether the soil needs watering, using the measurement.
+// The valve is closed if the measurement failed.
+func (i *Irrigator) Evaluate(v Measurement) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	defer i.recoverAndClose(nil)
+
+	c := i.Srv.Config()
+	if !v.Success {
+		if i.IsWatering {
+			i.logError("Lost the moisture reading while watering. Closing the valve.")
+			i.stop()
+		}
+		return
+	}
+	i.lastReading = v
+	if i.history.SetMoistureAfter(v, time.Duration(c.SoakTime)*time.Minute) {
+		i.saveHistory()
+	}
+	if !c.EnableIrrigation {
+		if i.IsWatering && i.Trigger == TriggerRule {
+			i.stop()
+		}
+		return
+	}
+	if i.IsWatering || v.Moisture >= c.TargetMoisture {
+		return
+	}
+
+	now := time.Now()
+	if !i.StoppedAt.IsZero() && now.Sub(i.StoppedAt) < time.Duration(c.SoakTime)*time.Minute {
+		i.logDebug("Waiting for the soil to respond to the last watering.")
+		return
+	}
+	if !i.LastAutoRun.IsZero() && now.Sub(i.LastAutoRun) < time.Duration(c.WaterCooldown)*time.Minute {
+		i.logDebug("Watering is cooling down.")
+		return
+	}
+	w, err := ParseTimeWindows(c.WaterWindows)
+	if err != nil {
+		i.logError("Invalid watering windows.", "error", err)
+		return
+	}
+	if !IsInTimeWindows(w, now) {
+		i.logDebug("Outside of the allowed watering windows.")
+		return
+	}
+	rem := i.remaining(now)
+	if rem <= 0 {
+		i.logInfo("Daily maximum watering time has been reached.")
+		return
+	}
+	d := time.Duration(c.WaterDuration) * time.Second
+	if d > rem {
+		d = rem
+	}
+
+	i.logInfo(fmt.Sprintf("Moisture %.1f%% is below the target of %.1f%%.", v.Moisture, c.TargetMoisture))
+	if err := i.start(TriggerRule, d); err != nil {
+		i.logError("Error starting the watering.", "error", err)
+		return
+	}
+	i.LastAutoRun = now
+}
+
+// Start opens the valve for the specified duration.
+// The duration is capped at the watering time left for the day.
+func (i *Irrigator) Start(trigger string, d time.Duration) (err error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	defer i.recoverAndClose(&err)
+
+	if d <= 0 {
+		return ErrInvalidDuration
+	}
+	if i.IsWatering {
+		return errors.New("watering is already in progress")
+	}
+	rem := i.remaining(time.Now())
+	if rem <= 0 {
+		return errors.New("daily maximum watering time has been reached")
+	}
+	if d > rem {
+		d = rem
+	}
+	return i.start(trigger, d)
+}
+
+// Stop closes the valve.
+func (i *Irrigator) Stop() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.stop()
+}
+
+// Close closes the valve, stops the schedule and releases the pin.
+// Open starts them again.
+func (i *Irrigator) Close() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.stop()
+	if i.done != nil {
+		close(i.done)
+		i.done = nil
+	}
+	if i.pin != nil {
+		i.pin.Close()
+		// Watering cannot be started again until the valve is initialized
+		i.pin = nil
+	}
+}
+
+// Status returns the current state of the irrigation.
+func (i *Irrigator) Status() IrrigationStatus {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	now := time.Now()
+	d := i.DailySeconds
+	if i.Day != now.Format("2006-01-02") {
+		d = 0
+	}
+	if i.IsWatering {
+		d = d + now.Sub(i.StartedAt).Seconds()
+	}
+	c := i.Srv.Config()
+	return IrrigationStatus{
+		Enabled:        c.EnableIrrigation,
+		IsWatering:     i.IsWatering,
+		Trigger:        i.Trigger,
+		StartedAt:      i.StartedAt,
+		StopAt:         i.StopAt,
+		StoppedAt:      i.StoppedAt,
+		DailyMinutes:   d / 60,
+		TargetMoisture: c.TargetMoisture,
+	}
+}
+
+// History returns the watering events since the specified time.
+func (i *Irrigator) History(since time.Time) []WateringEvent {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.history.Since(since)
+}
+
+// Season returns the daily watering totals from the specified day (YYYY-MM-DD).
+func (i *Irrigator) Season(day string) []DailyWatering {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.history.DailySince(day)
+}
+
+// checkSchedule starts a watering if the time matches a scheduled watering time.
+func (i *Irrigator) checkSchedule(now time.Time) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	defer i.recoverAndClose(nil)
+
+	c := i.Srv.Config()
+	if !c.EnableIrrigation || c.WaterSchedule == "" || i.IsWatering {
+		return
+	}
+	m := now.Hour()*60 + now.Minute()
+	key := now.Format("2006-01-02 15:04")
+	for _, ts := range strings.Split(c.WaterSchedule, ",") {
+		if strings.TrimSpace(ts) == "" {
+			continue
+		}
+		st, err := parseTimeOfDay(ts)
+		if err != nil {
+			i.logError("Invalid watering schedule.", "error", err)
+			return
+		}
+		if st != m || i.lastSchedule == key {
+			continue
+		}
+		i.lastSchedule = key
+		d := time.Duration(c.WaterDuration) * time.Second
+		rem := i.remaining(now)
+		if rem <= 0 {
+			i.logInfo("Skipping scheduled watering. Daily maximum watering time has been reached.")
+			return
+		}
+		if d > rem {
+			d = rem
+		}
+		if err := i.start(TriggerSchedule, d); err != nil {
+			i.logError("Error starting the scheduled watering.", "error", err)
+		}
+		return
+	}
+}
+
+// start opens the valve and starts the timer to close it.  The lock must be held.
+func (i *Irrigator) start(trigger string, d time.Duration) error {
+	if i.pin == nil {
+		return errors.New("irrigation has not been enabled")
+	}
+	i.logInfo("Opening the valve for ", d, ". Trigger is ", trigger, ".")
+	if err := i.pin.On(); err != nil {
+		i.pin.Off()
+		return err
+	}
+	now := time.Now()
+	i.IsWatering = true
+	i.Trigger = trigger
+	i.StartedAt = now
+	i.StopAt = now.Add(d)
+	i.event = WateringEvent{
+		Trigger:        trigger,
+		StartedAt:      now,
+		MoistureBefore: i.lastReading.Moisture,
+	}
+	i.Srv.Events.Publish(EventIrrigation, i.event)
+	i.run = i.run + 1
+	run := i.run
+	i.timer = time.AfterFunc(d, func() {
+		i.expire(run)
+	})
+	return nil
+}
+
+// expire closes the valve when the watering time is up.  A timer that fired
+// while its watering was being stopped leaves a newer watering running.
+func (i *Irrigator) expire(run int) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	defer i.recoverAndClose(nil)
+
+	if i.run != run {
+		return
+	}
+	i.stop()
+}
+
+// stop closes the valve and updates the daily total.  The lock must be held.
+func (i *Irrigator) stop() {
+	if i.timer != nil {
+		i.timer.Stop()
+		i.timer = nil
+	}
+	if i.pin != nil {
+		if err := i.pin.Off(); err != nil {
+			i.logError("Error closing the valve.", "error", err)
+		}
+	}
+	if !i.IsWatering {
+		return
+	}
+	now := time.Now()
+	i.remaining(now)
+	i.DailySeconds = i.DailySeconds + now.Sub(i.StartedAt).Seconds()
+	i.IsWatering = false
+	i.StoppedAt = now
+	i.logInfo("Closed the valve after ", now.Sub(i.StartedAt).Round(time.Second), ".")
+
+	// Record the watering event
+	e := i.event
+	e.StoppedAt = now
+	e.Duration = now.Sub(e.StartedAt).Seconds()
+	i.history.Add(e)
+	i.saveHistory()
+	i.Srv.Events.Publish(EventIrrigation, e)
+	if i.Srv.MqttClient != nil {
+		i.Srv.MqttClient.Async(func() {
+			if err := i.Srv.MqttClient.SendWateringEvent(e); err != nil {
+				i.logError("Error sending watering event to MQTT broker.", "error", err)
+			}
+		})
+	}
+}
+
+// saveHistory writes the watering history to the file.  The lock must be held.
+func (i *Irrigator) saveHistory() {
+	if i.HistoryPath == "" {
+		return
+	}
+	if err := i.history.WriteToFile(i.HistoryPath); err != nil {
+		i.logError("Error saving the watering history.", "error", err)
+	}
+}
+
+// remaining returns the watering time left for the day.  The lock must be held.
+func (i *Irrigator) remaining(now time.Time) time.Duration {
+	day := now.Format("2006-01-02")
+	if i.Day != day {
+		i.Day = day
+		i.DailySeconds = 0
+	}
+	max := time.Duration(i.Srv.Config().MaxDailyWater) * time.Minute
+	return max - time.Duration(i.DailySeconds*float64(time.Second))
+}
+
+// recoverAndClose makes sure that the valve is closed if a panic occurs.  The panic
+// is logged rather than passed on, as on the timer and schedule goroutines it would
+// stop the service.  If err is not nil, it is set to the panic.  It must be deferred
+// after the lock is taken, so that it runs while the lock is still held.
+func (i *Irrigator) recoverAndClose(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	i.logError("Panic in irrigation. Closing the valve.", "error", r, "stack", string(debug.Stack()))
+	if i.timer != nil {
+		i.timer.Stop()
+		i.timer = nil
+	}
+	// A watering started before the panic must not be stopped by its timer
+	i.run = i.run + 1
+	if i.pin != nil {
+		i.pin.Off()
+	}
+	i.IsWatering = false
+	if err != nil {
+		*err = fmt.Errorf("irrigation failed: %v", r)
+	}
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (s *IrrigationStatus) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+func (i *Irrigator) logDebug(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("Irrigator", LevelDebug, a)
+}
+
+func (i *Irrigator) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("Irrigator", LevelInfo, a)
+}
+
+func (i *Irrigator) logError(msg string, kv ...interface{}) {
+	logEntry("Irrigator", LevelError, msg, kv...)
+}
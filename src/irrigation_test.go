@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testValve records the state of the valve instead of switching a relay.
+type testValve struct {
+	open bool
+}
+
+func (v *testValve) On() error  { v.open = true; return nil }
+func (v *testValve) Off() error { v.open = false; return nil }
+func (v *testValve) Close()     {}
+
+func TestIrrigationFollowsMoisture(t *testing.T) {
+	v := &testValve{}
+	i := Irrigator{Srv: newTestServer(&Config{
+		EnableIrrigation: true,
+		TargetMoisture:   30,
+		WaterDuration:    60,
+		MaxDailyWater:    10,
+	}), pin: v}
+	defer i.Close()
+
+	i.Evaluate(Measurement{Success: true, Moisture: 40})
+	if i.IsWatering || v.open {
+		t.Fatal("Valve was opened while the soil is moist.")
+	}
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	if !i.IsWatering || !v.open || i.Trigger != TriggerRule {
+		t.Fatal("Valve was not opened when the soil is dry.")
+	}
+	if d := i.StopAt.Sub(i.StartedAt); d != time.Minute {
+		t.Error("Watering duration should be 1m, not", d)
+	}
+
+	// Losing the reading closes the valve
+	i.Evaluate(Measurement{Success: false})
+	if i.IsWatering || v.open {
+		t.Fatal("Valve was left open when the reading was lost.")
+	}
+	if l := i.History(time.Time{}); len(l) != 1 || l[0].MoistureBefore != 25 {
+		t.Error("Watering event was not recorded.", l)
+	}
+}
+
+func TestIrrigationWaitsBeforeWateringAgain(t *testing.T) {
+	v := &testValve{}
+	i := Irrigator{Srv: newTestServer(&Config{
+		EnableIrrigation: true,
+		TargetMoisture:   30,
+		WaterDuration:    60,
+		MaxDailyWater:    10,
+		SoakTime:         30,
+		WaterCooldown:    120,
+	}), pin: v}
+	defer i.Close()
+
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	i.Stop()
+
+	// The soil has not had time to respond
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	if i.IsWatering {
+		t.Fatal("Valve was opened before the soil had soaked.")
+	}
+
+	// Soaked, but still cooling down
+	i.StoppedAt = time.Now().Add(-31 * time.Minute)
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	if i.IsWatering {
+		t.Fatal("Valve was opened while cooling down.")
+	}
+
+	i.LastAutoRun = time.Now().Add(-121 * time.Minute)
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	if !i.IsWatering || !v.open {
+		t.Fatal("Valve was not opened after the cooldown.")
+	}
+}
+
+func TestIrrigationTimeWindows(t *testing.T) {
+	now := time.Now()
+	c := &Config{
+		EnableIrrigation: true,
+		TargetMoisture:   30,
+		WaterDuration:    60,
+		MaxDailyWater:    10,
+		WaterWindows:     now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04"),
+	}
+	i := Irrigator{Srv: newTestServer(c), pin: &testValve{}}
+	defer i.Close()
+
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	if i.IsWatering {
+		t.Fatal("Valve was opened outside of the watering windows.")
+	}
+
+	c.WaterWindows = now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	if !i.IsWatering {
+		t.Fatal("Valve was not opened inside the watering window.")
+	}
+}
+
+func TestIrrigationDailyMaximum(t *testing.T) {
+	i := Irrigator{Srv: newTestServer(&Config{
+		EnableIrrigation: true,
+		TargetMoisture:   30,
+		WaterDuration:    60,
+		MaxDailyWater:    1,
+	}), pin: &testValve{}}
+	defer i.Close()
+
+	if err := i.Start(TriggerManual, 0); err != ErrInvalidDuration {
+		t.Error("Duration of zero was not rejected.", err)
+	}
+
+	// A manual watering only uses what is left of the day's allowance
+	i.Day = time.Now().Format("2006-01-02")
+	i.DailySeconds = 50
+	if err := i.Start(TriggerManual, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if d := i.StopAt.Sub(i.StartedAt); d != 10*time.Second {
+		t.Error("Manual watering should be capped at 10s, not", d)
+	}
+	i.Stop()
+
+	i.DailySeconds = 60
+	if err := i.Start(TriggerManual, time.Minute); err == nil {
+		t.Error("Manual watering was started after the daily maximum was reached.")
+	}
+	i.Evaluate(Measurement{Success: true, Moisture: 25})
+	if i.IsWatering {
+		t.Error("Valve was opened after the daily maximum was reached.")
+	}
+}
+
+func TestStartIrrigationRejectsInvalidDuration(t *testing.T) {
+	s := newTestServer(&Config{MaxDailyWater: 10})
+	s.Irrigation = &Irrigator{Srv: s, pin: &testValve{}}
+	defer s.Irrigation.Close()
+	c := IrrigationController{Srv: s}
+
+	w := httptest.NewRecorder()
+	c.handleStartIrrigation(w, httptest.NewRequest("POST", "/irrigation/start?duration=-5", nil))
+	if w.Code != 400 {
+		t.Error("Invalid duration returned", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	c.handleStartIrrigation(w, httptest.NewRequest("POST", "/irrigation/start?duration=30", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"isWatering":true`) {
+		t.Error("Watering was not started.", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	c.handleStartIrrigation(w, httptest.NewRequest("POST", "/irrigation/start?duration=30", nil))
+	if w.Code != 409 {
+		t.Error("Second watering returned", w.Code)
+	}
+}
+
+func TestIrrigationRefusedAfterClose(t *testing.T) {
+	v := &testValve{}
+	i := Irrigator{Srv: newTestServer(&Config{MaxDailyWater: 10}), pin: v}
+	i.Close()
+
+	if err := i.Start(TriggerManual, time.Minute); err == nil {
+		t.Error("Watering was started after the valve was closed.")
+	}
+	if v.open {
+		t.Error("Valve was opened after it was closed.")
+	}
+}
+
+func TestIrrigationDisabledLeavesRelayAlone(t *testing.T) {
+	i := Irrigator{Srv: newTestServer(&Config{EnableIrrigation: false, IrrigationPin: 17})}
+	if err := i.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if i.pin != nil || i.done != nil {
+		t.Error("Relay pin and schedule checks were set up while irrigation is disabled.")
+	}
+	if err := i.Start(TriggerManual, time.Minute); err == nil {
+		t.Error("Watering was started while irrigation is disabled.")
+	}
+}
+
+func TestIrrigationTimerOnlyStopsItsWatering(t *testing.T) {
+	v := &testValve{}
+	i := Irrigator{Srv: newTestServer(&Config{MaxDailyWater: 10}), pin: v}
+	defer i.Close()
+	if err := i.Start(TriggerManual, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	run := i.run
+	i.Stop()
+	if err := i.Start(TriggerManual, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timer of the first watering fired just as it was stopped
+	i.expire(run)
+	if !i.IsWatering || !v.open {
+		t.Error("Timer of the first watering stopped the second watering.")
+	}
+	i.expire(i.run)
+	if i.IsWatering || v.open {
+		t.Error("Timer did not stop its watering.")
+	}
+}
+
+// panicValve panics when it is opened.
+type panicValve struct {
+	testValve
+}
+
+func (v *panicValve) On() error { v.open = true; panic("relay failed") }
+
+func TestIrrigationPanicClosesTheValve(t *testing.T) {
+	v := &panicValve{}
+	i := Irrigator{Srv: newTestServer(&Config{MaxDailyWater: 10}), pin: v}
+	defer i.Close()
+
+	if err := i.Start(TriggerManual, time.Minute); err == nil {
+		t.Error("Expected an error from the panic.")
+	}
+	if i.IsWatering || v.open {
+		t.Error("Valve was left open after the panic.")
+	}
+
+	// The lock was released, so the irrigation can still be used
+	if s := i.Status(); s.IsWatering {
+		t.Error("Irrigation is watering after the panic.", s)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// IrrigationController handles the Web Methods for controlling the irrigation.
+type IrrigationController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *IrrigationController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/irrigation/get").Name("GetIrrigation").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetIrrigation)))
+	router.Methods("GET").Path("/irrigation/history").Name("GetIrrigationHistory").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetHistory)))
+	router.Methods("GET").Path("/irrigation/season").Name("GetIrrigationSeason").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetSeason)))
+	router.Methods("POST").Path("/irrigation/start").Name("StartIrrigation").
+		Handler(Logger(c, http.HandlerFunc(c.handleStartIrrigation)))
+	router.Methods("POST").Path("/irrigation/stop").Name("StopIrrigation").
+		Handler(Logger(c, http.HandlerFunc(c.handleStopIrrigation)))
+}
+
+func (c *IrrigationController) handleGetIrrigation(w http.ResponseWriter, r *http.Request) {
+	v := c.Srv.Irrigation.Status()
+	if err := v.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing irrigation status. "+err.Error(), 500)
+	}
+}
+
+func (c *IrrigationController) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	// Defaults to the last 7 days
+	since := time.Now().AddDate(0, 0, -7)
+	if ss := r.URL.Query().Get("since"); ss != "" {
+		t, err := time.Parse(time.RFC3339, ss)
+		if err != nil {
+			http.Error(w, "Failed to convert "+ss+" to a time.", 400)
+			return
+		}
+		since = t
+	}
+	h := IrrigationHistory{
+		Events: c.Srv.Irrigation.History(since),
+		Daily:  []DailyWatering{},
+	}
+	if err := h.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing irrigation history. "+err.Error(), 500)
+	}
+}
+
+func (c *IrrigationController) handleGetSeason(w http.ResponseWriter, r *http.Request) {
+	// Defaults to the start of the configured season
+	from := SeasonStartFor(c.Srv.Config().SeasonStart, time.Now())
+	if fs := r.URL.Query().Get("from"); fs != "" {
+		if _, err := time.Parse("2006-01-02", fs); err != nil {
+			http.Error(w, "Failed to convert "+fs+" to a date.", 400)
+			return
+		}
+		from = fs
+	}
+	h := IrrigationHistory{
+		Events: []WateringEvent{},
+		Daily:  c.Srv.Irrigation.Season(from),
+	}
+	if err := h.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing irrigation season. "+err.Error(), 500)
+	}
+}
+
+func (c *IrrigationController) handleStartIrrigation(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	// Duration in seconds, defaults to the configured watering time
+	d := c.Srv.Config().WaterDuration
+	if ds := r.Form.Get("duration"); ds != "" {
+		v, err := strconv.Atoi(ds)
+		if err != nil {
+			http.Error(w, "Failed to convert "+ds+" to an integer.", 400)
+			return
+		}
+		d = v
+	}
+
+	c.LogInfo("Starting manual watering for ", d, " seconds.")
+	if err := c.Srv.Irrigation.Start(TriggerManual, time.Duration(d)*time.Second); err != nil {
+		code := 409
+		if err == ErrInvalidDuration {
+			code = 400
+		}
+		http.Error(w, "Error starting watering. "+err.Error(), code)
+		return
+	}
+	v := c.Srv.Irrigation.Status()
+	v.WriteTo(w)
+}
+
+func (c *IrrigationController) handleStopIrrigation(w http.ResponseWriter, r *http.Request) {
+	c.LogInfo("Stopping watering.")
+	c.Srv.Irrigation.Stop()
+	v := c.Srv.Irrigation.Status()
+	v.WriteTo(w)
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *IrrigationController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("IrrigationController", LevelInfo, a)
+}
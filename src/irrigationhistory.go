@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// WateringEvent records a single opening and closing of the irrigation valve.
+type WateringEvent struct {
+	Trigger        string    `json:"trigger"`        // What started the watering (rule, manual or schedule)
+	StartedAt      time.Time `json:"startedAt"`      // Time the valve was opened
+	StoppedAt      time.Time `json:"stoppedAt"`      // Time the valve was closed
+	Duration       float64   `json:"duration"`       // Time (in seconds) the valve was open
+	MoistureBefore float64   `json:"moistureBefore"` // Last moisture reading before the valve was opened
+	MoistureAfter  float64   `json:"moistureAfter"`  // First moisture reading after the soil had time to respond
+	MeasuredAfter  time.Time `json:"measuredAfter"`  // Time of the moisture after reading.  Zero if not yet measured.
+}
+
+// DailyWatering holds the total watering for a day.
+type DailyWatering struct {
+	Date    string  `json:"date"`    // The day, in the form YYYY-MM-DD
+	Minutes float64 `json:"minutes"` // Number of minutes the valve was open
+	Count   int     `json:"count"`   // Number of waterings
+}
+
+// IrrigationHistory holds the watering events and the daily totals.
+type IrrigationHistory struct {
+	Events []WateringEvent `json:"events"` // The most recent watering events, oldest first
+	Daily  []DailyWatering `json:"daily"`  // The daily totals, oldest first
+}
+
+const (
+	maxWateringEvents = 500 // Maximum number of watering events kept
+	maxDailyWatering  = 366 // Maximum number of daily totals kept
+)
+
+// Add adds the watering event to the history and updates the daily totals.
+func (h *IrrigationHistory) Add(e WateringEvent) {
+	h.Events = append(h.Events, e)
+	if len(h.Events) > maxWateringEvents {
+		h.Events = h.Events[len(h.Events)-maxWateringEvents:]
+	}
+
+	day := e.StartedAt.Format("2006-01-02")
+	if l := len(h.Daily); l == 0 || h.Daily[l-1].Date != day {
+		h.Daily = append(h.Daily, DailyWatering{Date: day})
+	}
+	d := &h.Daily[len(h.Daily)-1]
+	d.Minutes = d.Minutes + e.Duration/60
+	d.Count = d.Count + 1
+	if len(h.Daily) > maxDailyWatering {
+		h.Daily = h.Daily[len(h.Daily)-maxDailyWatering:]
+	}
+}
+
+// SetMoistureAfter records the moisture reading against the last watering
+// event, if the event is still waiting for a reading and the soak time has passed.
+// Returns true if the event was updated.
+func (h *IrrigationHistory) SetMoistureAfter(v Measurement, soak time.Duration) bool {
+	l := len(h.Events)
+	if l == 0 {
+		return false
+	}
+	e := &h.Events[l-1]
+	if !e.MeasuredAfter.IsZero() || v.DateMeasured.Before(e.StoppedAt.Add(soak)) {
+		return false
+	}
+	e.MoistureAfter = v.Moisture
+	e.MeasuredAfter = v.DateMeasured
+	return true
+}
+
+// DailyMinutes returns the number of minutes watered on the day.
+func (h *IrrigationHistory) DailyMinutes(day string) float64 {
+	for i := len(h.Daily) - 1; i >= 0; i-- {
+		if h.Daily[i].Date == day {
+			return h.Daily[i].Minutes
+		}
+	}
+	return 0
+}
+
+// Since returns the watering events that started at or after the specified time.
+func (h *IrrigationHistory) Since(t time.Time) []WateringEvent {
+	l := []WateringEvent{}
+	for _, e := range h.Events {
+		if !e.StartedAt.Before(t) {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// DailySince returns the daily totals from the specified day (YYYY-MM-DD).
+func (h *IrrigationHistory) DailySince(day string) []DailyWatering {
+	l := []DailyWatering{}
+	for _, d := range h.Daily {
+		if d.Date >= day {
+			l = append(l, d)
+		}
+	}
+	return l
+}
+
+// ReadFromFile will read the history from the specified file
+func (h *IrrigationHistory) ReadFromFile(path string) error {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &h)
+}
+
+// WriteToFile will write the history to the specified file.  The file is
+// replaced in one step so that it is never left half written.
+func (h *IrrigationHistory) WriteToFile(path string) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (h *IrrigationHistory) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// Serialize serializes the entity and returns the serialized string
+func (e *WateringEvent) Serialize() (string, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIrrigationHistoryAggregatesDailyMinutes(t *testing.T) {
+	h := IrrigationHistory{}
+	st := time.Date(2020, 6, 1, 6, 0, 0, 0, time.Local)
+	h.Add(WateringEvent{StartedAt: st, StoppedAt: st.Add(time.Minute), Duration: 60})
+	h.Add(WateringEvent{StartedAt: st.Add(time.Hour), StoppedAt: st.Add(time.Hour + 90*time.Second), Duration: 90})
+	h.Add(WateringEvent{StartedAt: st.AddDate(0, 0, 1), StoppedAt: st.AddDate(0, 0, 1).Add(time.Minute), Duration: 60})
+
+	if len(h.Daily) != 2 {
+		t.Fatal("Expected 2 days but got", len(h.Daily))
+	}
+	if m := h.DailyMinutes("2020-06-01"); m != 2.5 {
+		t.Error("Expected 2.5 minutes but got", m)
+	}
+	if h.Daily[0].Count != 2 {
+		t.Error("Expected 2 waterings but got", h.Daily[0].Count)
+	}
+
+	e := h.Events[2].StoppedAt
+	if h.SetMoistureAfter(Measurement{Moisture: 40, DateMeasured: e.Add(10 * time.Minute)}, 30*time.Minute) {
+		t.Error("Moisture after was set before the soak time passed.")
+	}
+	if !h.SetMoistureAfter(Measurement{Moisture: 45, DateMeasured: e.Add(30 * time.Minute)}, 30*time.Minute) {
+		t.Error("Moisture after was not set.")
+	}
+	if h.Events[2].MoistureAfter != 45 {
+		t.Error("Expected moisture after of 45 but got", h.Events[2].MoistureAfter)
+	}
+}
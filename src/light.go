@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxDailyLight = 366 // Maximum number of daily light totals kept
+
+// LightPoint maps a light sensor reading (%) to an illuminance (lux).
+type LightPoint struct {
+	Raw float64 `json:"raw"` // Light sensor reading (%)
+	Lux float64 `json:"lux"` // Illuminance (lux)
+}
+
+// defaultLightCurve approximates the logarithmic response of the light dependent resistor.
+var defaultLightCurve = []LightPoint{
+	{Raw: 0, Lux: 0},
+	{Raw: 10, Lux: 10},
+	{Raw: 30, Lux: 200},
+	{Raw: 50, Lux: 2000},
+	{Raw: 70, Lux: 15000},
+	{Raw: 90, Lux: 60000},
+	{Raw: 100, Lux: 100000},
+}
+
+// LightIntegrator integrates the light readings over each day into a daily
+// light integral and detects the photoperiod.
+type LightIntegrator struct {
+	Srv      *Server    // Server instance
+	FilePath string     // Path of the file used to persist the light totals
+	State    LightState // The accumulated state
+	unsaved  int        // Measurements added since the totals were saved
+	lock     sync.Mutex // Guards the state
+	saveLock sync.Mutex // Makes sure the totals are saved one save at a time
+}
+
+// LightState holds the light totals for the current day and the previous days.
+type LightState struct {
+	Today       DailyLight   `json:"today"`       // Totals for the current day so far
+	Days        []DailyLight `json:"days"`        // Totals for the previous days, oldest first
+	LastReading time.Time    `json:"lastReading"` // Time of the last reading
+	LastLux     float64      `json:"lastLux"`     // Illuminance of the last reading
+	LastPpfd    float64      `json:"lastPpfd"`    // PPFD of the last reading
+}
+
+// DailyLight holds the light totals for a day.
+type DailyLight struct {
+	Date        string    `json:"date"`        // The day, in the form YYYY-MM-DD
+	Dli         float64   `json:"dli"`         // Daily light integral (mol/m2/day)
+	Photoperiod float64   `json:"photoperiod"` // Hours above the daylight threshold
+	Sunrise     time.Time `json:"sunrise"`     // Time the light first rose above the daylight threshold
+	Sunset      time.Time `json:"sunset"`      // Time the light last fell below the daylight threshold
+	MaxLux      float64   `json:"maxLux"`      // Maximum illuminance (lux)
+}
+
+// LightList holds a list of daily light totals.
+type LightList struct {
+	Today DailyLight   `json:"today"` // Totals for the current day so far
+	Days  []DailyLight `json:"days"`  // Totals for the previous days, oldest first
+}
+
+// LightToLux converts the light sensor reading (%) to an illuminance (lux),
+// interpolating between the points of the transfer curve.
+func LightToLux(curve []LightPoint, raw float64) float64 {
+	if len(curve) == 0 {
+		curve = defaultLightCurve
+	}
+	c := append([]LightPoint{}, curve...)
+	sort.Slice(c, func(i, j int) bool { return c[i].Raw < c[j].Raw })
+	if raw <= c[0].Raw {
+		return c[0].Lux
+	}
+	for i := 1; i < len(c); i++ {
+		if raw <= c[i].Raw {
+			f := (raw - c[i-1].Raw) / (c[i].Raw - c[i-1].Raw)
+			return c[i-1].Lux + f*(c[i].Lux-c[i-1].Lux)
+		}
+	}
+	return c[len(c)-1].Lux
+}
+
+// Load reads the persisted light totals from the file.
+func (l *LightIntegrator) Load() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.FilePath == "" {
+		return nil
+	}
+	_, err := os.Stat(l.FilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(l.FilePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &l.State)
+}
+
+// Add integrates the light of the measurement into the daily totals.
+func (l *LightIntegrator) Add(v Measurement) DailyLight {
+	d, save := l.add(v)
+	if save {
+		l.Save()
+	}
+	return d
+}
+
+// add integrates the light and returns today's totals and whether the totals should be saved.
+func (l *LightIntegrator) add(v Measurement) (DailyLight, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !v.Success {
+		return l.State.Today, false
+	}
+	c := l.Srv.Config()
+	st := &l.State
+	l.unsaved = l.unsaved + 1
+	save := l.unsaved >= stateSaveEvery
+
+	// Close off the previous day
+	day := v.DateMeasured.Format("2006-01-02")
+	if st.Today.Date != day {
+		if st.Today.Date != "" {
+			st.Days = append(st.Days, st.Today)
+			if len(st.Days) > maxDailyLight {
+				st.Days = st.Days[len(st.Days)-maxDailyLight:]
+			}
+			l.logInfo(fmt.Sprintf("Daily light integral for %s was %.1f mol/m2 with %.1f hours of daylight.", st.Today.Date, st.Today.Dli, st.Today.Photoperiod))
+			save = true
+		}
+		st.Today = DailyLight{Date: day}
+	}
+
+	// Integrate the readings, ignoring gaps longer than two periods
+	if !st.LastReading.IsZero() {
+		dt := v.DateMeasured.Sub(st.LastReading)
+		if gap := 2 * l.Srv.sampleInterval(st.LastReading); dt > gap {
+			dt = 0
+		}
+		if dt > 0 {
+			st.Today.Dli = st.Today.Dli + (st.LastPpfd+v.Ppfd)/2*dt.Seconds()/1000000
+
+			thr := c.DaylightLux
+			wasDay := st.LastLux >= thr
+			isDay := v.Lux >= thr
+			switch {
+			case wasDay && isDay:
+				st.Today.Photoperiod = st.Today.Photoperiod + dt.Hours()
+			case !wasDay && isDay:
+				// Sunrise, at the interpolated crossing time
+				f := (thr - st.LastLux) / (v.Lux - st.LastLux)
+				t := st.LastReading.Add(time.Duration(f * float64(dt)))
+				st.Today.Photoperiod = st.Today.Photoperiod + (1-f)*dt.Hours()
+				if st.Today.Sunrise.IsZero() {
+					st.Today.Sunrise = t
+				}
+			case wasDay && !isDay:
+				// Sunset, at the interpolated crossing time
+				f := (st.LastLux - thr) / (st.LastLux - v.Lux)
+				st.Today.Sunset = st.LastReading.Add(time.Duration(f * float64(dt)))
+				st.Today.Photoperiod = st.Today.Photoperiod + f*dt.Hours()
+			}
+		}
+	}
+	if v.Lux > st.Today.MaxLux {
+		st.Today.MaxLux = v.Lux
+	}
+	st.LastReading = v.DateMeasured
+	st.LastLux = v.Lux
+	st.LastPpfd = v.Ppfd
+
+	d := st.Today
+
+	if l.Srv.MqttClient != nil {
+		l.Srv.MqttClient.Async(func() {
+			if err := l.Srv.MqttClient.SendLight(d); err != nil {
+				l.logError("Error sending light totals to MQTT broker.", "error", err)
+			}
+		})
+	}
+	return d, save
+}
+
+// Totals returns the totals for today and the previous number of days.
+func (l *LightIntegrator) Totals(days int) LightList {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	r := LightList{
+		Today: l.State.Today,
+		Days:  []DailyLight{},
+	}
+	n := len(l.State.Days)
+	if days > n {
+		days = n
+	}
+	if days > 0 {
+		r.Days = append(r.Days, l.State.Days[n-days:]...)
+	}
+	return r
+}
+
+// LastDay returns the totals of the most recent full day.
+func (l *LightIntegrator) LastDay() (DailyLight, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.State.Days) == 0 {
+		return DailyLight{}, false
+	}
+	return l.State.Days[len(l.State.Days)-1], true
+}
+
+// Daylight returns the window between the sunrise and sunset of the most
+// recent day that the light sensor saw both.
+func (l *LightIntegrator) Daylight() (TimeWindow, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for i := len(l.State.Days) - 1; i >= 0; i-- {
+		d := l.State.Days[i]
+		if !d.Sunrise.IsZero() && !d.Sunset.IsZero() && d.Sunset.After(d.Sunrise) {
+			return TimeWindow{
+				Start: d.Sunrise.Hour()*60 + d.Sunrise.Minute(),
+				End:   d.Sunset.Hour()*60 + d.Sunset.Minute(),
+			}, true
+		}
+	}
+	return TimeWindow{}, false
+}
+
+// Save writes the light totals to the file, if they have changed since they were last saved.
+// The file is written without holding up the readers.
+func (l *LightIntegrator) Save() error {
+	l.saveLock.Lock()
+	defer l.saveLock.Unlock()
+
+	l.lock.Lock()
+	if l.FilePath == "" || l.unsaved == 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	path := l.FilePath
+	b, err := json.Marshal(l.State)
+	n := l.unsaved
+	l.unsaved = 0
+	l.lock.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(path, b, 0644)
+	}
+	if err != nil {
+		l.logError("Error saving the light totals.", "error", err)
+		// Try again with the next save
+		l.lock.Lock()
+		l.unsaved = l.unsaved + n
+		l.lock.Unlock()
+	}
+	return err
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (l *LightList) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// Serialize serializes the entity and returns the serialized string
+func (d *DailyLight) Serialize() (string, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (l *LightIntegrator) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("LightIntegrator", LevelInfo, a)
+}
+
+func (l *LightIntegrator) logError(msg string, kv ...interface{}) {
+	logEntry("LightIntegrator", LevelError, msg, kv...)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLightToLux(t *testing.T) {
+	c := []LightPoint{{Raw: 0, Lux: 0}, {Raw: 50, Lux: 1000}, {Raw: 100, Lux: 11000}}
+	for _, x := range []struct{ raw, lux float64 }{{-5, 0}, {25, 500}, {75, 6000}, {120, 11000}} {
+		if l := LightToLux(c, x.raw); l != x.lux {
+			t.Errorf("Expected %.0f lux for %.0f but got %.0f", x.lux, x.raw, l)
+		}
+	}
+}
+
+func TestLightIntegratorDetectsPhotoperiod(t *testing.T) {
+	s := newTestServer(&Config{Period: 60, DaylightLux: 1000})
+	l := LightIntegrator{Srv: s}
+	st := time.Date(2020, 6, 1, 0, 0, 0, 0, time.Local)
+	// Dark until 06:00, 20000 lux from 07:00 to 18:00, dark from 19:00
+	for h := 0; h < 24; h++ {
+		v := Measurement{Success: true, DateMeasured: st.Add(time.Duration(h) * time.Hour)}
+		if h >= 7 && h <= 18 {
+			v.Lux = 20000
+			v.Ppfd = 500
+		}
+		l.Add(v)
+	}
+	d := l.State.Today
+	if math.Abs(d.Photoperiod-12.9) > 0.01 {
+		t.Error("Expected 12.9 hours of daylight but got", d.Photoperiod)
+	}
+	if d.Sunrise.Hour() != 6 || d.Sunset.Hour() != 18 {
+		t.Error("Expected sunrise at 6 and sunset at 18 but got", d.Sunrise, d.Sunset)
+	}
+	if math.Abs(d.Dli-21.6) > 0.01 {
+		t.Error("Expected a DLI of 21.6 but got", d.Dli)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// LightController handles the Web Methods for the daily light totals.
+type LightController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *LightController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/light/get").Name("GetLight").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetLight)))
+}
+
+func (c *LightController) handleGetLight(w http.ResponseWriter, r *http.Request) {
+	// Defaults to the last 7 days
+	days := 7
+	if ds := r.URL.Query().Get("days"); ds != "" {
+		v, err := strconv.Atoi(ds)
+		if err != nil {
+			http.Error(w, "Failed to convert "+ds+" to an integer.", 400)
+			return
+		}
+		days = v
+	}
+	l := c.Srv.Light.Totals(days)
+	if err := l.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing light totals. "+err.Error(), 500)
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *LightController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("LightController", LevelInfo, a)
+}
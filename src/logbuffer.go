@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// Log levels, from the most to the least severe
+const (
+	LevelError   = "error"
+	LevelWarning = "warning"
+	LevelInfo    = "info"
+	LevelDebug   = "debug"
+)
+
+// LogRecord holds a single log record.
+type LogRecord struct {
+	Time      time.Time         `json:"time"`             // Time the record was logged
+	Level     string            `json:"level"`            // Level of the record
+	Component string            `json:"component"`        // Component that logged the record, e.g. Server or SoilMonitor
+	Message   string            `json:"message"`          // The message
+	Fields    map[string]string `json:"fields,omitempty"` // Keys and values describing the message
+}
+
+// LogRecords holds a list of log records.
+type LogRecords []LogRecord
+
+// LogQuery holds the filters used to select log records.
+type LogQuery struct {
+	Level      string    // Least severe level to return.  Empty for all.
+	Components []string  // Components to return.  Empty for all.
+	Since      time.Time // Only return records logged at or after this time
+	Until      time.Time // Only return records logged before this time
+	Text       string    // Only return records containing this text
+	Limit      int       // Maximum number of records, keeping the most recent.  0 for no limit.
+}
+
+// LogBuffer is a service.Logger that keeps the most recent log records in
+// memory, and optionally writes them to a rotating file, before passing them
+// on to the system logger.
+type LogBuffer struct {
+	Next    service.Logger // Logger the records are passed on to
+	Size    int            // Maximum number of records kept in memory
+	File    *LogFile       // File the records are written to.  nil for none.
+	records []LogRecord    // Ring buffer of records
+	start   int            // Index of the oldest record once the buffer is full
+	lock    sync.Mutex     // Guards the buffer
+}
+
+// LogFile writes log records to a file as JSON lines, rotating the file when
+// it reaches the maximum size.
+type LogFile struct {
+	Path     string   // Path of the current file.  Older files have .1, .2, ... appended.
+	MaxSize  int64    // Size (in bytes) at which the file is rotated
+	MaxFiles int      // Number of old files to keep
+	f        *os.File // The open file
+	size     int64    // Size of the open file
+}
+
+// Error logs an error message.
+func (b *LogBuffer) Error(v ...interface{}) error {
+	b.add(LevelError, fmt.Sprint(v...))
+	return b.Next.Error(v...)
+}
+
+// Warning logs a warning message.
+func (b *LogBuffer) Warning(v ...interface{}) error {
+	b.add(LevelWarning, fmt.Sprint(v...))
+	return b.Next.Warning(v...)
+}
+
+// Info logs an information message.
+func (b *LogBuffer) Info(v ...interface{}) error {
+	b.add(LevelInfo, fmt.Sprint(v...))
+	return b.Next.Info(v...)
+}
+
+// Errorf logs a formatted error message.
+func (b *LogBuffer) Errorf(format string, a ...interface{}) error {
+	b.add(LevelError, fmt.Sprintf(format, a...))
+	return b.Next.Errorf(format, a...)
+}
+
+// Warningf logs a formatted warning message.
+func (b *LogBuffer) Warningf(format string, a ...interface{}) error {
+	b.add(LevelWarning, fmt.Sprintf(format, a...))
+	return b.Next.Warningf(format, a...)
+}
+
+// Infof logs a formatted information message.
+func (b *LogBuffer) Infof(format string, a ...interface{}) error {
+	b.add(LevelInfo, fmt.Sprintf(format, a...))
+	return b.Next.Infof(format, a...)
+}
+
+// Log records the structured record, and passes it on as text.
+func (b *LogBuffer) Log(r LogRecord) error {
+	b.record(r)
+	return writeLogRecord(b.Next, r)
+}
+
+// Query returns the records that match the query, oldest first.
+func (b *LogBuffer) Query(q LogQuery) LogRecords {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	max := logLevelRank(q.Level)
+	text := strings.ToLower(q.Text)
+	l := LogRecords{}
+	for i := range b.records {
+		r := b.records[(b.start+i)%len(b.records)]
+		switch {
+		case q.Level != "" && logLevelRank(r.Level) > max:
+		case len(q.Components) != 0 && !containsFold(q.Components, r.Component):
+		case !q.Since.IsZero() && r.Time.Before(q.Since):
+		case !q.Until.IsZero() && !r.Time.Before(q.Until):
+		case text != "" && !strings.Contains(strings.ToLower(r.Text()), text):
+		default:
+			l = append(l, r)
+		}
+	}
+	if q.Limit > 0 && len(l) > q.Limit {
+		l = l[len(l)-q.Limit:]
+	}
+	return l
+}
+
+// Close closes the log file.
+func (b *LogBuffer) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.File == nil {
+		return nil
+	}
+	return b.File.Close()
+}
+
+// add records the message.
+func (b *LogBuffer) add(level string, msg string) {
+	r := LogRecord{Time: time.Now(), Level: level, Message: msg}
+	if i := strings.Index(msg, ": "); i > 0 && isComponentName(msg[:i]) {
+		r.Component = msg[:i]
+		r.Message = msg[i+2:]
+	}
+	b.record(r)
+}
+
+// record adds the record to the buffer and the log file.
+func (b *LogBuffer) record(r LogRecord) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	size := b.Size
+	if size <= 0 {
+		size = 1000
+	}
+	if len(b.records) < size {
+		b.records = append(b.records, r)
+	} else {
+		b.records[b.start] = r
+		b.start = (b.start + 1) % len(b.records)
+	}
+	if b.File != nil {
+		if err := b.File.Write(r); err != nil {
+			b.Next.Error("LogBuffer: Error writing to the log file. ", err.Error())
+		}
+	}
+}
+
+// Write appends the record to the file, rotating the file first if it is full.
+func (l *LogFile) Write(r LogRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if l.f != nil && l.MaxSize > 0 && l.size+int64(len(b)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.f == nil {
+		f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		l.f = f
+		l.size = st.Size()
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the file.
+func (l *LogFile) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// rotate closes the current file and shifts the old files along, removing the oldest.
+func (l *LogFile) rotate() error {
+	if err := l.Close(); err != nil {
+		return err
+	}
+	if l.MaxFiles <= 0 {
+		return os.Remove(l.Path)
+	}
+	for i := l.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i+1))
+	}
+	return os.Rename(l.Path, l.Path+".1")
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (l LogRecords) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// WriteText writes the records as lines of text.
+func (l LogRecords) WriteText(w io.Writer) error {
+	for _, r := range l {
+		if _, err := fmt.Fprintln(w, r.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns the record as a line of text.
+func (r LogRecord) String() string {
+	return r.Time.Format("2006-01-02 15:04:05") + " " + fmt.Sprintf("%-7s", strings.ToUpper(r.Level)) + " " + r.Text()
+}
+
+// Text returns the component, message and fields of the record as text.
+func (r LogRecord) Text() string {
+	s := r.Message
+	if r.Component != "" {
+		s = r.Component + ": " + s
+	}
+	keys := []string{}
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := r.Fields[k]
+		if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+			v = strconv.Quote(v)
+		}
+		s = s + " " + k + "=" + v
+	}
+	return s
+}
+
+// ParseLogLevel returns the level named by the text, accepting warn for warning.
+func ParseLogLevel(s string) (string, error) {
+	switch l := strings.ToLower(s); l {
+	case LevelError, LevelWarning, LevelInfo, LevelDebug:
+		return l, nil
+	case "warn":
+		return LevelWarning, nil
+	}
+	return "", fmt.Errorf("Level %s is not valid. Use error, warning, info or debug.", s)
+}
+
+// logLevelRank orders the levels from the most to the least severe.
+func logLevelRank(level string) int {
+	switch level {
+	case LevelError:
+		return 0
+	case LevelWarning:
+		return 1
+	case LevelInfo:
+		return 2
+	}
+	return 3
+}
+
+// isComponentName returns whether the text is a single word, as used by the
+// components for the prefix of their log messages.
+func isComponentName(s string) bool {
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold returns whether the list contains the text, ignoring case.
+func containsFold(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kardianos/service"
+)
+
+func TestLogBufferQuery(t *testing.T) {
+	b := &LogBuffer{Next: service.ConsoleLogger, Size: 3}
+	b.Info("Server: ", "Service started")
+	b.Error("Mqtt: ", "Error connecting to the broker")
+	b.Warning("SoilMonitor: ", "Reading is out of range")
+	b.Infof("Display: Showing %d items", 4)
+
+	// The oldest record is dropped once the buffer is full
+	l := b.Query(LogQuery{})
+	if len(l) != 3 || l[0].Component != "Mqtt" || l[2].Message != "Showing 4 items" {
+		t.Fatal("Unexpected records", l)
+	}
+	if l := b.Query(LogQuery{Level: LevelWarning}); len(l) != 2 || l[1].Level != LevelWarning {
+		t.Error("Expected the error and warning but got", l)
+	}
+	if l := b.Query(LogQuery{Components: []string{"display", "mqtt"}, Text: "BROKER"}); len(l) != 1 || l[0].Component != "Mqtt" {
+		t.Error("Expected the Mqtt record but got", l)
+	}
+	if l := b.Query(LogQuery{Until: l[0].Time}); len(l) != 0 {
+		t.Error("Expected no records but got", l)
+	}
+	if l := b.Query(LogQuery{Limit: 1}); len(l) != 1 || l[0].Component != "Display" {
+		t.Error("Expected the most recent record but got", l)
+	}
+}
+
+func TestLogFileRotate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "soilmonitor")
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "soilmonitor.log")
+	b := &LogBuffer{Next: service.ConsoleLogger, File: &LogFile{Path: p, MaxSize: 200, MaxFiles: 2}}
+	for i := 0; i < 10; i++ {
+		b.Info("Server: ", "Record number ", i)
+	}
+	b.Close()
+
+	for _, f := range []string{p, p + ".1", p + ".2"} {
+		st, err := os.Stat(f)
+		if err != nil || st.Size() > 200 {
+			t.Error("Expected", f, "to be rotated", err)
+		}
+	}
+	if _, err := os.Stat(p + ".3"); err == nil {
+		t.Error("Expected only 2 old files to be kept")
+	}
+	s, _ := ReadAllText(p)
+	r := LogRecord{}
+	if err := json.Unmarshal([]byte(strings.Split(s, "\n")[0]), &r); err != nil || r.Component != "Server" {
+		t.Error("Expected a JSON record but got", s, err)
+	}
+}
+
+func TestLogControllerGet(t *testing.T) {
+	s := newTestServer(&Config{})
+	s.Logs = &LogBuffer{Next: service.ConsoleLogger}
+	s.Logs.Error("Server: ", "Error starting the web server")
+	s.Logs.Info("SoilMonitor: ", "Measurement taken")
+	r := mux.NewRouter()
+	c := &LogController{}
+	c.AddController(r, s)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/log/get?component=soilmonitor&since=1h&format=json", nil))
+	l := LogRecords{}
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil || len(l) != 1 || l[0].Message != "Measurement taken" {
+		t.Error("Expected the SoilMonitor record but got", w.Body.String(), err)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/log/get?level=error", nil))
+	if !strings.Contains(w.Body.String(), "ERROR   Server: Error starting the web server") || strings.Contains(w.Body.String(), "Measurement") {
+		t.Error("Unexpected text", w.Body.String())
+	}
+
+	for _, q := range []string{"level=debugging", "since=yesterday", "format=xml", "limit=-1"} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/log/get?"+q, nil))
+		if w.Code != 400 {
+			t.Error("Expected", q, "to be rejected but got", w.Code)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 
-	gopifinder "github.com/brumawen/gopi-finder/src"
 	"github.com/gorilla/mux"
 )
 
@@ -19,24 +21,131 @@ func (c *LogController) AddController(router *mux.Router, s *Server) {
 	c.Srv = s
 	router.Methods("GET").Path("/log/get").Name("GetLogs").
 		Handler(Logger(c, http.HandlerFunc(c.handleGetLogs)))
+	router.Methods("GET").Path("/log/levels").Name("GetLogLevels").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetLevels)))
+	router.Methods("PUT", "POST").Path("/log/levels").Name("SetLogLevel").
+		Handler(Logger(c, http.HandlerFunc(c.handleSetLevel)))
 }
 
+// handleGetLogs returns the log records kept by the service.
+// The records can be filtered by level (the least severe level to return),
+// component (a comma separated list), since and until (a time, or a duration
+// before now such as 1h), and text.  format is json or text (the default).
 func (c *LogController) handleGetLogs(w http.ResponseWriter, r *http.Request) {
-	myInfo, err := gopifinder.NewDeviceInfo()
+	if c.Srv.Logs == nil {
+		http.Error(w, "The log buffer is not enabled.", 503)
+		return
+	}
+	q, err := parseLogQuery(r)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		http.Error(w, err.Error(), 400)
 		return
 	}
-	if myInfo.OS != "Linux" {
-		http.Error(w, "Not supported.", 500)
+	l := c.Srv.Logs.Query(q)
+	switch f := r.URL.Query().Get("format"); f {
+	case "json":
+		if err := l.WriteTo(w); err != nil {
+			http.Error(w, "Error serializing log records. "+err.Error(), 500)
+		}
+	case "", "text":
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		l.WriteText(w)
+	default:
+		http.Error(w, "Format "+f+" is not supported. Use json or text.", 400)
+	}
+}
+
+func (c *LogController) handleGetLevels(w http.ResponseWriter, r *http.Request) {
+	v := logLevels.List()
+	if err := v.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing log levels. "+err.Error(), 500)
+	}
+}
+
+// handleSetLevel changes the log level of a component, or the default level,
+// for a time.  The level reverts when the time is up, or now if the level is empty.
+func (c *LogController) handleSetLevel(w http.ResponseWriter, r *http.Request) {
+	ch := LogLevelChange{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&ch); err != nil {
+		http.Error(w, "Error reading the log level change. "+err.Error(), 400)
 		return
 	}
-	out, _ := exec.Command("journalctl", "--no-pager", "-u", "SoilMonitor", "-S", "1 hour ago").CombinedOutput()
-	w.Write([]byte(out))
+	if ch.Level == "" {
+		c.LogInfo("Reverting the log level of ", componentLabel(ch.Component), ".")
+		logLevels.Revert(ch.Component)
+	} else {
+		level, err := ParseLogLevel(ch.Level)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if ch.Duration == 0 {
+			ch.Duration = 15 * 60
+		}
+		if ch.Duration < 0 || ch.Duration > 24*60*60 {
+			http.Error(w, "Duration must be between 1 second and 24 hours.", 400)
+			return
+		}
+		d := time.Duration(ch.Duration) * time.Second
+		c.LogInfo("Changing the log level of ", componentLabel(ch.Component), " to ", level, " for ", d, ".")
+		logLevels.Set(ch.Component, level, d)
+	}
+	v := logLevels.List()
+	v.WriteTo(w)
+}
+
+// componentLabel describes the component in a log message.
+func componentLabel(component string) string {
+	if component == "" {
+		return "all components"
+	}
+	return component
+}
+
+// parseLogQuery reads the log filters from the request.
+func parseLogQuery(r *http.Request) (LogQuery, error) {
+	v := r.URL.Query()
+	q := LogQuery{Text: v.Get("text")}
+	var err error
+	if ls := v.Get("level"); ls != "" {
+		if q.Level, err = ParseLogLevel(ls); err != nil {
+			return q, err
+		}
+	}
+	if cs := v.Get("component"); cs != "" {
+		q.Components = strings.Split(cs, ",")
+	}
+	if q.Since, err = parseLogTime(v.Get("since")); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseLogTime(v.Get("until")); err != nil {
+		return q, err
+	}
+	if ls := v.Get("limit"); ls != "" {
+		if q.Limit, err = strconv.Atoi(ls); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("Failed to convert %s to a limit.", ls)
+		}
+	}
+	return q, nil
+}
+
+// parseLogTime converts the value to a time.  It is either an RFC 3339 time
+// or a duration before now.
+func parseLogTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("Failed to convert %s to a time.", s)
 }
 
 // LogInfo is used to log information messages for this controller.
 func (c *LogController) LogInfo(v ...interface{}) {
 	a := fmt.Sprint(v...)
-	logger.Info("LogController: ", a)
+	logEntry("LogController", LevelInfo, a)
 }
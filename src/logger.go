@@ -10,6 +10,6 @@ func Logger(c Controller, inner http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		inner.ServeHTTP(w, r)
-		c.LogInfo(r.Method, r.RequestURI, "from", r.RemoteAddr, "took", time.Since(start))
+		logEntry(componentName(c), LevelInfo, "Handled request", "method", r.Method, "uri", r.RequestURI, "from", r.RemoteAddr, "took", time.Since(start))
 	})
 }
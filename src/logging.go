@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// LogLevels holds the log level of each component.  A level can be changed
+// for a time, after which it reverts, so that a unit can be debugged without
+// being left with verbose logging.
+type LogLevels struct {
+	base      string                  // Default level when it has not been changed.  Info if empty.
+	overrides map[string]*logOverride // Changed levels, keyed by component.  "" changes the default.
+	seen      map[string]bool         // Components that have logged
+	lock      sync.Mutex              // Guards the levels
+}
+
+// logOverride holds a changed level.
+type logOverride struct {
+	Level   string      // The level
+	Expires time.Time   // Time the level reverts
+	timer   *time.Timer // Reverts the level
+}
+
+// ComponentLevel holds the log level of a component.
+type ComponentLevel struct {
+	Component string    `json:"component"` // Name of the component
+	Level     string    `json:"level"`     // Current level
+	Expires   time.Time `json:"expires"`   // Time a changed level reverts.  Zero if it has not been changed.
+}
+
+// LogLevelList holds the log levels of the components.
+type LogLevelList struct {
+	Default        string           `json:"default"`        // Level of the components that have not been changed
+	DefaultExpires time.Time        `json:"defaultExpires"` // Time a changed default level reverts.  Zero if it has not been changed.
+	Components     []ComponentLevel `json:"components"`     // Level of each component
+}
+
+// LogLevelChange holds a request to change a log level.
+type LogLevelChange struct {
+	Component string `json:"component"` // Name of the component.  Empty for the default level.
+	Level     string `json:"level"`     // New level.  Empty to revert now.
+	Duration  int    `json:"duration"`  // Time (in seconds) before the level reverts.  0 for 15 minutes.
+}
+
+// logLevels holds the levels used by logEntry
+var logLevels = &LogLevels{}
+
+// SetDefault sets the default level that changed levels revert to.
+func (l *LogLevels) SetDefault(level string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.base = level
+}
+
+// Set changes the level of the component for the duration, after which it reverts.
+// An empty component changes the default level.
+func (l *LogLevels) Set(component string, level string, d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.overrides == nil {
+		l.overrides = map[string]*logOverride{}
+	}
+	if o := l.overrides[component]; o != nil {
+		o.timer.Stop()
+	}
+	o := &logOverride{Level: level, Expires: time.Now().Add(d)}
+	o.timer = time.AfterFunc(d, func() { l.expire(component, o) })
+	l.overrides[component] = o
+}
+
+// Revert reverts the level of the component now.
+func (l *LogLevels) Revert(component string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if o := l.overrides[component]; o != nil {
+		o.timer.Stop()
+		delete(l.overrides, component)
+	}
+}
+
+// Level returns the current level of the component.
+func (l *LogLevels) Level(component string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.level(component)
+}
+
+// Enabled returns whether the component logs messages of the level.
+func (l *LogLevels) Enabled(component string, level string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.seen == nil {
+		l.seen = map[string]bool{}
+	}
+	l.seen[component] = true
+	return logLevelRank(level) <= logLevelRank(l.level(component))
+}
+
+// List returns the levels of the components that have logged or been changed.
+func (l *LogLevels) List() LogLevelList {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	v := LogLevelList{Default: l.level(""), Components: []ComponentLevel{}}
+	if o := l.overrides[""]; o != nil {
+		v.DefaultExpires = o.Expires
+	}
+	names := []string{}
+	for n := range l.seen {
+		names = append(names, n)
+	}
+	for n := range l.overrides {
+		if n != "" && !l.seen[n] {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		c := ComponentLevel{Component: n, Level: l.level(n)}
+		if o := l.overrides[n]; o != nil {
+			c.Expires = o.Expires
+		}
+		v.Components = append(v.Components, c)
+	}
+	return v
+}
+
+// level returns the current level of the component.  The lock must be held.
+func (l *LogLevels) level(component string) string {
+	if o := l.overrides[component]; o != nil {
+		return o.Level
+	}
+	if o := l.overrides[""]; o != nil {
+		return o.Level
+	}
+	if l.base != "" {
+		return l.base
+	}
+	return LevelInfo
+}
+
+// expire reverts the changed level, unless it has been changed again since.
+func (l *LogLevels) expire(component string, o *logOverride) {
+	l.lock.Lock()
+	found := l.overrides[component] == o
+	if found {
+		delete(l.overrides, component)
+	}
+	l.lock.Unlock()
+
+	if found {
+		logEntry("LogLevels", LevelInfo, "Log level reverted", "component", component, "level", l.Level(component))
+	}
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (v *LogLevelList) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// logEntry logs a message from the component, if the level of the component
+// allows it.  kv holds pairs of keys and values that are added to the record.
+func logEntry(component string, level string, msg string, kv ...interface{}) {
+	if !logLevels.Enabled(component, level) {
+		return
+	}
+	r := LogRecord{Time: time.Now(), Level: level, Component: component, Message: msg, Fields: logFields(kv)}
+	if b, ok := logger.(*LogBuffer); ok {
+		b.Log(r)
+		return
+	}
+	writeLogRecord(logger, r)
+}
+
+// writeLogRecord writes the record to the system logger.
+func writeLogRecord(l service.Logger, r LogRecord) error {
+	switch r.Level {
+	case LevelError:
+		return l.Error(r.Text())
+	case LevelWarning:
+		return l.Warning(r.Text())
+	}
+	return l.Info(r.Text())
+}
+
+// logFields converts the pairs of keys and values to fields.
+func logFields(kv []interface{}) map[string]string {
+	if len(kv) == 0 {
+		return nil
+	}
+	m := map[string]string{}
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 == len(kv) {
+			m["!BADKEY"] = fmt.Sprint(kv[i])
+			break
+		}
+		m[fmt.Sprint(kv[i])] = fmt.Sprint(kv[i+1])
+	}
+	return m
+}
+
+// componentName returns the name of the type of the value, used as the component name.
+func componentName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
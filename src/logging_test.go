@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kardianos/service"
+)
+
+func TestLogLevels(t *testing.T) {
+	b := &LogBuffer{Next: service.ConsoleLogger}
+	logger = b
+	defer func() { logger = service.ConsoleLogger }()
+	l := &LogLevels{}
+	if !l.Enabled("Server", LevelInfo) || l.Enabled("Server", LevelDebug) {
+		t.Error("Expected the default level to be info")
+	}
+
+	l.Set("Mqtt", LevelDebug, 50*time.Millisecond)
+	l.Set("", LevelError, time.Hour)
+	if !l.Enabled("Mqtt", LevelDebug) || l.Enabled("Server", LevelWarning) {
+		t.Error("Expected Mqtt at debug and the others at error")
+	}
+	v := l.List()
+	if v.Default != LevelError || len(v.Components) != 2 || v.Components[0].Component != "Mqtt" || v.Components[0].Expires.IsZero() {
+		t.Error("Unexpected levels", v)
+	}
+
+	// The changed level reverts when the time is up
+	for i := 0; i < 100 && len(b.Query(LogQuery{Text: "reverted"})) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if l.Level("Mqtt") != LevelError {
+		t.Error("Expected Mqtt to revert to the default level but got", l.Level("Mqtt"))
+	}
+	l.Revert("")
+	if l.Level("Mqtt") != LevelInfo {
+		t.Error("Expected the default level to revert to info but got", l.Level("Mqtt"))
+	}
+}
+
+func TestLogEntryFields(t *testing.T) {
+	b := &LogBuffer{Next: service.ConsoleLogger}
+	logger = b
+	defer func() { logger = service.ConsoleLogger }()
+
+	logEntry("Mqtt", LevelError, "Error sending to MQTT Broker.", "topic", "soil/moisture", "error", "not connected")
+	logEntry("Mqtt", LevelDebug, "Not logged at the default level")
+	l := b.Query(LogQuery{Text: "topic=soil"})
+	if len(l) != 1 || l[0].Fields["error"] != "not connected" {
+		t.Fatal("Expected the structured record but got", l)
+	}
+	if s := l[0].Text(); s != `Mqtt: Error sending to MQTT Broker. error="not connected" topic=soil/moisture` {
+		t.Error("Unexpected text", s)
+	}
+}
+
+func TestLogControllerLevels(t *testing.T) {
+	defer logLevels.Revert("Display")
+	r := mux.NewRouter()
+	c := &LogController{}
+	c.AddController(r, newTestServer(&Config{}))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/log/levels", bytes.NewBufferString(`{"component":"Display","level":"warn","duration":60}`)))
+	v := LogLevelList{}
+	json.Unmarshal(w.Body.Bytes(), &v)
+	found := false
+	for _, cl := range v.Components {
+		if cl.Component == "Display" && cl.Level == LevelWarning && time.Until(cl.Expires) > 50*time.Second {
+			found = true
+		}
+	}
+	if w.Code != 200 || !found {
+		t.Error("Expected Display to be at warning but got", w.Code, w.Body.String())
+	}
+
+	for _, b := range []string{`{"level":"verbose"}`, `{"level":"debug","duration":100000}`, `{"level":`} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("PUT", "/log/levels", bytes.NewBufferString(b)))
+		if w.Code != 400 {
+			t.Error("Expected", b, "to be rejected but got", w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/log/levels", strings.NewReader(`{"component":"Display"}`)))
+	if logLevels.Level("Display") != LevelInfo {
+		t.Error("Expected Display to revert but got", logLevels.Level("Display"))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/kardianos/service"
@@ -14,13 +15,36 @@ var logger service.Logger
 func main() {
 	port := flag.Int("p", 20510, "Port Number to listen on.")
 	timeout := flag.Int("t", 2, "Timeout in seconds to wait for a response from a IP probe.")
+	tlsFlag := flag.Bool("tls", false, "Serve HTTPS.  A self-signed certificate is generated unless -cert and -key are specified.")
+	certFile := flag.String("cert", "", "TLS certificate file.")
+	keyFile := flag.String("key", "", "TLS key file.")
+	redirect := flag.Int("redirect", 0, "Port Number to listen on for HTTP requests to redirect to HTTPS.  0 for none.")
 	svcFlag := flag.String("service", "", "Service action.  Valid actions are: 'start', 'stop', 'restart', 'instal' and 'uninstall'")
+	logFile := flag.String("log", "", "File to write the log records to.  Empty for none.")
+	logSize := flag.Int("logsize", 1, "Size (in MB) at which the log file is rotated.")
+	logKeep := flag.Int("logkeep", 3, "Number of rotated log files to keep.")
+	logBuffer := flag.Int("logbuffer", 1000, "Number of log records to keep in memory.")
+	authFlag := flag.String("auth", "", "Authentication action.  Valid actions are: 'token-add NAME ROLE', 'token-list', 'token-revoke NAME', 'user-set NAME ROLE', 'user-list' and 'user-delete NAME'")
 	flag.Parse()
 
+	if *authFlag != "" {
+		// Manage the API tokens and users
+		a := &AuthManager{FilePath: authFilePath()}
+		if err := RunAuthCommand(a, *authFlag, flag.Args(), os.Stdin, os.Stdout); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create a new server
 	s := &Server{
-		PortNo:  *port,
-		Timeout: *timeout,
+		PortNo:       *port,
+		Timeout:      *timeout,
+		EnableTLS:    *tlsFlag,
+		CertFile:     *certFile,
+		KeyFile:      *keyFile,
+		RedirectPort: *redirect,
 	}
 
 	// Create the service
@@ -49,6 +73,15 @@ func main() {
 		}
 	}()
 
+	// Keep the most recent log records
+	lb := &LogBuffer{Next: logger, Size: *logBuffer}
+	if *logFile != "" {
+		lb.File = &LogFile{Path: *logFile, MaxSize: int64(*logSize) * 1024 * 1024, MaxFiles: *logKeep}
+	}
+	defer lb.Close()
+	logger = lb
+	s.Logs = lb
+
 	// Start the service
 	if *svcFlag != "" {
 		// Service control request
@@ -63,7 +96,9 @@ func main() {
 		}
 	} else {
 		// Start the service in debug if we are running in a terminal
-		s.VerboseLogging = service.Interactive()
+		if service.Interactive() {
+			logLevels.SetDefault(LevelDebug)
+		}
 		if err := v.Run(); err != nil {
 			log.Fatal(err)
 		}
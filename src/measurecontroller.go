@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -17,21 +18,42 @@ func (c *MeasureController) AddController(router *mux.Router, s *Server) {
 	c.Srv = s
 	router.Methods("GET").Path("/measure/get").Name("GetMeasurements").
 		Handler(Logger(c, http.HandlerFunc(c.handleGetMeasure)))
+	router.Methods("GET").Path("/measure/history").Name("GetMeasurementHistory").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetHistory)))
 	router.Methods("GET").Path("/measure/getcurrent").Name("GetCurrent").
 		Handler(Logger(c, http.HandlerFunc(c.handleGetCurrent)))
 }
 
 func (c *MeasureController) handleGetMeasure(w http.ResponseWriter, r *http.Request) {
 	l := MeasurementList{
-		Measurements: c.Srv.Monitor.Measurements,
+		Measurements: c.Srv.Monitor.Readings(),
 	}
 	if err := l.WriteTo(w); err != nil {
 		http.Error(w, "Error serializing list. "+err.Error(), 500)
 	}
 }
 
+func (c *MeasureController) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	// Defaults to the last 24 hours
+	since := time.Now().Add(-24 * time.Hour)
+	if ss := r.URL.Query().Get("since"); ss != "" {
+		t, err := time.Parse(time.RFC3339, ss)
+		if err != nil {
+			http.Error(w, "Failed to convert "+ss+" to a time.", 400)
+			return
+		}
+		since = t
+	}
+	l := MeasurementList{
+		Measurements: c.Srv.Monitor.History(since),
+	}
+	if err := l.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing measurement history. "+err.Error(), 500)
+	}
+}
+
 func (c *MeasureController) handleGetCurrent(w http.ResponseWriter, r *http.Request) {
-	if v, err := c.Srv.Monitor.MeasureValues(); err != nil {
+	if v, err := c.Srv.Monitor.MeasureValues(r.Context()); err != nil {
 		http.Error(w, "Error getting measurements. "+err.Error(), 500)
 	} else {
 		if err := v.WriteTo(w); err != nil {
@@ -44,5 +66,5 @@ func (c *MeasureController) handleGetCurrent(w http.ResponseWriter, r *http.Requ
 // LogInfo is used to log information messages for this controller.
 func (c *MeasureController) LogInfo(v ...interface{}) {
 	a := fmt.Sprint(v...)
-	logger.Info("MeasureController: ", a)
+	logEntry("MeasureController", LevelInfo, a)
 }
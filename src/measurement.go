@@ -5,18 +5,28 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // Measurement holds the values read from the component probes.
 type Measurement struct {
-	AirTemp      float64
-	SoilTemp     float64
-	Light        float64
-	Moisture     float64
-	Success      bool
-	Error        string
-	DateMeasured time.Time
+	AirTemp        float64
+	SoilTemp       float64
+	Light          float64
+	Lux            float64 // Illuminance (lux) approximated from the light reading
+	Ppfd           float64 // Photosynthetic photon flux density (umol/m2/s) approximated from the illuminance
+	Moisture       float64
+	Success        bool
+	Error          string
+	DateMeasured   time.Time
+	Profile        string          // Plant profile the moisture was evaluated against
+	Status         string          // Moisture status for the profile (too dry, ok or too wet)
+	SoilTempStatus string          // Soil temperature status for the profile (too cold, ok or too hot)
+	AirTempStatus  string          // Air temperature status for the profile (too cold or ok)
+	LightStatus    string          // Light status for the profile from the daily light integral of the last full day (too dark, ok or too bright)
+	Diagnostics    []SensorAttempt // Attempts made at reading the sensors
+	Missing        []string        `json:",omitempty"` // Readings that were not taken because the sensor was not found
 }
 
 // ReadFrom reads the string from the reader and deserializes it into the entity values
@@ -61,3 +71,33 @@ func (m *Measurement) Deserialize(v string) error {
 	}
 	return nil
 }
+
+// Has returns whether the named reading was taken.  The name is not case sensitive.
+func (m *Measurement) Has(name string) bool {
+	for _, n := range m.Missing {
+		if strings.EqualFold(n, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Value returns the value of the named measurement field.
+// The name is not case sensitive and the second return value is false if
+// the field is not known or the reading was not taken.
+func (m *Measurement) Value(name string) (float64, bool) {
+	if !m.Has(name) {
+		return 0, false
+	}
+	switch strings.ToLower(name) {
+	case "airtemp":
+		return m.AirTemp, true
+	case "soiltemp":
+		return m.SoilTemp, true
+	case "light":
+		return m.Light, true
+	case "moisture":
+		return m.Moisture, true
+	}
+	return 0, false
+}
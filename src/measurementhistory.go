@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// MeasurementHistory holds the measurements used to chart the values over time.
+type MeasurementHistory struct {
+	Measurements []Measurement `json:"measurements"` // The most recent measurements, oldest first
+}
+
+// measurementHistorySpan is how far back the history goes, whatever the schedule.
+const measurementHistorySpan = 24 * time.Hour
+
+// Add adds the measurement to the history and drops the measurements older
+// than the history span.  The sensor diagnostics are not kept.
+func (h *MeasurementHistory) Add(v Measurement) {
+	v.Diagnostics = nil
+	h.Measurements = append(h.Measurements, v)
+	from := v.DateMeasured.Add(-measurementHistorySpan)
+	n := 0
+	for n < len(h.Measurements) && h.Measurements[n].DateMeasured.Before(from) {
+		n++
+	}
+	if n > 0 {
+		h.Measurements = append([]Measurement{}, h.Measurements[n:]...)
+	}
+}
+
+// Since returns the measurements taken at or after the specified time.
+func (h *MeasurementHistory) Since(t time.Time) []Measurement {
+	l := []Measurement{}
+	for _, v := range h.Measurements {
+		if !v.DateMeasured.Before(t) {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// ReadFromFile will read the history from the specified file
+func (h *MeasurementHistory) ReadFromFile(path string) error {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &h)
+}
+
+// WriteToFile will write the history to the specified file
+func (h *MeasurementHistory) WriteToFile(path string) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMeasurementHistoryKeepsADay(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "measurements.json")
+	m := SoilMonitor{Srv: newTestServer(&Config{}), HistoryPath: p}
+	n := 300
+	st := time.Now().Add(-time.Duration(n) * 5 * time.Minute)
+	for i := 0; i < n; i++ {
+		m.addMeasurement(Measurement{
+			Success:      true,
+			Moisture:     float64(i),
+			DateMeasured: st.Add(time.Duration(i) * 5 * time.Minute),
+			Diagnostics:  []SensorAttempt{{Sensor: "airTemp", Success: true}},
+		})
+	}
+	if l := m.Readings(); len(l) != 12 {
+		t.Error("Expected the last 12 readings but got", len(l))
+	}
+	if err := m.SaveHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The history is reloaded after a restart
+	r := SoilMonitor{HistoryPath: p}
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+	l := r.History(time.Time{})
+	if len(l) != 289 || l[0].Moisture != 11 {
+		t.Fatal("Expected the most recent day of measurements but got", len(l))
+	}
+	if l[0].Diagnostics != nil {
+		t.Error("Diagnostics should not be kept in the history.")
+	}
+	if l := r.History(time.Now().Add(-62 * time.Minute)); len(l) != 12 {
+		t.Error("Expected 12 measurements in the last hour but got", len(l))
+	}
+}
+
+func TestMeasurementHistorySpansTheSchedule(t *testing.T) {
+	h := MeasurementHistory{}
+	st := time.Now().Add(-48 * time.Hour)
+	// Measured every hour, so a day is 25 measurements, not 288
+	for i := 0; i <= 48; i++ {
+		h.Add(Measurement{Success: true, DateMeasured: st.Add(time.Duration(i) * time.Hour)})
+	}
+	if len(h.Measurements) != 25 {
+		t.Error("Expected a day of measurements but got", len(h.Measurements))
+	}
+}
+
+func TestMeasurementHistoryIsSavedInBatches(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "measurements.json")
+	m := SoilMonitor{Srv: newTestServer(&Config{}), HistoryPath: p}
+	for i := 0; i < historySaveEvery-1; i++ {
+		m.addMeasurement(Measurement{Success: true, DateMeasured: time.Now()})
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Error("History was saved before the batch was complete.")
+	}
+	m.addMeasurement(Measurement{Success: true, DateMeasured: time.Now()})
+	if _, err := os.Stat(p); err != nil {
+		t.Error("History was not saved after the batch.", err)
+	}
+}
@@ -1,41 +1,65 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
+// defaultMqttTopic is the prefix of the topics if one has not been configured.
+const defaultMqttTopic = "home/garden"
+
 // Mqtt publishes the telemetry to a MQTT broker
 type Mqtt struct {
-	Srv               *Server     // Server instance
-	LastUpdateAttempt time.Time   // Last time an update was attempted
-	LastUpdate        time.Time   // Last time an update was published
-	client            MQTT.Client // MQTT client
+	Srv               *Server        // Server instance
+	LastUpdateAttempt time.Time      // Last time an update was attempted
+	LastUpdate        time.Time      // Last time an update was published
+	client            MQTT.Client    // MQTT client
+	pending           sync.WaitGroup // Publishes that are still in progress
+	lock              sync.Mutex     // Guards the client and the update times
+	connectLock       sync.Mutex     // Makes sure only one connect to the broker is made at a time
+}
 
+// MqttStatus holds the state of the connection to the MQTT broker.
+type MqttStatus struct {
+	Enabled           bool      `json:"enabled"`           // MQTT is enabled
+	Connected         bool      `json:"connected"`         // The client is connected to the broker
+	LastUpdateAttempt time.Time `json:"lastUpdateAttempt"` // Last time an update was attempted
+	LastUpdate        time.Time `json:"lastUpdate"`        // Last time an update was published
 }
 
-// Initialize starts up the MQTT client
+// Initialize starts up the MQTT client.  Settings that are missing are
+// reported as an error, and nothing is published until they are fixed.
 func (m *Mqtt) Initialize() error {
-	if !m.Srv.Config.EnableMqtt {
+	m.connectLock.Lock()
+	defer m.connectLock.Unlock()
+
+	return m.initialize()
+}
+
+// initialize starts up the MQTT client.  If the client cannot connect, it is
+// cleared so that the next publish starts it up again.  The connect lock must be held.
+func (m *Mqtt) initialize() error {
+	c := m.Srv.Config()
+	if !c.EnableMqtt {
 		m.logInfo("MQTT has been disabled")
 		return nil
 	}
-	if m.Srv.Config.MqttHost == "" {
+	if c.MqttHost == "" {
 		m.logError("MQTT Host has not been configured.")
-		m.Srv.Config.EnableMqtt = false
 		return errors.New("host has not been configured")
 	}
-	if m.Srv.Config.MqttUsername == "" {
+	if c.MqttUsername == "" {
 		m.logError("MQTT Username has not been configured.")
-		m.Srv.Config.EnableMqtt = false
 		return errors.New("username has not been configured")
 	}
-	if m.Srv.Config.MqttPassword == "" {
+	if c.MqttPassword == "" {
 		m.logError("MQTT Password has not been configured.")
-		m.Srv.Config.EnableMqtt = false
 		return errors.New("password has not been configured")
 	}
 
@@ -43,34 +67,148 @@ func (m *Mqtt) Initialize() error {
 	m.logInfo("Connecting to the MQTT Broker.")
 
 	opts := MQTT.NewClientOptions()
-	opts.AddBroker(m.Srv.Config.MqttHost)
-	opts.SetUsername(m.Srv.Config.MqttUsername)
-	opts.SetPassword(m.Srv.Config.MqttPassword)
+	opts.AddBroker(c.MqttHost)
+	opts.SetUsername(c.MqttUsername)
+	opts.SetPassword(string(c.MqttPassword))
+
+	// The broker publishes the offline state if the unit drops off without disconnecting
+	opts.SetWill(mqttTopic(c, "status"), "offline", byte(0), true)
 
 	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
-		m.logError("Disconnected from MQTT Broker.", err.Error())
+		logEntry("Mqtt", LevelWarning, "Disconnected from MQTT Broker.", "error", err)
 	})
 	opts.SetOnConnectHandler(func(client MQTT.Client) {
 		m.logInfo("Connected to the MQTT Broker.")
+		client.Publish(mqttTopic(c, "status"), byte(0), true, "online")
 	})
 
-	m.client = MQTT.NewClient(opts)
-	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
-		m.logError("Error connecting to MQTT Broker.", token.Error())
+	client := MQTT.NewClient(opts)
+	m.lock.Lock()
+	m.client = client
+	m.lock.Unlock()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		m.logError("Error connecting to MQTT Broker.", "error", token.Error())
+		m.lock.Lock()
+		if m.client == client {
+			m.client = nil
+		}
+		m.lock.Unlock()
 		return token.Error()
 	}
 
 	return nil
 }
 
+// Status returns the state of the connection to the MQTT broker.
+func (m *Mqtt) Status() MqttStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return MqttStatus{
+		Enabled:           m.Srv.Config().EnableMqtt,
+		Connected:         m.client != nil && m.client.IsConnected(),
+		LastUpdateAttempt: m.LastUpdateAttempt,
+		LastUpdate:        m.LastUpdate,
+	}
+}
+
 // Close closes the MQTT client and disconnects
 func (m *Mqtt) Close() {
-	m.client.Disconnect(250)
+	m.lock.Lock()
+	client := m.client
+	m.client = nil
+	m.lock.Unlock()
+
+	if client != nil && client.IsConnected() {
+		client.Disconnect(250)
+	}
+}
+
+// current returns the client.  A publish uses the client it started with,
+// even if the client is closed or replaced while it is publishing.
+func (m *Mqtt) current() MQTT.Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.client
+}
+
+// connect returns the client, connected to the broker.  A client that could not
+// connect is started up again, and a client that has been disconnected is reconnected.
+// The publishes share the client, so only one of them connects at a time.
+func (m *Mqtt) connect() (MQTT.Client, error) {
+	m.connectLock.Lock()
+	defer m.connectLock.Unlock()
+
+	client := m.current()
+	if client == nil {
+		if err := m.initialize(); err != nil {
+			return nil, err
+		}
+		if client = m.current(); client == nil {
+			return nil, errors.New("client has not been initialized")
+		}
+		return client, nil
+	}
+	if client.IsConnected() {
+		return client, nil
+	}
+	logEntry("Mqtt", LevelWarning, "Reconnecting to MQTT broker.")
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		m.logError("Error connecting to MQTT Broker.", "error", token.Error())
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+// Async publishes on a separate goroutine, so that the caller is not held up
+// by the broker.  Flush waits for these publishes to complete.
+func (m *Mqtt) Async(f func()) {
+	m.pending.Add(1)
+	go func() {
+		defer m.pending.Done()
+		f()
+	}()
+}
+
+// Flush waits for the publishes started with Async to complete, or for the context to expire.
+func (m *Mqtt) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendOffline publishes the offline state, so that subscribers know the unit
+// has shut down cleanly.  It gives up when the context expires.
+func (m *Mqtt) SendOffline(ctx context.Context) error {
+	client := m.current()
+	if client == nil || !client.IsConnected() {
+		return nil
+	}
+	m.logInfo("Publishing offline state")
+	d := 5 * time.Second
+	if dl, ok := ctx.Deadline(); ok {
+		d = time.Until(dl)
+	}
+	token := client.Publish(mqttTopic(m.Srv.Config(), "status"), byte(0), true, "offline")
+	if !token.WaitTimeout(d) {
+		return errors.New("timed out publishing the offline state")
+	}
+	return token.Error()
 }
 
 // SendTelemetry sends the current states of the devices to the MQTT Broker
 func (m *Mqtt) SendTelemetry(v Measurement) error {
-	if !m.Srv.Config.EnableMqtt {
+	c := m.Srv.Config()
+	if !c.EnableMqtt {
 		return nil
 	}
 
@@ -80,59 +218,168 @@ func (m *Mqtt) SendTelemetry(v Measurement) error {
 	}
 
 	m.logInfo("Publishing telemetry to MQTT")
+	m.lock.Lock()
 	m.LastUpdateAttempt = time.Now()
+	m.lock.Unlock()
 
-	if !m.client.IsConnected() {
-		m.logInfo("Reconnecting to MQTT broker")
-		if token := m.client.Connect(); token.Wait() && token.Error() != nil {
-			m.logError("Error connecting to MQTT Broker.", token.Error())
-			return token.Error()
-		}
+	client, err := m.connect()
+	if err != nil {
+		return err
 	}
 
-	// Temperature
-	m.logInfo("Publishing air temperature - ", fmt.Sprintf("%.1f", v.AirTemp), "C")
-	token := m.client.Publish("home/garden/airtemp", byte(0), true, fmt.Sprintf("%.1f", v.AirTemp))
-	if token.Wait() && token.Error() != nil {
-		m.logError("Error sending air temperature state to MQTT Broker.", token.Error())
-		return token.Error()
+	// Temperature.  A temperature that was not read is not published, so the retained value is kept.
+	if v.Has("airTemp") {
+		m.logInfo("Publishing air temperature - ", fmt.Sprintf("%.1f", v.AirTemp), "C")
+		token := client.Publish(mqttTopic(c, "airtemp"), byte(0), true, fmt.Sprintf("%.1f", v.AirTemp))
+		if token.Wait() && token.Error() != nil {
+			m.logError("Error sending air temperature state to MQTT Broker.", "error", token.Error())
+			return token.Error()
+		}
 	}
 
-	m.logInfo("Publishing soil temperature - ", fmt.Sprintf("%.1f", v.SoilTemp), "C")
-	token = m.client.Publish("home/garden/soiltemp", byte(0), true, fmt.Sprintf("%.1f", v.SoilTemp))
-	if token.Wait() && token.Error() != nil {
-		m.logError("Error sending soil temperature state to MQTT Broker.", token.Error())
-		return token.Error()
+	if v.Has("soilTemp") {
+		m.logInfo("Publishing soil temperature - ", fmt.Sprintf("%.1f", v.SoilTemp), "C")
+		token := client.Publish(mqttTopic(c, "soiltemp"), byte(0), true, fmt.Sprintf("%.1f", v.SoilTemp))
+		if token.Wait() && token.Error() != nil {
+			m.logError("Error sending soil temperature state to MQTT Broker.", "error", token.Error())
+			return token.Error()
+		}
 	}
 
 	// Light
 	m.logInfo("Publishing light - ", fmt.Sprintf("%.1f", v.Light), "%")
-	token = m.client.Publish("home/garden/light", byte(0), true, fmt.Sprintf("%.1f", v.Light))
+	token := client.Publish(mqttTopic(c, "light"), byte(0), true, fmt.Sprintf("%.1f", v.Light))
 	if token.Wait() && token.Error() != nil {
-		m.logError("Error sending light state to MQTT Broker.", token.Error())
+		m.logError("Error sending light state to MQTT Broker.", "error", token.Error())
 		return token.Error()
 	}
 	// Moisture
 	m.logInfo("Publishing moisture - ", fmt.Sprintf("%.1f", v.Moisture), "%")
-	token = m.client.Publish("home/garden/moisture", byte(0), true, fmt.Sprintf("%.1f", v.Moisture))
+	token = client.Publish(mqttTopic(c, "moisture"), byte(0), true, fmt.Sprintf("%.1f", v.Moisture))
 	if token.Wait() && token.Error() != nil {
-		m.logError("Error sending moisture state to MQTT Broker.", token.Error())
+		m.logError("Error sending moisture state to MQTT Broker.", "error", token.Error())
 		return token.Error()
 	}
 
+	m.lock.Lock()
 	m.LastUpdate = time.Now()
+	m.lock.Unlock()
+
+	return nil
+}
+
+// SendWateringEvent publishes the watering event to the MQTT Broker
+func (m *Mqtt) SendWateringEvent(e WateringEvent) error {
+	p, err := e.Serialize()
+	if err != nil {
+		return err
+	}
+	m.logInfo("Publishing watering event - ", e.Trigger, " for ", fmt.Sprintf("%.0f", e.Duration), "s")
+	return m.publish("irrigation", false, p)
+}
+
+// SendAlert publishes the alert state change to the MQTT Broker
+func (m *Mqtt) SendAlert(a Alert) error {
+	p, err := a.Serialize()
+	if err != nil {
+		return err
+	}
+	m.logInfo("Publishing alert - ", a.Rule, " is ", a.State)
+	return m.publish("alert", false, p)
+}
+
+// SendFrostForecast publishes the frost forecast to the MQTT Broker
+func (m *Mqtt) SendFrostForecast(fc FrostForecast) error {
+	p, err := fc.Serialize()
+	if err != nil {
+		return err
+	}
+	m.logInfo("Publishing frost forecast - minimum ", fmt.Sprintf("%.1f", fc.PredictedMin), "C")
+	return m.publish("frost", true, p)
+}
+
+// SendDryingForecast publishes the drying forecast to the MQTT Broker
+func (m *Mqtt) SendDryingForecast(fc DryingForecast) error {
+	if !fc.Valid {
+		return nil
+	}
+	p, err := fc.Serialize()
+	if err != nil {
+		return err
+	}
+	m.logInfo("Publishing hours until dry - ", fmt.Sprintf("%.1f", fc.HoursUntilDry), "h")
+	if err := m.publish("hourstodry", true, fmt.Sprintf("%.1f", fc.HoursUntilDry)); err != nil {
+		return err
+	}
+	return m.publish("drying", true, p)
+}
+
+// SendSeason publishes the season totals to the MQTT Broker
+func (m *Mqtt) SendSeason(t SeasonTotals) error {
+	m.logInfo("Publishing growing degree days - ", fmt.Sprintf("%.1f", t.AirGdd))
+	if err := m.publish("gdd", true, fmt.Sprintf("%.1f", t.AirGdd)); err != nil {
+		return err
+	}
+	if err := m.publish("soilgdd", true, fmt.Sprintf("%.1f", t.SoilGdd)); err != nil {
+		return err
+	}
+	m.logInfo("Publishing chill hours - ", fmt.Sprintf("%.1f", t.ChillHours))
+	return m.publish("chillhours", true, fmt.Sprintf("%.1f", t.ChillHours))
+}
 
+// SendLight publishes the daily light totals to the MQTT Broker
+func (m *Mqtt) SendLight(d DailyLight) error {
+	p, err := d.Serialize()
+	if err != nil {
+		return err
+	}
+	m.logInfo("Publishing daily light integral - ", fmt.Sprintf("%.2f", d.Dli), " mol/m2")
+	if err := m.publish("dli", true, fmt.Sprintf("%.2f", d.Dli)); err != nil {
+		return err
+	}
+	if err := m.publish("photoperiod", true, fmt.Sprintf("%.1f", d.Photoperiod)); err != nil {
+		return err
+	}
+	return m.publish("daylight", true, p)
+}
+
+// publish publishes the payload to the named topic under the topic prefix,
+// reconnecting to the broker if required
+func (m *Mqtt) publish(name string, retained bool, payload string) error {
+	c := m.Srv.Config()
+	if !c.EnableMqtt {
+		return nil
+	}
+	topic := mqttTopic(c, name)
+	client, err := m.connect()
+	if err != nil {
+		return err
+	}
+
+	token := client.Publish(topic, byte(0), retained, payload)
+	if token.Wait() && token.Error() != nil {
+		m.logError("Error sending to MQTT Broker.", "topic", topic, "error", token.Error())
+		return token.Error()
+	}
 	return nil
 }
 
+// mqttTopic returns the named topic under the configured topic prefix.
+func mqttTopic(c *Config, name string) string {
+	p := strings.Trim(c.MqttTopic, "/")
+	if p == "" {
+		p = defaultMqttTopic
+	}
+	return p + "/" + name
+}
+
 // logInfo logs an information message to the logger
 func (m *Mqtt) logInfo(v ...interface{}) {
 	a := fmt.Sprint(v...)
-	logger.Info("Mqtt: [Inf] ", a)
+	logEntry("Mqtt", LevelInfo, a)
 }
 
 // logError logs an error message to the logger
-func (m *Mqtt) logError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Error("Mqtt [Err] ", a)
+func (m *Mqtt) logError(msg string, kv ...interface{}) {
+	logEntry("Mqtt", LevelError, msg, kv...)
 }
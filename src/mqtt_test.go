@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMqttCloseWhilePublishing(t *testing.T) {
+	logLevels.Set("Mqtt", LevelError, time.Minute)
+	defer logLevels.Revert("Mqtt")
+
+	// Nothing listens on the port, so each publish fails to reconnect
+	c := &Config{EnableMqtt: true, MqttHost: "tcp://127.0.0.1:1", MqttUsername: "user", MqttPassword: "secret"}
+	m := &Mqtt{Srv: newTestServer(c)}
+	newClient := func() MQTT.Client {
+		opts := MQTT.NewClientOptions()
+		opts.AddBroker(c.MqttHost)
+		opts.SetAutoReconnect(false)
+		return MQTT.NewClient(opts)
+	}
+	m.client = newClient()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			m.SendTelemetry(Measurement{Success: true})
+			m.publish("test", false, "test")
+		}()
+		go func() {
+			defer wg.Done()
+			m.Close()
+			m.lock.Lock()
+			m.client = newClient()
+			m.lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	m.Close()
+	if m.Status().Connected {
+		t.Error("Client should not be connected.")
+	}
+}
+
+func TestMqttInitializeLeavesConfigUnchanged(t *testing.T) {
+	c := &Config{EnableMqtt: true}
+	m := &Mqtt{Srv: newTestServer(c)}
+	if err := m.Initialize(); err == nil {
+		t.Error("Missing host was not reported.")
+	}
+	if !c.EnableMqtt {
+		t.Error("Configuration was changed.")
+	}
+}
+
+func TestMqttFlushWaitsForPublishes(t *testing.T) {
+	m := Mqtt{}
+	release := make(chan struct{})
+	m.Async(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Flush(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected the flush to time out but got", err)
+	}
+	close(release)
+	if err := m.Flush(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMqttFailedConnectClearsClient(t *testing.T) {
+	logLevels.Set("Mqtt", LevelError, time.Minute)
+	defer logLevels.Revert("Mqtt")
+
+	// Nothing listens on the port, so the connect fails
+	c := &Config{EnableMqtt: true, MqttHost: "tcp://127.0.0.1:1", MqttUsername: "user", MqttPassword: "secret"}
+	m := &Mqtt{Srv: newTestServer(c)}
+	if err := m.Initialize(); err == nil {
+		t.Fatal("Expected the connect to fail")
+	}
+	if m.current() != nil {
+		t.Error("Client that failed to connect was kept.")
+	}
+
+	// The publishes connect one at a time, each starting a new client
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.publish("test", false, "test"); err == nil {
+				t.Error("Expected the publish to fail")
+			}
+		}()
+	}
+	wg.Wait()
+	if m.current() != nil {
+		t.Error("Client that failed to connect was kept.")
+	}
+}
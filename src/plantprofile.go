@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Plant profile statuses
+const (
+	StatusOk        = "ok"         // The value is inside the profile range
+	StatusTooDry    = "too dry"    // The moisture is below the profile range
+	StatusTooWet    = "too wet"    // The moisture is above the profile range
+	StatusTooCold   = "too cold"   // The temperature is below the profile range
+	StatusTooHot    = "too hot"    // The temperature is above the profile range
+	StatusTooDark   = "too dark"   // The daily light integral is below the profile range
+	StatusTooBright = "too bright" // The daily light integral is above the profile range
+)
+
+// Names of the probes used when assigning profiles to probes
+const (
+	SoilProbe  = "soil"  // Moisture and soil temperature probe
+	AirProbe   = "air"   // Air temperature probe
+	LightProbe = "light" // Light sensor
+)
+
+// Probes lists the names of the probes that profiles can be assigned to.
+var Probes = []string{SoilProbe, AirProbe, LightProbe}
+
+// lightRange holds the daily light integral (mol/m2/day) a light requirement needs.
+type lightRange struct {
+	Min float64 // Minimum daily light integral
+	Max float64 // Maximum daily light integral.  0 for no maximum.
+}
+
+// lightRanges holds the daily light integral range of each light requirement.
+var lightRanges = map[string]lightRange{
+	"full":    {Min: 20},
+	"partial": {Min: 10, Max: 30},
+	"shade":   {Min: 2, Max: 12},
+}
+
+// PlantProfile holds the growing conditions for a type of plant.
+type PlantProfile struct {
+	Name        string  `json:"name"`        // Name of the profile
+	MinMoisture float64 `json:"minMoisture"` // Minimum moisture (%)
+	MaxMoisture float64 `json:"maxMoisture"` // Maximum moisture (%)
+	MinSoilTemp float64 `json:"minSoilTemp"` // Minimum soil temperature (C)
+	MaxSoilTemp float64 `json:"maxSoilTemp"` // Maximum soil temperature (C)
+	MinAirTemp  float64 `json:"minAirTemp"`  // Minimum air temperature (C)
+	Light       string  `json:"light"`       // Light requirement ("full", "partial" or "shade")
+	Builtin     bool    `json:"builtin"`     // Profile is part of the built in catalogue and cannot be edited
+}
+
+// PlantProfileList holds the profile catalogue and the profile assignments.
+type PlantProfileList struct {
+	Profile       string            `json:"profile"`       // Profile assigned to the unit
+	ProbeProfiles map[string]string `json:"probeProfiles"` // Profiles assigned to the probes
+	Probes        []string          `json:"probes"`        // Probes that profiles can be assigned to
+	Profiles      []PlantProfile    `json:"profiles"`      // Built in and custom profiles
+}
+
+// builtinProfiles holds the built in profile catalogue.
+var builtinProfiles = []PlantProfile{
+	{Name: "general", MinMoisture: 30, MaxMoisture: 70, MinSoilTemp: 5, MaxSoilTemp: 35, MinAirTemp: 0, Light: "partial", Builtin: true},
+	{Name: "tomato", MinMoisture: 40, MaxMoisture: 70, MinSoilTemp: 15, MaxSoilTemp: 30, MinAirTemp: 10, Light: "full", Builtin: true},
+	{Name: "succulent", MinMoisture: 10, MaxMoisture: 35, MinSoilTemp: 10, MaxSoilTemp: 35, MinAirTemp: 5, Light: "full", Builtin: true},
+	{Name: "seedling", MinMoisture: 50, MaxMoisture: 80, MinSoilTemp: 18, MaxSoilTemp: 28, MinAirTemp: 12, Light: "partial", Builtin: true},
+	{Name: "lettuce", MinMoisture: 45, MaxMoisture: 75, MinSoilTemp: 7, MaxSoilTemp: 24, MinAirTemp: 2, Light: "partial", Builtin: true},
+	{Name: "herbs", MinMoisture: 25, MaxMoisture: 55, MinSoilTemp: 10, MaxSoilTemp: 30, MinAirTemp: 5, Light: "full", Builtin: true},
+}
+
+// Evaluate sets the moisture and temperature statuses of the measurement.
+func (p *PlantProfile) Evaluate(v *Measurement) {
+	p.EvaluateSoil(v)
+	p.EvaluateAir(v)
+}
+
+// EvaluateSoil sets the moisture and soil temperature statuses of the measurement.
+func (p *PlantProfile) EvaluateSoil(v *Measurement) {
+	v.Profile = p.Name
+
+	v.Status = StatusOk
+	if v.Moisture < p.MinMoisture {
+		v.Status = StatusTooDry
+	} else if v.Moisture > p.MaxMoisture {
+		v.Status = StatusTooWet
+	}
+
+	// Readings that were not taken have no status
+	v.SoilTempStatus = ""
+	if v.Has("soilTemp") {
+		v.SoilTempStatus = StatusOk
+		if v.SoilTemp < p.MinSoilTemp {
+			v.SoilTempStatus = StatusTooCold
+		} else if v.SoilTemp > p.MaxSoilTemp {
+			v.SoilTempStatus = StatusTooHot
+		}
+	}
+}
+
+// EvaluateAir sets the air temperature status of the measurement.
+func (p *PlantProfile) EvaluateAir(v *Measurement) {
+	v.AirTempStatus = ""
+	if v.Has("airTemp") {
+		v.AirTempStatus = StatusOk
+		if v.AirTemp < p.MinAirTemp {
+			v.AirTempStatus = StatusTooCold
+		}
+	}
+}
+
+// EvaluateLight sets the light status of the measurement from the daily light
+// integral of the last full day.  The status is left empty if the profile has
+// no light requirement.
+func (p *PlantProfile) EvaluateLight(v *Measurement, dli float64) {
+	v.LightStatus = ""
+	r, ok := lightRanges[p.Light]
+	if !ok {
+		return
+	}
+	v.LightStatus = StatusOk
+	if dli < r.Min {
+		v.LightStatus = StatusTooDark
+	} else if r.Max > 0 && dli > r.Max {
+		v.LightStatus = StatusTooBright
+	}
+}
+
+// Validate checks that the profile values are valid.
+func (p *PlantProfile) Validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("profile name must be specified")
+	}
+	if p.MinMoisture > p.MaxMoisture {
+		return errors.New("minimum moisture must not be more than the maximum moisture")
+	}
+	if p.MinSoilTemp > p.MaxSoilTemp {
+		return errors.New("minimum soil temperature must not be more than the maximum soil temperature")
+	}
+	switch p.Light {
+	case "", "full", "partial", "shade":
+	default:
+		return errors.New("light requirement must be 'full', 'partial' or 'shade'")
+	}
+	return nil
+}
+
+// Profiles returns the built in and custom plant profiles.
+func (c *Config) Profiles() []PlantProfile {
+	l := append([]PlantProfile{}, builtinProfiles...)
+	for _, p := range c.CustomProfiles {
+		p.Builtin = false
+		l = append(l, p)
+	}
+	return l
+}
+
+// FindProfile returns the plant profile with the specified name.
+func (c *Config) FindProfile(name string) (PlantProfile, bool) {
+	for _, p := range c.Profiles() {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return PlantProfile{}, false
+}
+
+// isProbe returns whether the name is one of the probes.
+func isProbe(name string) bool {
+	for _, p := range Probes {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfileFor returns the plant profile assigned to the probe.
+// If no profile has been assigned to the probe, the unit profile is used.
+func (c *Config) ProfileFor(probe string) PlantProfile {
+	if n, ok := c.ProbeProfiles[probe]; ok {
+		if p, ok := c.FindProfile(n); ok {
+			return p
+		}
+	}
+	if p, ok := c.FindProfile(c.Profile); ok {
+		return p
+	}
+	return builtinProfiles[0]
+}
+
+// SetCustomProfile adds or updates the custom plant profile.
+func (c *Config) SetCustomProfile(p PlantProfile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	for _, b := range builtinProfiles {
+		if strings.EqualFold(b.Name, p.Name) {
+			return errors.New("built in profile '" + b.Name + "' cannot be changed")
+		}
+	}
+	p.Builtin = false
+	for i := range c.CustomProfiles {
+		if strings.EqualFold(c.CustomProfiles[i].Name, p.Name) {
+			c.CustomProfiles[i] = p
+			return nil
+		}
+	}
+	c.CustomProfiles = append(c.CustomProfiles, p)
+	return nil
+}
+
+// DeleteCustomProfile removes the custom plant profile.
+func (c *Config) DeleteCustomProfile(name string) error {
+	for i := range c.CustomProfiles {
+		if strings.EqualFold(c.CustomProfiles[i].Name, name) {
+			c.CustomProfiles = append(c.CustomProfiles[:i], c.CustomProfiles[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("custom profile '" + name + "' was not found")
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (l *PlantProfileList) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
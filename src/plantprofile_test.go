@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfileStatus(t *testing.T) {
+	c := Config{Profile: "succulent"}
+	p := c.ProfileFor(SoilProbe)
+	if p.Name != "succulent" {
+		t.Fatal("Expected succulent profile but got", p.Name)
+	}
+	v := Measurement{Moisture: 50, SoilTemp: 20, AirTemp: 2}
+	p.Evaluate(&v)
+	if v.Status != StatusTooWet {
+		t.Error("Expected too wet but got", v.Status)
+	}
+	if v.AirTempStatus != StatusTooCold {
+		t.Error("Expected too cold but got", v.AirTempStatus)
+	}
+
+	if err := c.SetCustomProfile(PlantProfile{Name: "chillies", MinMoisture: 35, MaxMoisture: 60, MaxSoilTemp: 30}); err != nil {
+		t.Fatal(err)
+	}
+	c.ProbeProfiles = map[string]string{SoilProbe: "Chillies"}
+	if p := c.ProfileFor(SoilProbe); p.Name != "chillies" {
+		t.Error("Expected chillies profile for the probe but got", p.Name)
+	}
+	if err := c.SetCustomProfile(PlantProfile{Name: "Tomato", MaxMoisture: 10}); err == nil {
+		t.Error("Built in profile was changed.")
+	}
+}
+
+func TestProfileSkipsMissingReadings(t *testing.T) {
+	p := PlantProfile{Name: "test", MinMoisture: 30, MaxMoisture: 70, MinSoilTemp: 5, MaxSoilTemp: 35, MinAirTemp: 5}
+	v := Measurement{Moisture: 20, Missing: []string{"airTemp", "soilTemp"}}
+	p.Evaluate(&v)
+	if v.Status != StatusTooDry {
+		t.Error("Expected the moisture to be too dry but got", v.Status)
+	}
+	if v.AirTempStatus != "" || v.SoilTempStatus != "" {
+		t.Error("Expected no temperature status but got", v.AirTempStatus, v.SoilTempStatus)
+	}
+}
+
+func TestProfileLightStatus(t *testing.T) {
+	c := Config{Profile: "tomato"}
+	p := c.ProfileFor(SoilProbe)
+	v := Measurement{}
+	p.EvaluateLight(&v, 12)
+	if v.LightStatus != StatusTooDark {
+		t.Error("Expected too dark for a full sun profile but got", v.LightStatus)
+	}
+	p.EvaluateLight(&v, 25)
+	if v.LightStatus != StatusOk {
+		t.Error("Expected ok but got", v.LightStatus)
+	}
+
+	p = PlantProfile{Name: "fern", Light: "shade"}
+	p.EvaluateLight(&v, 25)
+	if v.LightStatus != StatusTooBright {
+		t.Error("Expected too bright for a shade profile but got", v.LightStatus)
+	}
+	p.Light = ""
+	p.EvaluateLight(&v, 25)
+	if v.LightStatus != "" {
+		t.Error("Expected no light status without a requirement but got", v.LightStatus)
+	}
+}
+
+func TestUnknownProbeIsRejected(t *testing.T) {
+	c := Config{ProbeProfiles: map[string]string{"sol": "tomato"}}
+	errs := c.Validate()
+	if len(errs) != 1 || errs[0].Field != "probeProfiles.sol" {
+		t.Error("Expected the unknown probe to be rejected but got", errs)
+	}
+	c.ProbeProfiles = map[string]string{SoilProbe: "tomato"}
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Error("Expected no errors but got", errs)
+	}
+}
+
+func TestDuplicateProfileNamesAreRejected(t *testing.T) {
+	c := Config{CustomProfiles: []PlantProfile{
+		{Name: "chilli", MaxMoisture: 60, MaxSoilTemp: 30},
+		{Name: "Chilli", MaxMoisture: 50, MaxSoilTemp: 30},
+		{Name: "Tomato", MaxMoisture: 50, MaxSoilTemp: 30},
+	}}
+	errs := c.Validate()
+	if len(errs) != 2 || errs[0].Field != "customProfiles[1].name" || errs[1].Field != "customProfiles[2].name" {
+		t.Error("Expected the duplicate and built in names to be rejected but got", errs)
+	}
+}
+
+func TestProfileControllerReturnsFieldErrors(t *testing.T) {
+	c := &ProfileController{Srv: newTestServer(&Config{})}
+	for _, x := range []struct {
+		path  string
+		form  string
+		field string
+	}{
+		{"/profile/set", "name=chilli&minMoisture=x", "minMoisture"},
+		{"/profile/delete", "name=general", "name"},
+		{"/profile/assign", "profile=cactus", "profile"},
+	} {
+		r := httptest.NewRequest("POST", x.path, strings.NewReader(x.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		switch x.path {
+		case "/profile/set":
+			c.handleSetProfile(w, r)
+		case "/profile/delete":
+			c.handleDeleteProfile(w, r)
+		default:
+			c.handleAssignProfile(w, r)
+		}
+		e := ConfigError{}
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != 400 || len(e.Errors) != 1 || e.Errors[0].Field != x.field {
+			t.Error("Expected a 400 error for", x.field, "but got", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestProfilesAreAssignedToEachProbe(t *testing.T) {
+	c := Config{Profile: "general", ProbeProfiles: map[string]string{AirProbe: "seedling", LightProbe: "succulent"}}
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Fatal("Expected no errors but got", errs)
+	}
+	v := Measurement{Moisture: 50, SoilTemp: 20, AirTemp: 10}
+	soil := c.ProfileFor(SoilProbe)
+	soil.EvaluateSoil(&v)
+	air := c.ProfileFor(AirProbe)
+	air.EvaluateAir(&v)
+	light := c.ProfileFor(LightProbe)
+	light.EvaluateLight(&v, 15)
+	if v.Profile != "general" || v.Status != StatusOk {
+		t.Error("Expected the moisture to be ok for the general profile but got", v.Profile, v.Status)
+	}
+	if v.AirTempStatus != StatusTooCold {
+		t.Error("Expected the air to be too cold for the seedling profile but got", v.AirTempStatus)
+	}
+	if v.LightStatus != StatusTooDark {
+		t.Error("Expected the light to be too dark for the succulent profile but got", v.LightStatus)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ProfileController handles the Web Methods for the plant profiles.
+type ProfileController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *ProfileController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/profile/get").Name("GetProfiles").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetProfiles)))
+	router.Methods("POST").Path("/profile/set").Name("SetProfile").
+		Handler(Logger(c, http.HandlerFunc(c.handleSetProfile)))
+	router.Methods("POST").Path("/profile/delete").Name("DeleteProfile").
+		Handler(Logger(c, http.HandlerFunc(c.handleDeleteProfile)))
+	router.Methods("POST").Path("/profile/assign").Name("AssignProfile").
+		Handler(Logger(c, http.HandlerFunc(c.handleAssignProfile)))
+}
+
+func (c *ProfileController) handleGetProfiles(w http.ResponseWriter, r *http.Request) {
+	cfg := c.Srv.Config()
+	l := PlantProfileList{
+		Profile:       cfg.Profile,
+		ProbeProfiles: cfg.ProbeProfiles,
+		Probes:        Probes,
+		Profiles:      cfg.Profiles(),
+	}
+	if err := l.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing profiles. "+err.Error(), 500)
+	}
+}
+
+func (c *ProfileController) handleSetProfile(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p := PlantProfile{
+		Name:  r.Form.Get("name"),
+		Light: r.Form.Get("light"),
+	}
+	for _, f := range []struct {
+		n string
+		v *float64
+	}{
+		{"minMoisture", &p.MinMoisture},
+		{"maxMoisture", &p.MaxMoisture},
+		{"minSoilTemp", &p.MinSoilTemp},
+		{"maxSoilTemp", &p.MaxSoilTemp},
+		{"minAirTemp", &p.MinAirTemp},
+	} {
+		s := r.Form.Get(f.n)
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			e := ConfigError{Message: "Profile is not valid.", Errors: ValidationErrors{}}
+			e.Errors.add(f.n, "must be a number")
+			e.WriteTo(w, 400)
+			return
+		}
+		*f.v = v
+	}
+
+	nc := c.Srv.Config().Clone()
+	if err := nc.SetCustomProfile(p); err != nil {
+		e := ConfigError{Message: "Profile is not valid. " + err.Error(), Errors: ValidationErrors{}}
+		e.WriteTo(w, 400)
+		return
+	}
+	c.LogInfo("Saving custom profile ", p.Name, ".")
+	c.update(w, r, nc)
+}
+
+func (c *ProfileController) handleDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	n := r.Form.Get("name")
+	nc := c.Srv.Config().Clone()
+	if strings.EqualFold(nc.Profile, n) || isAssignedToProbe(&nc, n) {
+		e := ConfigError{Message: "Profile '" + n + "' is assigned and cannot be deleted.", Errors: ValidationErrors{}}
+		e.Errors.add("name", "is assigned to the unit or a probe")
+		e.WriteTo(w, 400)
+		return
+	}
+	if err := nc.DeleteCustomProfile(n); err != nil {
+		e := ConfigError{Message: "Profile could not be deleted.", Errors: ValidationErrors{}}
+		e.Errors.add("name", err.Error())
+		e.WriteTo(w, 400)
+		return
+	}
+	c.LogInfo("Deleted custom profile ", n, ".")
+	c.update(w, r, nc)
+}
+
+func (c *ProfileController) handleAssignProfile(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	n := r.Form.Get("profile")
+	probe := r.Form.Get("probe")
+	nc := c.Srv.Config().Clone()
+	p, ok := nc.FindProfile(n)
+	if !ok && !(probe != "" && n == "") {
+		e := ConfigError{Message: "Profile '" + n + "' was not found.", Errors: ValidationErrors{}}
+		e.Errors.add("profile", "was not found")
+		e.WriteTo(w, 400)
+		return
+	}
+
+	if probe == "" {
+		c.LogInfo("Assigning profile ", p.Name, " to the unit.")
+		nc.Profile = p.Name
+	} else {
+		if nc.ProbeProfiles == nil {
+			nc.ProbeProfiles = map[string]string{}
+		}
+		if n == "" {
+			c.LogInfo("Removing the profile from probe ", probe, ".")
+			delete(nc.ProbeProfiles, probe)
+		} else {
+			c.LogInfo("Assigning profile ", p.Name, " to probe ", probe, ".")
+			nc.ProbeProfiles[probe] = p.Name
+		}
+	}
+	c.update(w, r, nc)
+}
+
+// isAssignedToProbe returns whether the profile is assigned to any of the probes.
+func isAssignedToProbe(c *Config, n string) bool {
+	for _, x := range c.ProbeProfiles {
+		if strings.EqualFold(x, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies and saves the changed configuration through the configuration API.
+func (c *ProfileController) update(w http.ResponseWriter, r *http.Request, nc Config) {
+	api := ConfigAPIController{Srv: c.Srv}
+	api.update(w, r, nc)
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *ProfileController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("ProfileController", LevelInfo, a)
+}
@@ -0,0 +1,113 @@
+package main
+
+import "math"
+
+// LinearFit holds the result of a least squares straight line fit.
+type LinearFit struct {
+	Slope     float64 // Change in y per unit of x
+	Intercept float64 // Value of y where x is zero
+	StdErr    float64 // Standard error of the residuals
+	SlopeErr  float64 // Standard error of the slope
+	N         int     // Number of points used in the fit
+}
+
+// FitLine fits a straight line through the points using least squares.
+// Returns false if there are fewer than 2 points or all the x values are the same.
+func FitLine(x []float64, y []float64) (LinearFit, bool) {
+	f := LinearFit{N: len(x)}
+	if len(x) < 2 || len(x) != len(y) {
+		return f, false
+	}
+	n := float64(len(x))
+	sx, sy := 0.0, 0.0
+	for i := range x {
+		sx = sx + x[i]
+		sy = sy + y[i]
+	}
+	mx, my := sx/n, sy/n
+	sxx, sxy := 0.0, 0.0
+	for i := range x {
+		sxx = sxx + (x[i]-mx)*(x[i]-mx)
+		sxy = sxy + (x[i]-mx)*(y[i]-my)
+	}
+	if sxx == 0 {
+		return f, false
+	}
+	f.Slope = sxy / sxx
+	f.Intercept = my - f.Slope*mx
+	if len(x) > 2 {
+		ss := 0.0
+		for i := range x {
+			r := y[i] - f.At(x[i])
+			ss = ss + r*r
+		}
+		f.StdErr = math.Sqrt(ss / (n - 2))
+		f.SlopeErr = f.StdErr / math.Sqrt(sxx)
+	}
+	return f, true
+}
+
+// At returns the fitted value of y at x.
+func (f LinearFit) At(x float64) float64 {
+	return f.Intercept + f.Slope*x
+}
+
+// QuadraticFit holds the result of a least squares quadratic fit, y = A*x*x + B*x + C.
+type QuadraticFit struct {
+	A float64 // Coefficient of x squared
+	B float64 // Coefficient of x
+	C float64 // Value of y where x is zero
+	N int     // Number of points used in the fit
+}
+
+// FitQuadratic fits a quadratic through the points using least squares.
+// Returns false if there are fewer than 3 points or fewer than 3 different x values.
+func FitQuadratic(x []float64, y []float64) (QuadraticFit, bool) {
+	f := QuadraticFit{N: len(x)}
+	if len(x) < 3 || len(x) != len(y) {
+		return f, false
+	}
+
+	// Centre the x values to keep the sums small
+	m := 0.0
+	for i := range x {
+		m = m + x[i]
+	}
+	m = m / float64(len(x))
+	var s [5]float64
+	var t [3]float64
+	for i := range x {
+		u := x[i] - m
+		p := 1.0
+		for k := 0; k < 5; k++ {
+			s[k] = s[k] + p
+			if k < 3 {
+				t[k] = t[k] + p*y[i]
+			}
+			p = p * u
+		}
+	}
+
+	// Solve the normal equations using Cramer's rule
+	det3 := func(a, b, c, d, e, f, g, h, i float64) float64 {
+		return a*(e*i-f*h) - b*(d*i-f*g) + c*(d*h-e*g)
+	}
+	d := det3(s[4], s[3], s[2], s[3], s[2], s[1], s[2], s[1], s[0])
+	if math.Abs(d) < 1e-12 {
+		return f, false
+	}
+	a := det3(t[2], s[3], s[2], t[1], s[2], s[1], t[0], s[1], s[0]) / d
+	b := det3(s[4], t[2], s[2], s[3], t[1], s[1], s[2], t[0], s[0]) / d
+	c := det3(s[4], s[3], t[2], s[3], s[2], t[1], s[2], s[1], t[0]) / d
+
+	// Move the origin back from the centre
+	f.A = a
+	f.B = b - 2*a*m
+	f.C = a*m*m - b*m + c
+	return f, true
+}
+
+// At returns the fitted value of y at x.
+func (f QuadraticFit) At(x float64) float64 {
+	return f.A*x*x + f.B*x + f.C
+}
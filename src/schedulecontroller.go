@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ScheduleController handles the Web Methods for the measurement schedule.
+type ScheduleController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *ScheduleController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/schedule/get").Name("GetSchedule").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetSchedule)))
+}
+
+func (c *ScheduleController) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	// Defaults to the next 5 measurements
+	n := 5
+	if ns := r.URL.Query().Get("upcoming"); ns != "" {
+		v, err := strconv.Atoi(ns)
+		if err != nil {
+			http.Error(w, "Failed to convert "+ns+" to an integer.", 400)
+			return
+		}
+		n = v
+	}
+	sc := c.Srv.Scheduler()
+	if sc == nil {
+		http.Error(w, "The scheduler has not been started.", 500)
+		return
+	}
+	st := sc.Status(n)
+	if err := st.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing schedule. "+err.Error(), 500)
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *ScheduleController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("ScheduleController", LevelInfo, a)
+}
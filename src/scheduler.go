@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleRule defines how often the measurements are taken during a window of the day.
+type ScheduleRule struct {
+	Window string `json:"window"` // Named window, or time windows in the form "HH:MM-HH:MM".  Empty for the whole day.
+	Every  int    `json:"every"`  // Time (in minutes) between measurements, aligned to the clock
+	Cron   string `json:"cron"`   // Cron expression, used instead of Every
+}
+
+// ScheduleStatus holds the current state of the scheduler.
+type ScheduleStatus struct {
+	NextRun    time.Time      `json:"nextRun"`    // Time of the next measurement
+	LastRun    time.Time      `json:"lastRun"`    // Time of the last measurement
+	IsQuiet    bool           `json:"isQuiet"`    // The display and LED are off for the quiet hours
+	Period     int            `json:"period"`     // Period (in minutes) used when there are no schedule rules
+	Schedules  []ScheduleRule `json:"schedules"`  // Schedule rules
+	QuietHours string         `json:"quietHours"` // Quiet hours window
+	Upcoming   []time.Time    `json:"upcoming"`   // Times of the upcoming measurements
+}
+
+// Scheduler runs the job at the times defined by the schedule rules.
+// The first rule whose window contains the time decides if the job runs.
+// If there are no rules, the job runs every Period minutes.
+// Runs are aligned to the clock so that units line up in charts.
+type Scheduler struct {
+	Srv     *Server       // Server instance
+	Job     func()        // Job to run
+	NextRun time.Time     // Time of the next run
+	LastRun time.Time     // Time of the last run
+	IsQuiet bool          // The display and LED are off for the quiet hours
+	stop    chan struct{} // Stops the scheduler
+	stopped chan struct{} // Closed when the scheduler has stopped
+	lock    sync.Mutex    // Guards the scheduler state
+}
+
+// scheduleRule holds a schedule rule with the window and cron expression parsed.
+type scheduleRule struct {
+	windows []TimeWindow
+	every   int
+	cron    *CronExpr
+}
+
+// Start starts running the job on the schedule.
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.run(s.stop, s.stopped)
+}
+
+// Stop stops the scheduler.  A job that is already running is not interrupted.
+func (s *Scheduler) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// Wait waits for the scheduler to stop, including a job that is already running,
+// or for the context to expire.
+func (s *Scheduler) Wait(ctx context.Context) error {
+	s.lock.Lock()
+	stopped := s.stopped
+	s.lock.Unlock()
+	if stopped == nil {
+		return nil
+	}
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Next returns the first scheduled time after the specified time.
+func (s *Scheduler) Next(after time.Time) (time.Time, error) {
+	c := s.Srv.Config()
+	rules, err := s.compile(c)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < 2*24*60; i++ {
+		if s.matches(c, rules, t) {
+			return t, nil
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}, errors.New("no measurement is scheduled in the next 48 hours")
+}
+
+// Status returns the current state of the scheduler.
+func (s *Scheduler) Status(upcoming int) ScheduleStatus {
+	c := s.Srv.Config()
+	s.lock.Lock()
+	st := ScheduleStatus{
+		NextRun:    s.NextRun,
+		LastRun:    s.LastRun,
+		IsQuiet:    s.IsQuiet,
+		Period:     c.Period,
+		Schedules:  c.Schedules,
+		QuietHours: c.QuietHours,
+		Upcoming:   []time.Time{},
+	}
+	s.lock.Unlock()
+
+	t := time.Now()
+	for i := 0; i < upcoming; i++ {
+		n, err := s.Next(t)
+		if err != nil {
+			break
+		}
+		st.Upcoming = append(st.Upcoming, n)
+		t = n
+	}
+	return st
+}
+
+// run waits for the next scheduled time and runs the job, and switches the
+// quiet hours on and off.
+func (s *Scheduler) run(stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+	from := time.Now()
+	s.checkQuiet(from)
+	q := time.NewTicker(time.Minute)
+	defer q.Stop()
+
+	for {
+		// The next run is recalculated every minute to pick up configuration changes
+		next, err := s.Next(from)
+		if err != nil {
+			s.logError("Error calculating the next run.", "error", err)
+			next = from.Add(time.Duration(s.Srv.Config().Period) * time.Minute)
+		}
+		s.lock.Lock()
+		s.NextRun = next
+		s.lock.Unlock()
+
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case n := <-q.C:
+			t.Stop()
+			s.checkQuiet(n)
+		case <-t.C:
+			s.lock.Lock()
+			s.LastRun = time.Now()
+			s.lock.Unlock()
+			s.Job()
+			from = time.Now()
+		}
+	}
+}
+
+// checkQuiet switches the display and LED off during the quiet hours.
+func (s *Scheduler) checkQuiet(t time.Time) {
+	c := s.Srv.Config()
+	quiet := false
+	if c.QuietHours != "" {
+		w, err := c.resolveWindow(c.QuietHours, s.daylight())
+		if err != nil {
+			s.logError("Invalid quiet hours.", "error", err)
+		} else {
+			quiet = len(w) > 0 && IsInTimeWindows(w, t)
+		}
+	}
+
+	s.lock.Lock()
+	changed := s.IsQuiet != quiet
+	s.IsQuiet = quiet
+	s.lock.Unlock()
+	if !changed {
+		return
+	}
+
+	if quiet {
+		s.logInfo("Starting the quiet hours.")
+		s.Srv.LCD.SetQuiet(true)
+		if err := s.Srv.Led.Off(); err != nil {
+			s.logError("Failed to switch off the LED.", "error", err)
+		}
+	} else {
+		s.logInfo("Ending the quiet hours.")
+		s.Srv.LCD.SetQuiet(false)
+		if err := s.Srv.Led.On(); err != nil {
+			s.logError("Failed to switch on the LED.", "error", err)
+		}
+	}
+}
+
+// compile parses the schedule rules of the configuration.
+func (s *Scheduler) compile(c *Config) ([]scheduleRule, error) {
+	l := []scheduleRule{}
+	for _, r := range c.Schedules {
+		sr := scheduleRule{every: r.Every}
+		w, err := c.resolveWindow(r.Window, s.daylight())
+		if err != nil {
+			return l, err
+		}
+		sr.windows = w
+		if r.Cron != "" {
+			if sr.cron, err = ParseCron(r.Cron); err != nil {
+				return l, err
+			}
+		}
+		l = append(l, sr)
+	}
+	return l, nil
+}
+
+// matches returns whether the job should run at the time.
+func (s *Scheduler) matches(c *Config, rules []scheduleRule, t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if len(rules) == 0 {
+		return isAligned(m, c.Period)
+	}
+	for _, r := range rules {
+		if !IsInTimeWindows(r.windows, t) {
+			continue
+		}
+		if r.cron != nil {
+			return r.cron.Matches(t)
+		}
+		if r.every <= 0 {
+			return isAligned(m, c.Period)
+		}
+		return isAligned(m, r.every)
+	}
+	return false
+}
+
+// resolveWindow returns the time windows for a named window or a list of time windows.
+// The configured named windows are checked first.  "daylight" and "night" are taken
+// from the daylight window.
+func (c *Config) resolveWindow(name string, daylight TimeWindow) ([]TimeWindow, error) {
+	if name == "" {
+		return []TimeWindow{}, nil
+	}
+	if w, ok := c.Windows[name]; ok {
+		return ParseTimeWindows(w)
+	}
+	switch strings.ToLower(name) {
+	case "daylight", "day":
+		return []TimeWindow{daylight}, nil
+	case "night":
+		return []TimeWindow{{Start: daylight.End, End: daylight.Start}}, nil
+	}
+	return ParseTimeWindows(name)
+}
+
+// defaultDaylight is the daylight window used until the light sensor has seen a sunrise and sunset.
+var defaultDaylight = TimeWindow{Start: 6 * 60, End: 18 * 60}
+
+// daylight returns the daylight window seen by the light sensor, defaulting to 06:00-18:00.
+func (s *Scheduler) daylight() TimeWindow {
+	if s.Srv.Light != nil {
+		if w, ok := s.Srv.Light.Daylight(); ok {
+			return w
+		}
+	}
+	return defaultDaylight
+}
+
+// isAligned returns whether the minute of the day falls on the period boundary.
+func isAligned(m int, period int) bool {
+	if period <= 0 {
+		period = 5
+	}
+	return m%period == 0
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (st *ScheduleStatus) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+func (s *Scheduler) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("Scheduler", LevelInfo, a)
+}
+
+func (s *Scheduler) logError(msg string, kv ...interface{}) {
+	logEntry("Scheduler", LevelError, msg, kv...)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCronMatchesStepsAndRanges(t *testing.T) {
+	c, err := ParseCron("*/15 6-18 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2020-01-06 is a Monday
+	for _, x := range []struct {
+		t  time.Time
+		ok bool
+	}{
+		{time.Date(2020, 1, 6, 6, 0, 0, 0, time.Local), true},
+		{time.Date(2020, 1, 6, 6, 45, 0, 0, time.Local), true},
+		{time.Date(2020, 1, 6, 6, 50, 0, 0, time.Local), false},
+		{time.Date(2020, 1, 6, 19, 0, 0, 0, time.Local), false},
+		{time.Date(2020, 1, 5, 12, 0, 0, 0, time.Local), false},
+	} {
+		if c.Matches(x.t) != x.ok {
+			t.Errorf("%v should be %v", x.t, x.ok)
+		}
+	}
+	if _, err := ParseCron("* * *"); err == nil {
+		t.Error("Expected an error for a short expression")
+	}
+	if _, err := ParseCron("61 * * * *"); err == nil {
+		t.Error("Expected an error for an out of range minute")
+	}
+}
+
+func TestSchedulerUsesFirstMatchingWindow(t *testing.T) {
+	s := Scheduler{Srv: newTestServer(&Config{
+		Period:  5,
+		Windows: map[string]string{"night": "20:00-06:00"},
+		Schedules: []ScheduleRule{
+			{Window: "night", Every: 60},
+			{Window: "", Every: 10},
+		},
+	})}
+	d := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	for _, x := range []struct {
+		after, next time.Time
+	}{
+		{d.Add(12*time.Hour + 3*time.Minute), d.Add(12*time.Hour + 10*time.Minute)},
+		{d.Add(20*time.Hour + 5*time.Minute), d.Add(21 * time.Hour)},
+		{d.Add(5*time.Hour + 30*time.Minute), d.Add(6 * time.Hour)},
+	} {
+		n, err := s.Next(x.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !n.Equal(x.next) {
+			t.Errorf("Expected next run after %v to be %v but got %v", x.after, x.next, n)
+		}
+	}
+}
+
+func TestSchedulerDefaultsToAlignedPeriod(t *testing.T) {
+	s := Scheduler{Srv: newTestServer(&Config{Period: 15})}
+	d := time.Date(2020, 1, 1, 10, 7, 30, 0, time.Local)
+	n, err := s.Next(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Minute() != 15 || n.Hour() != 10 {
+		t.Error("Expected 10:15 but got", n)
+	}
+}
+
+func TestSchedulerWaitReturnsWhenStopped(t *testing.T) {
+	s := Scheduler{Srv: newTestServer(&Config{Period: 5}), Job: func() {}}
+	s.Start()
+	s.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Wait(ctx); err != nil {
+		t.Error("Expected the scheduler to stop but got", err)
+	}
+}
+
+func TestSampleIntervalFollowsSchedule(t *testing.T) {
+	s := newTestServer(&Config{
+		Period:    5,
+		Schedules: []ScheduleRule{{Window: "20:00-06:00", Every: 60}, {Every: 10}},
+	})
+	d := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	if i := s.sampleInterval(d.Add(12 * time.Hour)); i != 5*time.Minute {
+		t.Error("Expected the period without a scheduler but got", i)
+	}
+
+	s.scheduler = &Scheduler{Srv: s}
+	if i := s.sampleInterval(d.Add(12 * time.Hour)); i != 10*time.Minute {
+		t.Error("Expected 10m during the day but got", i)
+	}
+	if i := s.sampleInterval(d.Add(21 * time.Hour)); i != time.Hour {
+		t.Error("Expected 1h at night but got", i)
+	}
+}
+
+func TestStartScheduleKeepsQuietState(t *testing.T) {
+	r := &displayRecorder{}
+	s := newTestServer(&Config{Period: 5, Schedules: []ScheduleRule{{Cron: "0 0 1 1 *"}}})
+	s.LCD = &Display{ShowTime: 5, write: r.write}
+	s.LCD.SetItem("IP", "No IP", "")
+	s.LCD.Start()
+	defer s.LCD.Stop()
+
+	// The quiet hours have been removed while the display was switched off
+	s.LCD.SetQuiet(true)
+	s.scheduler = &Scheduler{Srv: s, IsQuiet: true}
+	s.StartSchedule()
+	defer s.Scheduler().Stop()
+
+	for i := 0; i < 100 && r.last() == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.last() == "" {
+		t.Error("Display was not switched back on.")
+	}
+	if s.Scheduler().Status(0).IsQuiet {
+		t.Error("Scheduler is still quiet.")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Growing degree day methods
+const (
+	GddAverage  = "average"  // Modified average of the daily minimum and maximum
+	GddTriangle = "triangle" // Single triangle between the daily minimum and maximum
+)
+
+// stateSaveEvery is the number of measurements between saves of the season
+// and light totals.  They are also saved when the day changes and on shutdown,
+// so the SD card is not written on every run.
+const stateSaveEvery = historySaveEvery
+
+// SeasonAccumulator accumulates the growing degree days and chill hours for the season.
+type SeasonAccumulator struct {
+	Srv      *Server     // Server instance
+	FilePath string      // Path of the file used to persist the season state
+	State    SeasonState // The accumulated state
+	unsaved  int         // Measurements added since the state was saved
+	lock     sync.Mutex  // Guards the state
+	saveLock sync.Mutex  // Makes sure the state is saved one save at a time
+}
+
+// SeasonState holds the accumulated totals for the completed days of the
+// season and the temperature range of the current day.
+type SeasonState struct {
+	SeasonStart string    `json:"seasonStart"` // Day the season started, in the form YYYY-MM-DD
+	Days        int       `json:"days"`        // Number of completed days
+	AirGdd      float64   `json:"airGdd"`      // Growing degree days from the air temperature for the completed days
+	SoilGdd     float64   `json:"soilGdd"`     // Growing degree days from the soil temperature for the completed days
+	ChillHours  float64   `json:"chillHours"`  // Chill hours accumulated
+	Day         string    `json:"day"`         // The current day, in the form YYYY-MM-DD
+	AirMin      float64   `json:"airMin"`      // Minimum air temperature for the current day
+	AirMax      float64   `json:"airMax"`      // Maximum air temperature for the current day
+	SoilMin     float64   `json:"soilMin"`     // Minimum soil temperature for the current day
+	SoilMax     float64   `json:"soilMax"`     // Maximum soil temperature for the current day
+	NoAirTemp   bool      `json:"noAirTemp"`   // The air temperature has not been read on the current day
+	NoSoilTemp  bool      `json:"noSoilTemp"`  // The soil temperature has not been read on the current day
+	LastReading time.Time `json:"lastReading"` // Time of the last reading
+}
+
+// SeasonTotals holds the running totals for the season.
+type SeasonTotals struct {
+	SeasonStart  string    `json:"seasonStart"`  // Day the season started, in the form YYYY-MM-DD
+	Days         int       `json:"days"`         // Number of completed days
+	Method       string    `json:"method"`       // Growing degree day method
+	Base         float64   `json:"base"`         // Base temperature
+	Cap          float64   `json:"cap"`          // Cap temperature
+	AirGdd       float64   `json:"airGdd"`       // Growing degree days from the air temperature, including today
+	SoilGdd      float64   `json:"soilGdd"`      // Growing degree days from the soil temperature, including today
+	TodayAirGdd  float64   `json:"todayAirGdd"`  // Growing degree days from the air temperature for today so far
+	TodaySoilGdd float64   `json:"todaySoilGdd"` // Growing degree days from the soil temperature for today so far
+	ChillHours   float64   `json:"chillHours"`   // Chill hours accumulated
+	UpdatedAt    time.Time `json:"updatedAt"`    // Time of the last reading
+}
+
+// Load reads the persisted season state from the file.
+func (s *SeasonAccumulator) Load() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.FilePath == "" {
+		return nil
+	}
+	_, err := os.Stat(s.FilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.FilePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &s.State)
+}
+
+// Add accumulates the temperatures of the measurement.
+func (s *SeasonAccumulator) Add(v Measurement) SeasonTotals {
+	t, save := s.add(v)
+	if save {
+		s.Save()
+	}
+	return t
+}
+
+// add accumulates the temperatures and returns the totals and whether the state should be saved.
+func (s *SeasonAccumulator) add(v Measurement) (SeasonTotals, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := s.Srv.Config()
+	if !v.Success {
+		return s.totals(), false
+	}
+	s.unsaved = s.unsaved + 1
+	save := s.unsaved >= stateSaveEvery
+
+	// Start a new season if the season start day has passed
+	st := SeasonStartFor(c.SeasonStart, v.DateMeasured)
+	if s.State.SeasonStart < st {
+		s.logInfo("Starting a new season from ", st, ".")
+		s.State = SeasonState{SeasonStart: st}
+		save = true
+	}
+
+	// Close off the previous day
+	day := v.DateMeasured.Format("2006-01-02")
+	if s.State.Day != day {
+		if s.State.Day != "" {
+			if !s.State.NoAirTemp {
+				s.State.AirGdd = s.State.AirGdd + DegreeDays(s.State.AirMin, s.State.AirMax, c.GddBase, c.GddCap, c.GddMethod)
+			}
+			if !s.State.NoSoilTemp {
+				s.State.SoilGdd = s.State.SoilGdd + DegreeDays(s.State.SoilMin, s.State.SoilMax, c.GddBase, c.GddCap, c.GddMethod)
+			}
+			s.State.Days = s.State.Days + 1
+			save = true
+		}
+		s.State.Day = day
+		s.State.NoAirTemp, s.State.NoSoilTemp = true, true
+	}
+
+	// A temperature that was not read does not count towards the day's range
+	if v.Has("airTemp") {
+		if s.State.NoAirTemp {
+			s.State.AirMin, s.State.AirMax = v.AirTemp, v.AirTemp
+			s.State.NoAirTemp = false
+		}
+		s.State.AirMin = math.Min(s.State.AirMin, v.AirTemp)
+		s.State.AirMax = math.Max(s.State.AirMax, v.AirTemp)
+	}
+	if v.Has("soilTemp") {
+		if s.State.NoSoilTemp {
+			s.State.SoilMin, s.State.SoilMax = v.SoilTemp, v.SoilTemp
+			s.State.NoSoilTemp = false
+		}
+		s.State.SoilMin = math.Min(s.State.SoilMin, v.SoilTemp)
+		s.State.SoilMax = math.Max(s.State.SoilMax, v.SoilTemp)
+	}
+
+	// Chill hours accumulate while the air is between freezing and the chill temperature.
+	// Gaps longer than two periods are not counted, as the temperature in the gap is not known.
+	if !s.State.LastReading.IsZero() {
+		dt := v.DateMeasured.Sub(s.State.LastReading)
+		if gap := 2 * s.Srv.sampleInterval(s.State.LastReading); dt > gap {
+			dt = 0
+		}
+		if dt > 0 && v.Has("airTemp") && v.AirTemp > 0 && v.AirTemp <= c.ChillBase {
+			s.State.ChillHours = s.State.ChillHours + dt.Hours()
+		}
+	}
+	s.State.LastReading = v.DateMeasured
+
+	t := s.totals()
+
+	s.Srv.LCD.SetItem("GDD", "GDD", fmt.Sprintf("%.1f", t.AirGdd))
+	if s.Srv.MqttClient != nil {
+		s.Srv.MqttClient.Async(func() {
+			if err := s.Srv.MqttClient.SendSeason(t); err != nil {
+				s.logError("Error sending season totals to MQTT broker.", "error", err)
+			}
+		})
+	}
+	return t, save
+}
+
+// Reset starts a new season from today.
+func (s *SeasonAccumulator) Reset() {
+	s.lock.Lock()
+	s.logInfo("Resetting the season.")
+	s.State = SeasonState{SeasonStart: time.Now().Format("2006-01-02")}
+	s.unsaved = s.unsaved + 1
+	s.lock.Unlock()
+
+	s.Save()
+}
+
+// Totals returns the running totals for the season.
+func (s *SeasonAccumulator) Totals() SeasonTotals {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.totals()
+}
+
+// totals calculates the running totals.  The lock must be held.
+func (s *SeasonAccumulator) totals() SeasonTotals {
+	c := s.Srv.Config()
+	t := SeasonTotals{
+		SeasonStart: s.State.SeasonStart,
+		Days:        s.State.Days,
+		Method:      c.GddMethod,
+		Base:        c.GddBase,
+		Cap:         c.GddCap,
+		AirGdd:      s.State.AirGdd,
+		SoilGdd:     s.State.SoilGdd,
+		ChillHours:  s.State.ChillHours,
+		UpdatedAt:   s.State.LastReading,
+	}
+	if s.State.Day != "" {
+		if !s.State.NoAirTemp {
+			t.TodayAirGdd = DegreeDays(s.State.AirMin, s.State.AirMax, c.GddBase, c.GddCap, c.GddMethod)
+		}
+		if !s.State.NoSoilTemp {
+			t.TodaySoilGdd = DegreeDays(s.State.SoilMin, s.State.SoilMax, c.GddBase, c.GddCap, c.GddMethod)
+		}
+		t.AirGdd = t.AirGdd + t.TodayAirGdd
+		t.SoilGdd = t.SoilGdd + t.TodaySoilGdd
+	}
+	return t
+}
+
+// Save writes the season state to the file, if it has changed since it was last saved.
+// The file is written without holding up the readers.
+func (s *SeasonAccumulator) Save() error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	s.lock.Lock()
+	if s.FilePath == "" || s.unsaved == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+	path := s.FilePath
+	b, err := json.Marshal(s.State)
+	n := s.unsaved
+	s.unsaved = 0
+	s.lock.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(path, b, 0644)
+	}
+	if err != nil {
+		s.logError("Error saving the season state.", "error", err)
+		// Try again with the next save
+		s.lock.Lock()
+		s.unsaved = s.unsaved + n
+		s.lock.Unlock()
+	}
+	return err
+}
+
+// DegreeDays calculates the growing degree days for a day with the
+// minimum and maximum temperatures.  Temperatures above the cap do not count.
+func DegreeDays(tmin float64, tmax float64, base float64, limit float64, method string) float64 {
+	if tmax < tmin {
+		tmin, tmax = tmax, tmin
+	}
+	if limit <= base {
+		limit = math.Inf(1)
+	}
+	if strings.ToLower(method) != GddTriangle {
+		// Modified average, with the maximum capped and the minimum raised to the base
+		hi := math.Min(tmax, limit)
+		lo := math.Min(math.Max(tmin, base), hi)
+		return math.Max(0, (hi+lo)/2-base)
+	}
+
+	// Single triangle with a horizontal cut off at the cap
+	if tmax <= base {
+		return 0
+	}
+	if tmin >= limit {
+		return limit - base
+	}
+	if tmax == tmin {
+		return math.Min(tmax, limit) - base
+	}
+	r := tmax - tmin
+	dd := 0.0
+	if tmin >= base {
+		dd = (tmax+tmin)/2 - base
+	} else {
+		dd = (tmax - base) * (tmax - base) / (2 * r)
+	}
+	if tmax > limit {
+		dd = dd - (tmax-limit)*(tmax-limit)/(2*r)
+	}
+	return dd
+}
+
+// SeasonStartFor returns the start day (YYYY-MM-DD) of the season that the time falls in.
+// The start is specified in the form MM-DD and defaults to the 1st of January.
+func SeasonStartFor(start string, t time.Time) string {
+	md, err := time.Parse("01-02", start)
+	if err != nil {
+		md, _ = time.Parse("01-02", "01-01")
+	}
+	y := t.Year()
+	st := time.Date(y, md.Month(), md.Day(), 0, 0, 0, 0, t.Location())
+	if t.Before(st) {
+		st = st.AddDate(-1, 0, 0)
+	}
+	return st.Format("2006-01-02")
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (t *SeasonTotals) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+func (s *SeasonAccumulator) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("SeasonAccumulator", LevelInfo, a)
+}
+
+func (s *SeasonAccumulator) logError(msg string, kv ...interface{}) {
+	logEntry("SeasonAccumulator", LevelError, msg, kv...)
+}
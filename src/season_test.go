@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDegreeDays(t *testing.T) {
+	for _, x := range []struct {
+		min, max float64
+		method   string
+		dd       float64
+	}{
+		{5, 25, GddAverage, 7.5},
+		{12, 34, GddAverage, 11},
+		{2, 8, GddAverage, 0},
+		{5, 25, GddTriangle, 5.625},
+		{12, 20, GddTriangle, 6},
+		{2, 8, GddTriangle, 0},
+	} {
+		if dd := DegreeDays(x.min, x.max, 10, 30, x.method); math.Abs(dd-x.dd) > 0.001 {
+			t.Errorf("%s %.0f-%.0f: expected %.2f but got %.2f", x.method, x.min, x.max, x.dd, dd)
+		}
+	}
+}
+
+func TestSeasonStartFor(t *testing.T) {
+	d := time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	if s := SeasonStartFor("09-01", d); s != "2019-09-01" {
+		t.Error("Expected 2019-09-01 but got", s)
+	}
+	if s := SeasonStartFor("03-01", d); s != "2020-03-01" {
+		t.Error("Expected 2020-03-01 but got", s)
+	}
+}
+
+// newTestSeason returns a season accumulator for hourly measurements.
+func newTestSeason() *SeasonAccumulator {
+	s := newTestServer(&Config{Period: 60, GddBase: 10, GddCap: 30, GddMethod: GddAverage, ChillBase: 7})
+	s.LCD = &Display{write: (&displayRecorder{}).write}
+	return &SeasonAccumulator{Srv: s}
+}
+
+func TestSeasonClosesOffTheDay(t *testing.T) {
+	a := newTestSeason()
+	st := time.Date(2020, 6, 1, 0, 0, 0, 0, time.Local)
+	// The soil temperature probe is missing on the first day
+	a.Add(Measurement{Success: true, DateMeasured: st, AirTemp: 5, Missing: []string{"soilTemp"}})
+	a.Add(Measurement{Success: true, DateMeasured: st.Add(12 * time.Hour), AirTemp: 25, Missing: []string{"soilTemp"}})
+	tt := a.Add(Measurement{Success: true, DateMeasured: st.Add(24 * time.Hour), AirTemp: 20, SoilTemp: 20})
+
+	if tt.Days != 1 {
+		t.Error("Expected 1 completed day but got", tt.Days)
+	}
+	if math.Abs(tt.AirGdd-a.State.AirGdd-10) > 0.001 || math.Abs(a.State.AirGdd-7.5) > 0.001 {
+		t.Error("Expected 7.5 growing degree days for the first day and 10 for today but got", a.State.AirGdd, tt.AirGdd)
+	}
+	if a.State.SoilGdd != 0 || math.Abs(tt.TodaySoilGdd-10) > 0.001 {
+		t.Error("Expected no soil growing degree days for the day without readings but got", a.State.SoilGdd, tt.TodaySoilGdd)
+	}
+}
+
+func TestSeasonMissingAirTemperature(t *testing.T) {
+	a := newTestSeason()
+	st := time.Date(2020, 6, 1, 0, 0, 0, 0, time.Local)
+	tt := a.Add(Measurement{Success: true, DateMeasured: st, SoilTemp: 20, Missing: []string{"airTemp"}})
+	if !a.State.NoAirTemp || tt.TodayAirGdd != 0 {
+		t.Error("Expected no air temperature range but got", a.State.AirMin, a.State.AirMax)
+	}
+	if math.Abs(tt.TodaySoilGdd-10) > 0.001 {
+		t.Error("Expected 10 soil growing degree days but got", tt.TodaySoilGdd)
+	}
+}
+
+func TestSeasonChillHours(t *testing.T) {
+	a := newTestSeason()
+	st := time.Date(2020, 1, 10, 0, 0, 0, 0, time.Local)
+	for h := 0; h < 4; h++ {
+		a.Add(Measurement{Success: true, DateMeasured: st.Add(time.Duration(h) * time.Hour), AirTemp: 3})
+	}
+	// A gap of three hours is not counted, nor is an hour without the air temperature
+	a.Add(Measurement{Success: true, DateMeasured: st.Add(6 * time.Hour), AirTemp: 3})
+	a.Add(Measurement{Success: true, DateMeasured: st.Add(7 * time.Hour), Missing: []string{"airTemp"}})
+	// Nor is the time below freezing or above the chill temperature
+	a.Add(Measurement{Success: true, DateMeasured: st.Add(8 * time.Hour), AirTemp: -2})
+	a.Add(Measurement{Success: true, DateMeasured: st.Add(9 * time.Hour), AirTemp: 12})
+
+	if h := a.Totals().ChillHours; math.Abs(h-3) > 0.001 {
+		t.Error("Expected 3 chill hours but got", h)
+	}
+}
+
+func TestSeasonReset(t *testing.T) {
+	a := newTestSeason()
+	a.FilePath = filepath.Join(t.TempDir(), "season.json")
+	st := time.Date(2020, 6, 1, 0, 0, 0, 0, time.Local)
+	a.Add(Measurement{Success: true, DateMeasured: st, AirTemp: 20, SoilTemp: 20})
+	a.Add(Measurement{Success: true, DateMeasured: st.Add(24 * time.Hour), AirTemp: 20, SoilTemp: 20})
+
+	a.Reset()
+	tt := a.Totals()
+	if tt.Days != 0 || tt.AirGdd != 0 || tt.SeasonStart != time.Now().Format("2006-01-02") {
+		t.Error("Expected a new season from today but got", tt)
+	}
+
+	// The reset is saved straight away
+	b := SeasonAccumulator{Srv: a.Srv, FilePath: a.FilePath}
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if b.State.SeasonStart != tt.SeasonStart || b.State.Days != 0 {
+		t.Error("Expected the reset to be saved but got", b.State)
+	}
+}
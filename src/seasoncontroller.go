@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// SeasonController handles the Web Methods for the season totals.
+type SeasonController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *SeasonController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/season/get").Name("GetSeason").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetSeason)))
+	router.Methods("POST").Path("/season/reset").Name("ResetSeason").
+		Handler(Logger(c, http.HandlerFunc(c.handleResetSeason)))
+}
+
+func (c *SeasonController) handleGetSeason(w http.ResponseWriter, r *http.Request) {
+	t := c.Srv.Season.Totals()
+	if err := t.WriteTo(w); err != nil {
+		http.Error(w, "Error serializing season totals. "+err.Error(), 500)
+	}
+}
+
+func (c *SeasonController) handleResetSeason(w http.ResponseWriter, r *http.Request) {
+	c.LogInfo("Resetting the season totals.")
+	c.Srv.Season.Reset()
+	t := c.Srv.Season.Totals()
+	t.WriteTo(w)
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *SeasonController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("SeasonController", LevelInfo, a)
+}
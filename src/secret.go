@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	secretMask      = "********************" // Value returned in place of a secret
+	secretPrefix    = "enc:"                 // Prefix of an encrypted secret in the configuration file
+	deviceKeyFile   = "device.key"           // Name of the key file, kept next to the configuration file
+	deviceKeyLength = 32                     // Length of the key (AES-256)
+)
+
+// keyLock stops two writers creating the device key at the same time.
+var keyLock sync.Mutex
+
+// Secret holds a configuration value, such as a password, that must not be disclosed.
+// A secret is write-only: it is serialized as a mask, and setting it to the mask
+// leaves it unchanged, so a configuration that has been read can be sent back as is.
+// The configuration file holds the secret encrypted with the device key.
+type Secret string
+
+// String returns the mask so that the secret is not written to the logs.
+func (s Secret) String() string {
+	return s.Redacted()
+}
+
+// GoString returns the mask so that the secret is not written to the logs.
+func (s Secret) GoString() string {
+	return s.Redacted()
+}
+
+// Redacted returns the mask if the secret is set, and an empty string if it is not.
+func (s Secret) Redacted() string {
+	if s == "" {
+		return ""
+	}
+	return secretMask
+}
+
+// MarshalJSON serializes the secret as the mask.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Redacted())
+}
+
+// UnmarshalJSON sets the secret, unless the value is the mask.
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	v := ""
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v != secretMask {
+		*s = Secret(v)
+	}
+	return nil
+}
+
+// deviceKeyPath returns the path of the key file used to encrypt the secrets in the configuration file.
+func deviceKeyPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), deviceKeyFile)
+}
+
+// loadDeviceKey reads the device key from the file, creating a new random key if the file does not exist.
+func loadDeviceKey(path string) ([]byte, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		k := make([]byte, deviceKeyLength)
+		if _, err := io.ReadFull(rand.Reader, k); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, []byte(hex.EncodeToString(k)), 0600); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(k) != deviceKeyLength {
+		return nil, errors.New("device key " + path + " is not valid")
+	}
+	return k, nil
+}
+
+// encryptSecret encrypts the secret with the key using AES-GCM.  The name of the
+// value is authenticated with it so that encrypted values cannot be swapped.
+func encryptSecret(key []byte, name string, s Secret) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	b := gcm.Seal(nonce, nonce, []byte(s), []byte(name))
+	return secretPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// decryptSecret decrypts a value written by encryptSecret.
+func decryptSecret(key []byte, name string, v string) (Secret, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, secretPrefix))
+	if err != nil {
+		return "", errors.New(name + " is not a valid encrypted value")
+	}
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < gcm.NonceSize() {
+		return "", errors.New(name + " is not a valid encrypted value")
+	}
+	p, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", errors.New(name + " could not be decrypted with the device key")
+	}
+	return Secret(p), nil
+}
+
+// isEncryptedSecret returns whether the value in the configuration file is encrypted.
+func isEncryptedSecret(v string) bool {
+	return strings.HasPrefix(v, secretPrefix)
+}
+
+// newSecretCipher returns the AES-GCM cipher for the key.
+func newSecretCipher(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretsAreRedacted(t *testing.T) {
+	c := Config{ThingspeakID: "ABCD1234", MqttPassword: "hunter2"}
+	s, err := c.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(s, "ABCD1234") || strings.Contains(s, "hunter2") {
+		t.Error("Serialized configuration contains a secret.", s)
+	}
+	if l := fmt.Sprint(c.MqttPassword, " ", c); strings.Contains(l, "hunter2") {
+		t.Error("Formatted secret was not redacted.", l)
+	}
+
+	// Sending the mask back leaves the secret unchanged
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.MqttPassword != "hunter2" || c.ThingspeakID != "ABCD1234" {
+		t.Error("Secrets were changed by the mask.")
+	}
+	if err := json.Unmarshal([]byte(`{"mqttPassword": "secret"}`), &c); err != nil || c.MqttPassword != "secret" {
+		t.Error("Secret was not updated.", err)
+	}
+}
+
+func TestSecretsAreEncryptedAtRest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "config.json")
+
+	c := Config{ThingspeakID: "ABCD1234", MqttPassword: "hunter2"}
+	if err := c.WriteToFile(p); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(p)
+	if strings.Contains(string(b), "ABCD1234") || strings.Contains(string(b), "hunter2") || strings.Contains(string(b), secretMask) {
+		t.Error("Configuration file does not hold the encrypted secrets.", string(b))
+	}
+	for _, f := range []string{p, deviceKeyPath(p)} {
+		if fi, err := os.Stat(f); err != nil || fi.Mode().Perm() != 0600 {
+			t.Error("Expected", f, "to only be readable by the owner")
+		}
+	}
+
+	n := Config{}
+	if err := n.ReadFromFile(p); err != nil {
+		t.Fatal(err)
+	}
+	if n.ThingspeakID != "ABCD1234" || n.MqttPassword != "hunter2" {
+		t.Error("Secrets were not decrypted.")
+	}
+
+	// A different device key cannot decrypt the secrets
+	ioutil.WriteFile(deviceKeyPath(p), []byte(strings.Repeat("00", deviceKeyLength)), 0600)
+	if err := (&Config{}).ReadFromFile(p); err == nil {
+		t.Error("Expected an error decrypting with the wrong key")
+	}
+}
+
+func TestPlainSecretsAreEncryptedOnRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(p, []byte(`{"period": 10, "mqttPassword": "hunter2"}`), 0666)
+
+	c := Config{}
+	if err := c.ReadFromFile(p); err != nil {
+		t.Fatal(err)
+	}
+	if c.MqttPassword != "hunter2" || c.Period != 10 {
+		t.Error("Configuration was not read.")
+	}
+	b, _ := ioutil.ReadFile(p)
+	if strings.Contains(string(b), "hunter2") {
+		t.Error("Plain text secret was not encrypted.", string(b))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SensorAttempt records a single attempt at reading a sensor.
+type SensorAttempt struct {
+	Sensor   string    `json:"sensor"`   // Name of the sensor
+	Attempt  int       `json:"attempt"`  // Attempt number, starting at 1
+	Started  time.Time `json:"started"`  // Time the attempt started
+	Duration float64   `json:"duration"` // Time (in milliseconds) the attempt took
+	Success  bool      `json:"success"`  // The sensor was read successfully
+	TimedOut bool      `json:"timedOut"` // The read did not complete within the timeout
+	Error    string    `json:"error"`    // Error returned by the attempt
+}
+
+// SensorStatus holds the state of a sensor at the last measurement.
+type SensorStatus struct {
+	Name        string    `json:"name"`        // Name of the sensor
+	Present     bool      `json:"present"`     // The sensor was found
+	Reading     bool      `json:"reading"`     // The sensor was read successfully
+	LastChecked time.Time `json:"lastChecked"` // Time the sensor was last read
+	LastSuccess time.Time `json:"lastSuccess"` // Time the sensor was last read successfully
+	Error       string    `json:"error"`       // Why the sensor could not be read
+}
+
+// transientError is a sensor error that may succeed if the read is retried.
+type transientError struct {
+	msg string
+}
+
+func (e *transientError) Error() string {
+	return e.msg
+}
+
+// newTransientError returns an error that will cause the sensor read to be retried.
+func newTransientError(msg string) error {
+	return &transientError{msg: msg}
+}
+
+// isTransient returns whether the sensor read should be retried after the error.
+// Timeouts and CRC failures on the 1-wire bus are treated as transient.
+func isTransient(err error) bool {
+	var te *transientError
+	if errors.As(err, &te) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "crc")
+}
+
+// sensorRead reads the values from a sensor.
+type sensorRead func(ctx context.Context) ([]float64, error)
+
+// readSensor calls the read function until it succeeds, retrying transient
+// errors up to the configured number of retries with an increasing backoff.
+// Each attempt is bounded by the sensor timeout and is recorded in the
+// measurement diagnostics.
+func (m *SoilMonitor) readSensor(ctx context.Context, v *Measurement, sensor string, read sensorRead) ([]float64, error) {
+	c := m.Srv.Config()
+	timeout := time.Duration(c.SensorTimeout) * time.Second
+	backoff := time.Duration(c.SensorBackoff) * time.Millisecond
+	retries := c.SensorRetries
+	if retries < 0 {
+		retries = 0
+	}
+
+	var err error
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			logEntry("SoilMonitor", LevelWarning, "Retrying sensor.", "sensor", sensor, "attempt", i+1, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff = backoff * 2
+		}
+
+		a := SensorAttempt{
+			Sensor:  sensor,
+			Attempt: i + 1,
+			Started: time.Now(),
+		}
+		var vals []float64
+		vals, err = callWithTimeout(ctx, timeout, read)
+		a.Duration = float64(time.Since(a.Started)) / float64(time.Millisecond)
+		if err == nil {
+			a.Success = true
+			v.Diagnostics = append(v.Diagnostics, a)
+			return vals, nil
+		}
+		a.Error = err.Error()
+		a.TimedOut = errors.Is(err, context.DeadlineExceeded)
+		v.Diagnostics = append(v.Diagnostics, a)
+
+		// A failure that is retried is only a warning
+		retry := i < retries && ctx.Err() == nil && isTransient(err)
+		level := LevelError
+		if retry {
+			level = LevelWarning
+		}
+		logEntry("SoilMonitor", level, "Reading sensor failed.", "sensor", sensor, "attempt", a.Attempt, "error", err)
+		if !retry {
+			break
+		}
+	}
+	return nil, err
+}
+
+// callWithTimeout calls the function, giving up when the timeout expires.
+// Reads from the 1-wire bus cannot be interrupted, so the function is called
+// on its own goroutine and is abandoned if it does not return in time.
+func callWithTimeout(ctx context.Context, timeout time.Duration, f sensorRead) ([]float64, error) {
+	if timeout <= 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		vals []float64
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		vals, err := f(ctx)
+		done <- result{vals: vals, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.vals, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("timed out after %v: %w", timeout, ctx.Err())
+		}
+		return nil, ctx.Err()
+	}
+}
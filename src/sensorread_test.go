@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+func TestReadSensorRetriesTransientErrors(t *testing.T) {
+	m := &newTestServer(&Config{SensorTimeout: 1, SensorRetries: 2, SensorBackoff: 1}).Monitor
+	b := &LogBuffer{Next: service.ConsoleLogger}
+	logger = b
+	defer func() { logger = service.ConsoleLogger }()
+	v := Measurement{}
+	n := 0
+	vals, err := m.readSensor(context.Background(), &v, "airTemp", func(ctx context.Context) ([]float64, error) {
+		n++
+		if n < 3 {
+			return nil, newTransientError("sensor returned an invalid reading")
+		}
+		return []float64{21.5}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vals[0] != 21.5 {
+		t.Error("Expected 21.5 but got", vals[0])
+	}
+	if len(v.Diagnostics) != 3 || v.Diagnostics[0].Success || !v.Diagnostics[2].Success {
+		t.Error("Expected 2 failed attempts and 1 successful attempt but got", v.Diagnostics)
+	}
+
+	// The retries are warnings, with the error as a field
+	l := b.Query(LogQuery{Level: LevelWarning, Components: []string{"SoilMonitor"}})
+	if len(l) != 4 || l[0].Level != LevelWarning || l[0].Fields["error"] != "sensor returned an invalid reading" {
+		t.Error("Expected 4 warnings but got", l)
+	}
+}
+
+func TestReadSensorDoesNotRetryPermanentErrors(t *testing.T) {
+	m := &newTestServer(&Config{SensorTimeout: 1, SensorRetries: 2, SensorBackoff: 1}).Monitor
+	v := Measurement{}
+	_, err := m.readSensor(context.Background(), &v, "soilTemp", func(ctx context.Context) ([]float64, error) {
+		return nil, errors.New("no such device")
+	})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if len(v.Diagnostics) != 1 {
+		t.Error("Expected 1 attempt but got", len(v.Diagnostics))
+	}
+}
+
+func TestReadSensorTimesOut(t *testing.T) {
+	m := &newTestServer(&Config{SensorTimeout: 1, SensorRetries: -1, SensorBackoff: 1}).Monitor
+	v := Measurement{}
+	hang := make(chan struct{})
+	defer close(hang)
+	start := time.Now()
+	_, err := m.readSensor(context.Background(), &v, "mcp3008", func(ctx context.Context) ([]float64, error) {
+		<-hang
+		return nil, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected a timeout but got", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Read was not bounded by the timeout")
+	}
+	if len(v.Diagnostics) != 1 || !v.Diagnostics[0].TimedOut {
+		t.Error("Expected a timed out attempt but got", v.Diagnostics)
+	}
+}
+
+func TestCrcErrorsAreTransient(t *testing.T) {
+	if !isTransient(errors.New("CRC check failed")) {
+		t.Error("CRC failures should be retried")
+	}
+}
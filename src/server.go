@@ -1,37 +1,67 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	gopifinder "github.com/brumawen/gopi-finder/src"
 	gopitools "github.com/brumawen/gopi-tools/src"
 	"github.com/gorilla/mux"
 	"github.com/kardianos/service"
-	"github.com/onatm/clockwerk"
 )
 
 // Server defines the Web Server.
 type Server struct {
-	PortNo         int                  // Port No the server will listen on
-	VerboseLogging bool                 // Verbose logging on/ off
-	Timeout        int                  // Timeout waiting for a response from an IP probe.  Defaults to 2 seconds.
-	Config         *Config              // Configuration settings
-	Finder         gopifinder.Finder    // Finder client - used to find other devices
-	Monitor        SoilMonitor          // Soil monitor module
-	MqttClient     *Mqtt                // MQTT client
-	LCD            *Display             // LCD display
-	Led            gopitools.Led        // LED module
-	exit           chan struct{}        // Exit flag
-	shutdown       chan struct{}        // Shutdown complete flag
-	http           *http.Server         // HTTP server
-	router         *mux.Router          // HTTP router
-	cw             *clockwerk.Clockwerk // Clockwerk scheduler
-	isregistering  bool                 // Indicates that a registration is currently ongoing
+	PortNo          int                // Port No the server will listen on
+	Timeout         int                // Timeout waiting for a response from an IP probe.  Defaults to 2 seconds.
+	ShutdownTimeout int                // Time (in seconds) allowed for the service to shut down.  Defaults to 15 seconds.
+	EnableTLS       bool               // Serve HTTPS instead of HTTP
+	CertFile        string             // TLS certificate file.  A self-signed certificate is generated if empty.
+	KeyFile         string             // TLS key file
+	RedirectPort    int                // Port No of the listener that redirects HTTP to HTTPS.  0 for none.
+	config          *Config            // Configuration settings.  Replaced, never changed, once the service is running.
+	Finder          gopifinder.Finder  // Finder client - used to find other devices
+	Monitor         SoilMonitor        // Soil monitor module
+	MqttClient      *Mqtt              // MQTT client
+	Alerts          *AlertManager      // Alert rules engine
+	Irrigation      *Irrigator         // Irrigation valve controller
+	Frost           *FrostPredictor    // Frost predictor
+	Season          *SeasonAccumulator // Growing degree days and chill hours
+	Drying          *DryingModel       // Soil drying rate model
+	Light           *LightIntegrator   // Daily light integral and photoperiod
+	Applier         *ConfigApplier     // Applies configuration changes to the running service
+	Watcher         *ConfigWatcher     // Watches the configuration file for external edits
+	Auth            *AuthManager       // Authenticates the web requests
+	Events          *EventHub          // Live stream of events
+	Logs            *LogBuffer         // Most recent log records.  nil if they are not kept.
+	LCD             *Display           // LCD display
+	Led             gopitools.Led      // LED module
+	exit            chan struct{}      // Exit flag
+	startup         chan struct{}      // Closed when the startup steps have finished
+	shutdown        chan struct{}      // Shutdown complete flag
+	http            *http.Server       // HTTP server
+	redirect        *http.Server       // HTTP to HTTPS redirect server
+	router          *mux.Router        // HTTP router
+	registration    RegistrationStatus // State of the registration with the Finder
+	started         time.Time          // Time the service started
+	scheduler       *Scheduler         // Measurement scheduler
+	lock            sync.Mutex         // Guards the registration state and the scheduler
+	configLock      sync.RWMutex       // Guards the configuration pointer
+}
+
+// RegistrationStatus holds the state of the registration of the service with the devices on the network.
+type RegistrationStatus struct {
+	Registering    bool      `json:"registering"`    // A registration is in progress
+	Registered     bool      `json:"registered"`     // The service has been registered
+	LastRegistered time.Time `json:"lastRegistered"` // Time the service was last registered
+	Error          string    `json:"error"`          // Error from the last registration attempt
 }
 
 // Start is called when the service is starting
@@ -41,17 +71,17 @@ func (s *Server) Start(v service.Service) error {
 	// Make sure the working directory is the same as the application exe
 	ap, err := os.Executable()
 	if err != nil {
-		s.logError("Error getting the executable path.", err.Error())
+		s.logError("Error getting the executable path.", "error", err)
 	} else {
 		wd, err := os.Getwd()
 		if err != nil {
-			s.logError("Error getting current working directory.", err.Error())
+			s.logError("Error getting current working directory.", "error", err)
 		} else {
 			ad := filepath.Dir(ap)
 			s.logInfo("Current application path is", ad)
 			if ad != wd {
 				if err := os.Chdir(ad); err != nil {
-					s.logError("Error chaning working directory.", err.Error())
+					s.logError("Error chaning working directory.", "error", err)
 				}
 			}
 		}
@@ -79,24 +109,78 @@ func (s *Server) run() {
 	if s.PortNo < 0 {
 		s.PortNo = 20510
 	}
+	s.started = time.Now()
 	s.Monitor.Srv = s
 	s.Finder.Logger = logger
 	s.Finder.VerboseLogging = service.Interactive()
 
 	// Get the configuration
-	if s.Config == nil {
-		s.Config = &Config{}
+	c := &Config{}
+	c.ReadFromFile("config.json")
+	s.setConfig(c)
+	s.Events = &EventHub{Srv: s, nextID: eventEpoch(time.Now())}
+	s.Applier = &ConfigApplier{Srv: s}
+	s.Watcher = &ConfigWatcher{Srv: s, FilePath: "config.json"}
+
+	// Load the measurement history
+	s.Monitor.HistoryPath = "measurements.json"
+	if err := s.Monitor.Load(); err != nil {
+		s.logError("Error loading the measurement history.", "error", err)
+	}
+
+	// Load the alert state
+	s.Alerts = &AlertManager{Srv: s, FilePath: "alerts.json"}
+	if err := s.Alerts.Load(); err != nil {
+		s.logError("Error loading the alert state.", "error", err)
+	}
+
+	s.Frost = &FrostPredictor{Srv: s}
+	s.Drying = &DryingModel{Srv: s}
+
+	// Load the season totals
+	s.Season = &SeasonAccumulator{Srv: s, FilePath: "season.json"}
+	if err := s.Season.Load(); err != nil {
+		s.logError("Error loading the season totals.", "error", err)
+	}
+
+	// Load the light totals
+	s.Light = &LightIntegrator{Srv: s, FilePath: "light.json"}
+	if err := s.Light.Load(); err != nil {
+		s.logError("Error loading the light totals.", "error", err)
+	}
+
+	// Load the watering history and make sure the irrigation valve is closed
+	s.Irrigation = &Irrigator{Srv: s, HistoryPath: "irrigation.json"}
+	s.Irrigation.Initialize()
+
+	// Load the API tokens and users
+	s.Auth = &AuthManager{FilePath: "auth.json"}
+	if err := s.Auth.Load(); err != nil {
+		s.logError("Error loading the API tokens and users.", "error", err)
 	}
-	s.Config.ReadFromFile("config.json")
 
 	// Create a router
 	s.router = mux.NewRouter().StrictSlash(true)
-	s.router.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.Dir("./html/assets"))))
+	s.router.Use(s.Auth.Middleware)
+	s.router.PathPrefix("/assets/").Name("Assets").Handler(http.StripPrefix("/assets/", http.FileServer(http.Dir("./html/assets"))))
 
 	// Add the controllers
+	s.addController(new(AuthController))
 	s.addController(new(MeasureController))
 	s.addController(new(LogController))
 	s.addController(new(ConfigController))
+	s.addController(new(ConfigAPIController))
+	s.addController(new(AlertController))
+	s.addController(new(IrrigationController))
+	s.addController(new(ForecastController))
+	s.addController(new(SeasonController))
+	s.addController(new(ProfileController))
+	s.addController(new(LightController))
+	s.addController(new(ScheduleController))
+	s.addController(new(DisplayController))
+	s.addController(new(HealthController))
+	s.addController(new(StreamController))
+	s.addController(new(DashboardController))
 
 	// Create an HTTP server
 	s.http = &http.Server{
@@ -107,7 +191,7 @@ func (s *Server) run() {
 	// Set the LED
 	s.Led = gopitools.Led{GpioLed: 18}
 	if err := s.Led.On(); err != nil {
-		s.logError("Failed to switch on the LED.", err.Error())
+		s.logError("Failed to switch on the LED.", "error", err)
 	}
 
 	// Set the display
@@ -117,6 +201,9 @@ func (s *Server) run() {
 	s.LCD.SetItem("SOILTEMP", "SoilTemp", "")
 	s.LCD.SetItem("LIGHT", "Light", "")
 	s.LCD.SetItem("MOISTURE", "Moisture", "")
+	s.LCD.SetItem("STATUS", s.Config().Profile, "")
+	s.LCD.SetItem("GDD", "GDD", "")
+	s.LCD.SetItem("DRY", "Dry in", "")
 	s.LCD.Start()
 
 	if s.MqttClient == nil {
@@ -124,58 +211,308 @@ func (s *Server) run() {
 		s.MqttClient.Srv = s
 	}
 
-	go func() {
-		// Register service with the Finder server
-		go s.RegisterService()
+	// Register service with the Finder server
+	go s.RegisterService()
 
-		s.MqttClient.Initialize()
+	s.startup = make(chan struct{})
+	go s.startServices()
 
-		// Read the values immedietely
-		s.Monitor.Run()
+	// Start the web server
+	if s.EnableTLS {
+		s.startTLS()
+	} else {
+		go func() {
+			s.logInfo("Server listening on port", s.PortNo)
+			if err := s.http.ListenAndServe(); err != nil {
+				msg := err.Error()
+				if !strings.Contains(msg, "http: Server closed") {
+					s.logError("Error starting Web Server.", "error", err)
+				}
+			}
+		}()
+	}
 
-		// Start the scheduler
-		s.StartSchedule()
-	}()
+	// Wait for an exit signal
+	_ = <-s.exit
+
+	s.shutdownServices()
+
+	s.logDebug("Shutdown complete")
+	close(s.shutdown)
+}
+
+// startServices connects to the MQTT broker, takes the first measurement and
+// starts the schedule and the configuration watcher.  The service can be
+// stopped while a step is blocked, so each step checks first, rather than
+// starting something that has already been shut down.
+func (s *Server) startServices() {
+	defer close(s.startup)
+
+	if s.stopping() {
+		return
+	}
+	s.MqttClient.Initialize()
+
+	// Read the values immedietely
+	if s.stopping() {
+		return
+	}
+	s.Monitor.Run()
+
+	// Start the scheduler
+	if s.stopping() {
+		return
+	}
+	s.StartSchedule()
+
+	// Watch for changes to the configuration file
+	if s.stopping() {
+		return
+	}
+	s.Watcher.Start()
+}
+
+// startTLS starts the web server with HTTPS, and the listener that redirects
+// HTTP to HTTPS if there is one.  The web server is not started if the
+// certificate cannot be loaded, so that passwords are never sent in clear text.
+func (s *Server) startTLS() {
+	c, err := s.loadCertificate()
+	if err != nil {
+		s.logError("Error loading the TLS certificate. The web server has not been started.", "error", err)
+		s.LCD.SetItem("CERT", "TLS", "failed")
+		return
+	}
+	fp := CertFingerprint(c)
+	s.logInfo("TLS certificate SHA-256 fingerprint is", fp)
+	s.LCD.SetItem("CERT", fp[0:8], fp[8:16])
+	s.http.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{c},
+		MinVersion:   tls.VersionTLS12,
+	}
 
-	// Start the web server
 	go func() {
-		s.logInfo("Server listening on port", s.PortNo)
-		if err := s.http.ListenAndServe(); err != nil {
+		s.logInfo("Server listening for HTTPS on port", s.PortNo)
+		if err := s.http.ListenAndServeTLS("", ""); err != nil {
 			msg := err.Error()
 			if !strings.Contains(msg, "http: Server closed") {
-				s.logError("Error starting Web Server.", err.Error())
+				s.logError("Error starting Web Server.", "error", err)
 			}
 		}
 	}()
 
-	// Wait for an exit signal
-	_ = <-s.exit
+	if s.RedirectPort > 0 {
+		s.redirect = &http.Server{
+			Addr:    fmt.Sprintf(":%d", s.RedirectPort),
+			Handler: RedirectToHTTPS(s.PortNo),
+		}
+		go func() {
+			s.logInfo("Redirecting HTTP on port", s.RedirectPort, "to HTTPS")
+			if err := s.redirect.ListenAndServe(); err != nil {
+				msg := err.Error()
+				if !strings.Contains(msg, "http: Server closed") {
+					s.logError("Error starting the HTTP redirect listener.", "error", err)
+				}
+			}
+		}()
+	}
+}
 
-	// Turn off the LED
-	if err := s.Led.Off(); err != nil {
-		s.logError("Failed to turn off the LED.", err.Error())
+// shutdownServices stops the subsystems in order.  Steps that are still
+// running when the shutdown deadline is reached are abandoned.
+func (s *Server) shutdownServices() {
+	if s.ShutdownTimeout <= 0 {
+		s.ShutdownTimeout = 15
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	if s.startup != nil {
+		s.shutdownStep("Waiting for the startup", func() error {
+			// The first measurement may be holding up the startup, so cancel it
+			// if the startup has not finished in a third of the time.
+			wctx, wcancel := context.WithTimeout(ctx, time.Duration(s.ShutdownTimeout)*time.Second/3)
+			defer wcancel()
+			select {
+			case <-s.startup:
+				return nil
+			case <-wctx.Done():
+			}
+			s.logInfo("Startup did not finish. Cancelling the first measurement.")
+			s.Monitor.Close()
+			select {
+			case <-s.startup:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+
+	s.shutdownStep("Stopping the schedule", func() error {
+		s.Watcher.Stop()
+		if sc := s.Scheduler(); sc != nil {
+			sc.Stop()
+		}
+		return nil
+	})
+
+	s.shutdownStep("Draining the HTTP connections", func() error {
+		// Stop accepting requests first, so nothing can start watering or a
+		// measurement while the valve and sensors are being shut down.
+		// End the live streams, which would otherwise hold the server open.
+		s.Events.Close()
+		if s.redirect != nil {
+			s.redirect.Close()
+		}
+		hctx, hcancel := context.WithTimeout(ctx, time.Duration(s.ShutdownTimeout)*time.Second/3)
+		defer hcancel()
+		err := s.http.Shutdown(hctx)
+		if err != nil {
+			s.http.Close()
+		}
+		return err
+	})
+
+	s.shutdownStep("Waiting for the measurement run", func() error {
+		// Give the run a third of the time to finish, then cancel it so the sensor power is switched off
+		wctx, wcancel := context.WithTimeout(ctx, time.Duration(s.ShutdownTimeout)*time.Second/3)
+		defer wcancel()
+		err := s.waitForMeasurement(wctx)
+		s.Monitor.Close()
+		if err != nil {
+			s.logInfo("Measurement run did not finish. Cancelling it.")
+			return s.waitForMeasurement(ctx)
+		}
+		return nil
+	})
 
-	// Shutdown the HTTP server
-	s.http.Shutdown(nil)
+	s.shutdownStep("Saving the measurement history", func() error {
+		return s.Monitor.SaveHistory()
+	})
 
-	s.LCD.Stop()
+	if s.Season != nil {
+		s.shutdownStep("Saving the season totals", func() error {
+			return s.Season.Save()
+		})
+	}
+	if s.Light != nil {
+		s.shutdownStep("Saving the light totals", func() error {
+			return s.Light.Save()
+		})
+	}
 
-	s.logDebug("Shutdown complete")
-	close(s.shutdown)
+	s.shutdownStep("Closing the irrigation valve", func() error {
+		s.Irrigation.Close()
+		return nil
+	})
+
+	if s.MqttClient != nil {
+		s.shutdownStep("Flushing the MQTT publishes", func() error {
+			return s.MqttClient.Flush(ctx)
+		})
+		s.shutdownStep("Disconnecting from the MQTT broker", func() error {
+			err := s.MqttClient.SendOffline(ctx)
+			s.MqttClient.Close()
+			return err
+		})
+	}
+
+	s.shutdownStep("Blanking the display", func() error {
+		s.LCD.Stop()
+		return s.Led.Off()
+	})
 }
 
-// StartSchedule will start up the schedule for measuring the values
+// waitForMeasurement waits for the scheduled run and for any measurement
+// started at startup or from the web to finish.
+func (s *Server) waitForMeasurement(ctx context.Context) error {
+	if sc := s.Scheduler(); sc != nil {
+		if err := sc.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return s.Monitor.Wait(ctx)
+}
+
+// stopping returns whether the service has been told to stop.
+func (s *Server) stopping() bool {
+	if s.exit == nil {
+		return false
+	}
+	select {
+	case <-s.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownStep runs the shutdown step and logs how long it took.
+func (s *Server) shutdownStep(name string, f func() error) {
+	st := time.Now()
+	err := f()
+	d := time.Since(st).Round(time.Millisecond)
+	if err != nil {
+		s.logError(name+" failed.", "took", d, "error", err)
+		return
+	}
+	s.logInfo(name, " took ", d, ".")
+}
+
+// Config returns the running configuration.  A change replaces the configuration
+// rather than changing it, so take it once and use it for the whole operation.
+func (s *Server) Config() *Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return s.config
+}
+
+// setConfig replaces the running configuration.
+func (s *Server) setConfig(c *Config) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	s.config = c
+}
+
+// StartSchedule will start up the schedule for measuring the values.
+// The quiet state is carried over, so that the new scheduler only switches the
+// display and LED if the quiet hours have changed.
 func (s *Server) StartSchedule() {
-	if s.Config.Period <= 0 {
-		s.Config.Period = 5
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sc := &Scheduler{Srv: s, Job: s.Monitor.Run}
+	if s.scheduler != nil {
+		s.scheduler.Stop()
+		sc.IsQuiet = s.scheduler.Status(0).IsQuiet
+	}
+	s.scheduler = sc
+	s.scheduler.Start()
+}
+
+// Scheduler returns the measurement scheduler.  nil if it has not been started.
+func (s *Server) Scheduler() *Scheduler {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.scheduler
+}
+
+// sampleInterval returns the time expected between the measurement taken at
+// the time and the next one, taken from the schedule.
+func (s *Server) sampleInterval(after time.Time) time.Duration {
+	if sc := s.Scheduler(); sc != nil {
+		if n, err := sc.Next(after); err == nil {
+			return n.Sub(after)
+		}
 	}
-	if s.cw != nil {
-		s.cw.Stop()
+	p := s.Config().Period
+	if p <= 0 {
+		p = 5
 	}
-	s.cw = clockwerk.New()
-	s.cw.Every(time.Duration(s.Config.Period) * time.Minute).Do(&s.Monitor)
-	s.cw.Start()
+	return time.Duration(p) * time.Minute
 }
 
 // AddController adds the specified web service controller to the Router
@@ -185,17 +522,22 @@ func (s *Server) addController(c Controller) {
 
 // RegisterService will register the service with the devices on the network
 func (s *Server) RegisterService() {
-	if s.isregistering {
+	s.lock.Lock()
+	if s.registration.Registering {
+		s.lock.Unlock()
 		return
 	}
-	s.isregistering = true
+	s.registration.Registering = true
+	s.lock.Unlock()
+
 	isReg := false
 	s.logDebug("Starting service registration.")
 	for !isReg {
 		s.logDebug("RegisterService: Getting device info")
 		d, err := gopifinder.NewDeviceInfo()
 		if err != nil {
-			s.logError("Error getting device info.", err.Error())
+			s.logError("Error getting device info.", "error", err)
+			s.setRegistrationError(err)
 		}
 		s.logDebug("RegisterService: Creating service")
 		sv := d.CreateService("SoilMonitor")
@@ -215,7 +557,8 @@ func (s *Server) RegisterService() {
 		s.logDebug("Reg: Finding devices")
 		_, err = s.Finder.FindDevices()
 		if err != nil {
-			s.logError("RegisterService: Error getting list of devices.", err.Error())
+			s.logError("RegisterService: Error getting list of devices.", "error", err)
+			s.setRegistrationError(err)
 		} else {
 			if len(s.Finder.Devices) == 0 {
 				s.logDebug("RegisterService: Sleeping")
@@ -229,25 +572,40 @@ func (s *Server) RegisterService() {
 		}
 	}
 	s.logDebug("Completed service registration.")
-	s.isregistering = false
+	s.lock.Lock()
+	s.registration = RegistrationStatus{Registered: true, LastRegistered: time.Now()}
+	s.lock.Unlock()
+}
+
+// Registration returns the state of the registration with the devices on the network.
+func (s *Server) Registration() RegistrationStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.registration
+}
+
+// setRegistrationError records the error from the registration attempt.
+func (s *Server) setRegistrationError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.registration.Error = err.Error()
 }
 
 // logDebug logs a debug message to the logger
 func (s *Server) logDebug(v ...interface{}) {
-	if s.VerboseLogging {
-		a := fmt.Sprint(v...)
-		logger.Info("Server: ", a)
-	}
+	a := fmt.Sprint(v...)
+	logEntry("Server", LevelDebug, a)
 }
 
 // logInfo logs an information message to the logger
 func (s *Server) logInfo(v ...interface{}) {
 	a := fmt.Sprint(v...)
-	logger.Info("Server: ", a)
+	logEntry("Server", LevelInfo, a)
 }
 
 // logError logs an error message to the logger
-func (s *Server) logError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Error("Server: ", a)
+func (s *Server) logError(msg string, kv ...interface{}) {
+	logEntry("Server", LevelError, msg, kv...)
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kardianos/service"
+)
+
+func TestMain(m *testing.M) {
+	logger = service.ConsoleLogger
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server with the configuration, and the parts that the
+// controllers and the monitor use, without touching the hardware or any files.
+func newTestServer(c *Config) *Server {
+	c.setDefaults()
+	s := &Server{config: c}
+	s.Monitor.Srv = s
+	s.Events = &EventHub{Srv: s}
+	s.Applier = &ConfigApplier{Srv: s}
+	return s
+}
+
+// changeTestConfig replaces the configuration of the test server with a changed
+// copy, as the running configuration is never changed in place.
+func changeTestConfig(s *Server, f func(c *Config)) {
+	c := s.Config().Clone()
+	f(&c)
+	s.setConfig(&c)
+}
+
+func TestStartServicesStopsWhenShuttingDown(t *testing.T) {
+	s := newTestServer(&Config{})
+	s.exit = make(chan struct{})
+	s.startup = make(chan struct{})
+	close(s.exit)
+
+	// Nothing is started, so nothing is left running after the shutdown
+	s.startServices()
+	select {
+	case <-s.startup:
+	default:
+		t.Error("Startup was not marked as finished")
+	}
+	if s.Scheduler() != nil {
+		t.Error("Scheduler was started after the service was stopped")
+	}
+}
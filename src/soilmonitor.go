@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	gopitools "github.com/brumawen/gopi-tools/src"
@@ -14,16 +17,50 @@ import (
 
 // SoilMonitor manages the monitoring of the soil measurement components
 // and provides the latest readings.
+// Callers that ask for a measurement while one is being taken share its result,
+// so that the probes are only powered up once.
 type SoilMonitor struct {
-	Srv             *Server       // Server instance
-	LastRead        time.Time     // Last time the measurement was taken
-	Measurements    []Measurement // Last 10 measurements
-	LastMeasurement Measurement   // Last successful measurement
-	IsRunning       bool          // Is the monitor running
+	Srv             *Server                                        // Server instance
+	LastRead        time.Time                                      // Last time the measurement was taken
+	Measurements    []Measurement                                  // Last 12 measurements
+	LastMeasurement Measurement                                    // Last successful measurement
+	HistoryPath     string                                         // Path of the file used to persist the measurement history
+	history         MeasurementHistory                             // Measurements charted over time
+	acquire         func(ctx context.Context) (Measurement, error) // Reads the probes.  Defaults to readProbes.
+	flight          *measureFlight                                 // The measurement currently being taken
+	unsaved         int                                            // Measurements added to the history since it was saved
+	sensors         map[string]*SensorStatus                       // State of each sensor at the last measurement
+	thingspeak      ThingspeakStatus                               // Result of the last send to Thingspeak
+	ctx             context.Context                                // Cancelled when the monitor is closed
+	cancel          context.CancelFunc                             // Cancels the monitor context
+	lock            sync.Mutex                                     // Guards the monitor state
+	saveLock        sync.Mutex                                     // Makes sure the history is saved one save at a time
+	thingspeakLock  sync.Mutex                                     // Makes sure one update or connection test is sent to Thingspeak at a time
+	thingspeakLast  time.Time                                      // Time of the last update or connection test sent to Thingspeak.  Guarded by thingspeakLock.
 }
 
-// Run is called from the scheduler (ClockWerk). This function will get the latest measurements
-// and send the measurements to Thingspeak
+// historySaveEvery is the number of measurements between saves of the history.
+// The history is also saved on shutdown, so the SD card is not written on every run.
+const historySaveEvery = 12
+
+// ThingspeakStatus holds the result of the last send to Thingspeak.
+type ThingspeakStatus struct {
+	Enabled     bool      `json:"enabled"`     // Thingspeak is enabled
+	LastAttempt time.Time `json:"lastAttempt"` // Last time a send was attempted
+	LastSuccess time.Time `json:"lastSuccess"` // Last time a send succeeded
+	Error       string    `json:"error"`       // Error returned by the last send
+}
+
+// measureFlight holds a measurement that is being taken, shared by all the callers waiting for it.
+type measureFlight struct {
+	done chan struct{} // Closed when the measurement has been taken
+	v    Measurement   // The measurement
+	err  error         // Error taking the measurement
+}
+
+// Run is called from the scheduler. This function will get the latest measurements
+// and send the measurements to Thingspeak and MQTT, evaluate the alert rules and
+// control the irrigation.
 // It will also keep the last 12 measurements in a list.
 func (m *SoilMonitor) Run() {
 	// Rerun a registration
@@ -31,58 +68,296 @@ func (m *SoilMonitor) Run() {
 
 	m.logDebug("Starting measurement run.")
 	// Get the current measurements
-	v, err := m.MeasureValues()
+	v, err := m.MeasureValues(m.context())
 	if err != nil {
-		m.Measurements = append(m.Measurements, Measurement{
+		f := Measurement{
 			Success:      false,
 			Error:        err.Error(),
 			DateMeasured: time.Now(),
-		})
+		}
+		m.addMeasurement(f)
+		m.Srv.Events.Publish(EventMeasurement, f)
 	} else {
+		c := m.Srv.Config()
+
 		// Thingspeak
-		if m.Srv.Config.EnableThingspeak {
+		if c.EnableThingspeak {
 			// Send the measurement to Thingspeak
 			m.logDebug("Sending result to Thingspeak.")
-			err = m.sendToThingspeak(v)
+			err = m.sendThingspeakUpdate(m.context(), v)
+			m.setThingspeak(err)
 			if err != nil {
-				m.logError("Error sending result to Thingspeak. " + err.Error())
+				m.logError("Error sending result to Thingspeak.", "error", err)
 				v.Error = err.Error()
 			}
 		}
 		// MQTT
-		if m.Srv.Config.EnableMqtt {
+		if c.EnableMqtt {
 			// Send the measurement to MQTT broker
 			m.logDebug("Sending result to MQTT.")
 			err := m.Srv.MqttClient.SendTelemetry(v)
 			if err != nil {
-				m.logError("Error sending result to MQTT broker. " + err.Error())
+				m.logError("Error sending result to MQTT broker.", "error", err)
 				v.Error = err.Error()
 			}
 		}
 
+		// Evaluate the alert rules and forecasts
+		m.Srv.Alerts.Evaluate(v)
+		m.Srv.Frost.Evaluate(v)
+		m.Srv.Drying.Evaluate(v)
+
+		// Accumulate the growing degree days, chill hours and daily light
+		m.Srv.Season.Add(v)
+		m.Srv.Light.Add(v)
+
 		// Append the measurement to the list
-		m.Measurements = append(m.Measurements, v)
+		m.addMeasurement(v)
+		m.Srv.Events.Publish(EventMeasurement, v)
+	}
+
+	// Decide whether the soil needs watering
+	m.Srv.Irrigation.Evaluate(v)
+
+	logEntry("SoilMonitor", LevelDebug, "Completed measurement run.", "success", v.Success,
+		"moisture", v.Moisture, "soilTemp", v.SoilTemp, "airTemp", v.AirTemp, "light", v.Light)
+}
+
+// MeasureValues will measure the values from the component probes.
+// If a measurement is already being taken, the caller waits for it and shares
+// its result.  Cancelling the context stops the caller waiting, but the
+// measurement carries on for the other callers.
+func (m *SoilMonitor) MeasureValues(ctx context.Context) (Measurement, error) {
+	m.lock.Lock()
+	f := m.flight
+	if f == nil {
+		f = &measureFlight{done: make(chan struct{})}
+		m.flight = f
+		go m.take(f)
+	}
+	m.lock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.v, f.err
+	case <-ctx.Done():
+		return Measurement{}, ctx.Err()
+	}
+}
+
+// IsRunning returns whether a measurement is being taken.
+func (m *SoilMonitor) IsRunning() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.flight != nil
+}
+
+// Wait waits until no measurement is being taken, or for the context to expire.
+// It covers every run, whether started by the schedule, at startup or from the web.
+func (m *SoilMonitor) Wait(ctx context.Context) error {
+	for {
+		m.lock.Lock()
+		f := m.flight
+		m.lock.Unlock()
+		if f == nil {
+			return nil
+		}
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Readings returns a copy of the last measurements.
+func (m *SoilMonitor) Readings() []Measurement {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]Measurement{}, m.Measurements...)
+}
+
+// History returns the measurements taken since the specified time.
+func (m *SoilMonitor) History(since time.Time) []Measurement {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.history.Since(since)
+}
+
+// Load loads the measurement history from the file.
+func (m *SoilMonitor) Load() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.HistoryPath == "" {
+		return nil
+	}
+	return m.history.ReadFromFile(m.HistoryPath)
+}
+
+// Last returns the time of the last measurement and the last successful measurement.
+func (m *SoilMonitor) Last() (time.Time, Measurement) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.LastRead, m.LastMeasurement
+}
+
+// Sensors returns the state of each sensor at the last measurement, in name order.
+func (m *SoilMonitor) Sensors() []SensorStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	l := []SensorStatus{}
+	for _, st := range m.sensors {
+		l = append(l, *st)
 	}
-	// Only keep the last 12 measurements
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return l
+}
+
+// Thingspeak returns the result of the last send to Thingspeak.
+func (m *SoilMonitor) Thingspeak() ThingspeakStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	st := m.thingspeak
+	st.Enabled = m.Srv.Config().EnableThingspeak
+	return st
+}
+
+// Close cancels the measurement being taken and any callers waiting for it.
+func (m *SoilMonitor) Close() {
+	m.context()
+	m.cancel()
+}
+
+// take takes the measurement and releases the callers waiting for it.
+func (m *SoilMonitor) take(f *measureFlight) {
+	defer func() {
+		m.lock.Lock()
+		m.flight = nil
+		m.lock.Unlock()
+		close(f.done)
+	}()
+
+	acq := m.acquire
+	if acq == nil {
+		acq = m.readProbes
+	}
+	f.v, f.err = acq(m.context())
+}
+
+// addMeasurement appends the measurement to the list, keeping the last 12 measurements.
+func (m *SoilMonitor) addMeasurement(v Measurement) {
+	m.lock.Lock()
+	m.LastRead = v.DateMeasured
+	if v.Success {
+		m.LastMeasurement = v
+	}
+	m.Measurements = append(m.Measurements, v)
 	if len(m.Measurements) > 12 {
 		// Remove the first item
 		m.Measurements = m.Measurements[1:]
 	}
-	m.logDebug("Completed measurement run.")
+
+	m.history.Add(v)
+	m.unsaved = m.unsaved + 1
+	save := m.unsaved >= historySaveEvery
+	m.lock.Unlock()
+
+	if save {
+		m.SaveHistory()
+	}
 }
 
-// MeasureValues will measure the values from the component probes.
-func (m *SoilMonitor) MeasureValues() (Measurement, error) {
-	if m.IsRunning {
-		if len(m.Measurements) == 0 {
-			return Measurement{}, nil
-		}
-		return m.Measurements[len(m.Measurements)-1], nil
+// SaveHistory writes the measurement history to the file, if it has changed
+// since it was last saved.  The file is written without holding up the readers.
+func (m *SoilMonitor) SaveHistory() error {
+	m.saveLock.Lock()
+	defer m.saveLock.Unlock()
+
+	m.lock.Lock()
+	if m.HistoryPath == "" || m.unsaved == 0 {
+		m.lock.Unlock()
+		return nil
 	}
-	m.IsRunning = true
-	defer m.setStopped()
+	path := m.HistoryPath
+	h := MeasurementHistory{Measurements: append([]Measurement{}, m.history.Measurements...)}
+	n := m.unsaved
+	m.unsaved = 0
+	m.lock.Unlock()
 
+	err := h.WriteToFile(path)
+	if err != nil {
+		m.logError("Error saving the measurement history.", "error", err)
+		// Try again with the next save
+		m.lock.Lock()
+		m.unsaved = m.unsaved + n
+		m.lock.Unlock()
+	}
+	return err
+}
+
+// setSensor records the state of the sensor.  err is the error reading the sensor, if it is present.
+func (m *SoilMonitor) setSensor(name string, present bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.sensors == nil {
+		m.sensors = map[string]*SensorStatus{}
+	}
+	st, ok := m.sensors[name]
+	if !ok {
+		st = &SensorStatus{Name: name}
+		m.sensors[name] = st
+	}
+	st.Present = present
+	st.Reading = present && err == nil
+	st.LastChecked = time.Now()
+	st.Error = ""
+	switch {
+	case !present:
+		st.Error = "sensor was not found"
+	case err != nil:
+		st.Error = err.Error()
+	default:
+		st.LastSuccess = st.LastChecked
+	}
+}
+
+// setThingspeak records the result of sending the measurement to Thingspeak.
+func (m *SoilMonitor) setThingspeak(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.thingspeak.LastAttempt = time.Now()
+	m.thingspeak.Error = ""
+	if err != nil {
+		m.thingspeak.Error = err.Error()
+	} else {
+		m.thingspeak.LastSuccess = m.thingspeak.LastAttempt
+	}
+}
+
+// context returns the monitor context, which is cancelled when the monitor is closed.
+func (m *SoilMonitor) context() context.Context {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.ctx == nil {
+		m.ctx, m.cancel = context.WithCancel(context.Background())
+	}
+	return m.ctx
+}
+
+// readProbes powers up the probes and reads the values from them.
+func (m *SoilMonitor) readProbes(ctx context.Context) (Measurement, error) {
 	m.logDebug("Reading measurements.")
+	c := m.Srv.Config()
 
 	v := Measurement{
 		DateMeasured: time.Now(),
@@ -94,12 +369,16 @@ func (m *SoilMonitor) MeasureValues() (Measurement, error) {
 	defer pwr.Close()
 	if err := pwr.On(); err != nil {
 		msg := "Error turning on power. " + err.Error() + "."
-		m.logError(msg)
+		m.logError("Error turning on power.", "error", err)
 		return v, errors.New(msg)
 	}
 
 	// wait 2 secs to let everthing stabilize
-	time.Sleep(2 * time.Second)
+	select {
+	case <-time.After(2 * time.Second):
+	case <-ctx.Done():
+		return v, ctx.Err()
+	}
 
 	errLst := []string{}
 
@@ -108,101 +387,76 @@ func (m *SoilMonitor) MeasureValues() (Measurement, error) {
 	devlst, err := gopitools.GetDeviceList()
 	if err != nil {
 		msg := "Error getting one-wire device list. " + err.Error() + "."
-		m.logError(msg)
+		m.logError("Error getting one-wire device list.", "error", err)
 		errLst = append(errLst, msg)
 	}
 
 	// Read the Air Temperature
 	airTemp := gopitools.OneWireTemp{}
 	defer airTemp.Close()
-	airTemp.ID = m.Srv.Config.AirTempID
+	airTemp.ID = c.AirTempID
 	if !airTemp.IsInDevices(devlst) {
+		m.setSensor("airTemp", false, nil)
 		m.Srv.LCD.SetItem("AIRTEMP", "AirTemp", "No Cable")
-		msg := "No air temperature device '" + airTemp.ID + "' found. Cable could be disconnected."
-		m.logError(msg)
+		m.logError("No air temperature device found. Cable could be disconnected.", "device", airTemp.ID)
+		v.Missing = append(v.Missing, "airTemp")
 	} else {
 		m.logDebug("Reading air temperature from ", airTemp.ID)
-		temp, err := airTemp.ReadTemp()
+		vals, err := m.readSensor(ctx, &v, "airTemp", readOneWireTemp(airTemp.ID))
+		m.setSensor("airTemp", true, err)
 		if err != nil {
 			m.Srv.LCD.SetItem("AIRTEMP", "AirTemp", "Err")
 			msg := "Error reading air temperature. " + err.Error() + "."
-			m.logError(msg)
+			m.logError("Error reading air temperature.", "error", err)
 			errLst = append(errLst, msg)
 		} else {
-			if temp == 999999 {
-				m.Srv.LCD.SetItem("AIRTEMP", "AirTemp", "Err")
-				msg := "Error reading air temperature."
-				m.logError(msg)
-				errLst = append(errLst, msg)
-			} else {
-				m.Srv.LCD.SetItem("AIRTEMP", "AirTemp", fmt.Sprintf("%f", temp))
-				v.AirTemp = temp
-			}
+			m.Srv.LCD.SetItem("AIRTEMP", "AirTemp", fmt.Sprintf("%f", vals[0]))
+			v.AirTemp = vals[0]
 		}
 	}
 
 	// Read the soil temperature
 	soilTemp := gopitools.OneWireTemp{}
 	defer soilTemp.Close()
-	soilTemp.ID = m.Srv.Config.SoilTempID
-	if !airTemp.IsInDevices(devlst) {
+	soilTemp.ID = c.SoilTempID
+	if !soilTemp.IsInDevices(devlst) {
+		m.setSensor("soilTemp", false, nil)
 		m.Srv.LCD.SetItem("SOILTEMP", "SoilTemp", "No Cable")
-		msg := "No soil temperature device '" + airTemp.ID + "' found. Cable could be disconnected."
-		m.logError(msg)
+		m.logError("No soil temperature device found. Cable could be disconnected.", "device", soilTemp.ID)
+		v.Missing = append(v.Missing, "soilTemp")
 	} else {
-		m.logDebug("Reading soil temperature from ", airTemp.ID)
-		temp, err := soilTemp.ReadTemp()
+		m.logDebug("Reading soil temperature from ", soilTemp.ID)
+		vals, err := m.readSensor(ctx, &v, "soilTemp", readOneWireTemp(soilTemp.ID))
+		m.setSensor("soilTemp", true, err)
 		if err != nil {
 			m.Srv.LCD.SetItem("SOILTEMP", "SoilTemp", "Err")
 			msg := "Error reading soil temperature. " + err.Error() + "."
-			m.logError(msg)
+			m.logError("Error reading soil temperature.", "error", err)
 			errLst = append(errLst, msg)
 		} else {
-			if temp == 999999 {
-				m.Srv.LCD.SetItem("SOILTEMP", "SoilTemp", "Err")
-				msg := "Error reading soil temperature."
-				m.logError(msg)
-				errLst = append(errLst, msg)
-			} else {
-				m.Srv.LCD.SetItem("SOILTEMP", "SoilTemp", fmt.Sprintf("%f", temp))
-				v.SoilTemp = temp
-			}
+			m.Srv.LCD.SetItem("SOILTEMP", "SoilTemp", fmt.Sprintf("%f", vals[0]))
+			v.SoilTemp = vals[0]
 		}
 	}
 
 	// Read ambient light and moisture content
 	m.logDebug("Reading Light and Moisture values")
-	out, err := exec.Command("python", "mcp3008.py").CombinedOutput()
+	vals, err := m.readSensor(ctx, &v, "mcp3008", m.readMcp3008)
+	m.setSensor("mcp3008", true, err)
 	if err != nil {
 		msg := "Failed to get light and moisture content values. " + err.Error() + "."
-		m.logError(msg)
+		m.logError("Failed to get light and moisture content values.", "error", err)
 		errLst = append(errLst, msg)
 		m.Srv.LCD.SetItem("LIGHT", "Light", "Err")
 		m.Srv.LCD.SetItem("MOISTURE", "Moisture", "Err")
 	} else {
-		outStr := strings.TrimSpace(string(out))
-		m.logDebug("Values returned =", outStr)
-		mcpVals := strings.Split(outStr, ",")
+		v.Light = 100 - (vals[0] * 100)
+		v.Lux = LightToLux(c.LightCurve, v.Light)
+		v.Ppfd = v.Lux * c.PpfdFactor
+		m.Srv.LCD.SetItem("LIGHT", "Light", fmt.Sprintf("%f", v.Light))
 
-		if f, err := strconv.ParseFloat(mcpVals[0], 64); err != nil {
-			msg := "Failed to get light value. " + err.Error() + "."
-			m.logError(msg)
-			errLst = append(errLst, msg)
-			m.Srv.LCD.SetItem("LIGHT", "Light", "Err")
-		} else {
-			v.Light = 100 - (f * 100)
-			m.Srv.LCD.SetItem("LIGHT", "Light", fmt.Sprintf("%f", v.Light))
-		}
-
-		if f, err := strconv.ParseFloat(mcpVals[1], 64); err != nil {
-			msg := "Failed to get moisture content value. " + err.Error() + "."
-			m.logError(msg)
-			errLst = append(errLst, msg)
-			m.Srv.LCD.SetItem("MOISTURE", "Moisture", "Err")
-		} else {
-			v.Moisture = f * 100
-			m.Srv.LCD.SetItem("MOISTURE", "Moisture", fmt.Sprintf("%f", v.Moisture))
-		}
+		v.Moisture = vals[1] * 100
+		m.Srv.LCD.SetItem("MOISTURE", "Moisture", fmt.Sprintf("%f", v.Moisture))
 	}
 
 	// Switch off the power to the soil components
@@ -210,12 +464,26 @@ func (m *SoilMonitor) MeasureValues() (Measurement, error) {
 	err = pwr.Off()
 	if err != nil {
 		msg := "Error turning off power. " + err.Error() + "."
-		m.logError(msg)
+		m.logError("Error turning off power.", "error", err)
 		errLst = append(errLst, msg)
 	}
 
 	if len(errLst) == 0 {
 		v.Success = true
+
+		// Evaluate the values against the plant profiles assigned to the probes
+		p := c.ProfileFor(SoilProbe)
+		p.EvaluateSoil(&v)
+		ap := c.ProfileFor(AirProbe)
+		ap.EvaluateAir(&v)
+		if m.Srv.Light != nil {
+			if d, ok := m.Srv.Light.LastDay(); ok {
+				lp := c.ProfileFor(LightProbe)
+				lp.EvaluateLight(&v, d.Dli)
+			}
+		}
+		m.Srv.LCD.SetItem("STATUS", p.Name, strings.ToUpper(v.Status))
+
 		return v, nil
 	}
 
@@ -229,38 +497,118 @@ func (m *SoilMonitor) MeasureValues() (Measurement, error) {
 	return v, errors.New(msg)
 }
 
-func (m *SoilMonitor) setStopped() {
-	m.IsRunning = false
+// readOneWireTemp returns a read of the 1-wire temperature sensor with the ID.
+func readOneWireTemp(id string) sensorRead {
+	return func(ctx context.Context) ([]float64, error) {
+		t := gopitools.OneWireTemp{ID: id}
+		defer t.Close()
+		temp, err := t.ReadTemp()
+		if err != nil {
+			return nil, err
+		}
+		if temp == 999999 {
+			return nil, newTransientError("sensor returned an invalid reading")
+		}
+		return []float64{temp}, nil
+	}
+}
+
+// readMcp3008 reads the light and moisture channels of the MCP3008 ADC.
+// The script is killed if the context is cancelled.
+func (m *SoilMonitor) readMcp3008(ctx context.Context) ([]float64, error) {
+	out, err := exec.CommandContext(ctx, "python", "mcp3008.py").CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+	outStr := strings.TrimSpace(string(out))
+	m.logDebug("Values returned =", outStr)
+	mcpVals := strings.Split(outStr, ",")
+	if len(mcpVals) < 2 {
+		return nil, newTransientError("unexpected values '" + outStr + "' returned")
+	}
+
+	vals := []float64{}
+	for i, n := range []string{"light", "moisture content"} {
+		f, err := strconv.ParseFloat(strings.TrimSpace(mcpVals[i]), 64)
+		if err != nil {
+			return nil, newTransientError("failed to get " + n + " value. " + err.Error())
+		}
+		vals = append(vals, f)
+	}
+	return vals, nil
+}
+
+// sendThingspeakUpdate sends the measurement to Thingspeak.  If an update or a
+// connection test was sent just before, it first waits until Thingspeak accepts
+// another update.
+func (m *SoilMonitor) sendThingspeakUpdate(ctx context.Context, v Measurement) error {
+	m.thingspeakLock.Lock()
+	defer m.thingspeakLock.Unlock()
+
+	if d := m.thingspeakWait(); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	err := m.sendToThingspeak(v)
+	m.thingspeakLast = time.Now()
+	return err
+}
+
+// TestThingspeak runs the Thingspeak connection test.  The test is refused if an
+// update or another test was sent less than the update interval ago, as Thingspeak
+// would reject it, and the time to wait before trying again is returned instead.
+func (m *SoilMonitor) TestThingspeak(s ConnectionSettings) (ConnectionTest, time.Duration) {
+	m.thingspeakLock.Lock()
+	defer m.thingspeakLock.Unlock()
+
+	if d := m.thingspeakWait(); d > 0 {
+		return ConnectionTest{}, d
+	}
+	t := CheckThingspeak(s)
+	m.thingspeakLast = time.Now()
+	return t, 0
+}
+
+// thingspeakWait returns the time until Thingspeak accepts another update.
+// The Thingspeak lock must be held.
+func (m *SoilMonitor) thingspeakWait() time.Duration {
+	return thingspeakUpdateInterval - time.Since(m.thingspeakLast)
 }
 
 func (m *SoilMonitor) sendToThingspeak(v Measurement) error {
-	key := m.Srv.Config.ThingspeakID
+	key := string(m.Srv.Config().ThingspeakID)
 	if key == "" {
 		return errors.New("Thingspeak API ID has not been configured")
 	}
 
 	client := http.Client{}
-	url := fmt.Sprintf("https://api.thingspeak.com/update?api_key=%s&field1=%.1f&field2=%.1f&field3=%.1f", key, v.SoilTemp, v.Light, v.Moisture)
+	url := fmt.Sprintf("%s/update?api_key=%s&field2=%.1f&field3=%.1f", thingspeakURL, key, v.Light, v.Moisture)
+	if v.Has("soilTemp") {
+		url = url + fmt.Sprintf("&field1=%.1f", v.SoilTemp)
+	}
 	_, err := client.Get(url)
 	if err != nil {
-		return err
+		// The error holds the url, so remove the key before it is logged
+		return errors.New(strings.Replace(err.Error(), key, secretMask, -1))
 	}
 	return nil
 }
 
 func (m *SoilMonitor) logDebug(v ...interface{}) {
-	if m.Srv.VerboseLogging {
-		a := fmt.Sprint(v...)
-		logger.Info("SoilMonitor: ", a)
-	}
+	a := fmt.Sprint(v...)
+	logEntry("SoilMonitor", LevelDebug, a)
 }
 
 func (m *SoilMonitor) logInfo(v ...interface{}) {
 	a := fmt.Sprint(v...)
-	logger.Info("SoilMonitor: ", a)
+	logEntry("SoilMonitor", LevelInfo, a)
 }
 
-func (m *SoilMonitor) logError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Error("SoilMonitor: ", a)
+func (m *SoilMonitor) logError(msg string, kv ...interface{}) {
+	logEntry("SoilMonitor", LevelError, msg, kv...)
 }
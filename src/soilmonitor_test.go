@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCanMeasureValues(t *testing.T) {
-	m := SoilMonitor{}
-	v, err := m.MeasureValues()
+	s := newTestServer(&Config{})
+	s.LCD = &Display{write: (&displayRecorder{}).write}
+	m := &s.Monitor
+	v, err := m.MeasureValues(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -17,3 +23,111 @@ func TestCanMeasureValues(t *testing.T) {
 		t.Error("Air temperature is 0")
 	}
 }
+
+func TestConcurrentMeasurementsAreCoalesced(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	m := SoilMonitor{}
+	m.acquire = func(ctx context.Context) (Measurement, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return Measurement{Success: true, Moisture: 42}, nil
+	}
+
+	var wg sync.WaitGroup
+	res := make([]Measurement, 10)
+	for i := range res {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := m.MeasureValues(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			res[i] = v
+		}(i)
+	}
+	// Wait for the measurement to start before releasing it
+	for !m.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("Expected the probes to be read once but were read", n, "times")
+	}
+	for _, v := range res {
+		if v.Moisture != 42 {
+			t.Error("Expected the shared measurement but got", v)
+		}
+	}
+	if m.IsRunning() {
+		t.Error("Monitor should not be running")
+	}
+}
+
+func TestMeasureValuesStopsWaitingWhenCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	m := SoilMonitor{}
+	m.acquire = func(ctx context.Context) (Measurement, error) {
+		<-release
+		return Measurement{Success: true}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.MeasureValues(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected the deadline to be exceeded but got", err)
+	}
+	if !m.IsRunning() {
+		t.Error("Measurement should carry on for the other callers")
+	}
+}
+
+func TestCloseCancelsMeasurement(t *testing.T) {
+	m := SoilMonitor{}
+	m.acquire = func(ctx context.Context) (Measurement, error) {
+		<-ctx.Done()
+		return Measurement{}, ctx.Err()
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.Close()
+	}()
+	if _, err := m.MeasureValues(context.Background()); err != context.Canceled {
+		t.Error("Expected the measurement to be cancelled but got", err)
+	}
+}
+
+func TestWaitCoversEveryMeasurement(t *testing.T) {
+	release := make(chan struct{})
+	m := SoilMonitor{}
+	m.acquire = func(ctx context.Context) (Measurement, error) {
+		<-release
+		return Measurement{Success: true}, nil
+	}
+	if err := m.Wait(context.Background()); err != nil {
+		t.Error("Wait should return at once when idle but got", err)
+	}
+
+	// A measurement started from the web is not known to the scheduler
+	go m.MeasureValues(context.Background())
+	for !m.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected the wait to time out but got", err)
+	}
+	close(release)
+	if err := m.Wait(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if m.IsRunning() {
+		t.Error("Monitor should not be running")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// StreamController handles the live stream of events, offered as both
+// Server-Sent Events and a WebSocket.
+type StreamController struct {
+	Srv      *Server
+	upgrader websocket.Upgrader
+}
+
+// AddController adds the controller routes to the router
+func (c *StreamController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	c.upgrader = websocket.Upgrader{ReadBufferSize: 512, WriteBufferSize: 4096}
+	router.Methods("GET").Path("/stream/events").Name("StreamEvents").
+		Handler(Logger(c, http.HandlerFunc(c.handleEvents)))
+	router.Methods("GET").Path("/stream/ws").Name("StreamWebSocket").
+		Handler(Logger(c, http.HandlerFunc(c.handleWebSocket)))
+}
+
+// handleEvents streams the events as Server-Sent Events.
+// The client resumes with the Last-Event-ID header, which browsers send when
+// they reconnect, or the lastEventId query value.  The types query value
+// limits the event types, e.g. types=measurement,alert.
+func (c *StreamController) handleEvents(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", 500)
+		return
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("lastEventId")
+	}
+	cl, missed, err := c.subscribe(w, last, r.URL.Query().Get("types"))
+	if err != nil {
+		return
+	}
+	defer c.Srv.Events.Unsubscribe(cl)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	for _, e := range missed {
+		if e.WriteSSE(w) != nil {
+			return
+		}
+	}
+	fl.Flush()
+
+	hb := time.NewTicker(c.Srv.Events.heartbeatInterval())
+	defer hb.Stop()
+	for {
+		var e Event
+		select {
+		case <-r.Context().Done():
+			return
+		case <-hb.C:
+			e = newHeartbeat()
+		case x, ok := <-cl.C:
+			if !ok {
+				return
+			}
+			e = x
+		}
+		if e.WriteSSE(w) != nil {
+			return
+		}
+		fl.Flush()
+	}
+}
+
+// handleWebSocket streams the events over a WebSocket as JSON messages.
+// Resuming and the event types work the same way as for Server-Sent Events.
+func (c *StreamController) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	cl, missed, err := c.subscribe(w, r.URL.Query().Get("lastEventId"), r.URL.Query().Get("types"))
+	if err != nil {
+		return
+	}
+	defer c.Srv.Events.Unsubscribe(cl)
+
+	ws, err := c.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		c.LogError("Error upgrading to a WebSocket. ", err.Error())
+		return
+	}
+	defer ws.Close()
+
+	// Read the messages from the client so that a close is noticed.  The client is not expected to send anything else.
+	ws.SetReadLimit(512)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e Event) bool {
+		ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return ws.WriteJSON(e) == nil
+	}
+	for _, e := range missed {
+		if !send(e) {
+			return
+		}
+	}
+
+	hb := time.NewTicker(c.Srv.Events.heartbeatInterval())
+	defer hb.Stop()
+	for {
+		var e Event
+		select {
+		case <-gone:
+			return
+		case <-hb.C:
+			e = newHeartbeat()
+		case x, ok := <-cl.C:
+			if !ok {
+				ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+				return
+			}
+			e = x
+		}
+		if !send(e) {
+			return
+		}
+	}
+}
+
+// subscribe connects the client to the event hub, writing the error response if it cannot.
+func (c *StreamController) subscribe(w http.ResponseWriter, last string, types string) (*EventClient, []Event, error) {
+	var id uint64
+	if last != "" {
+		n, err := strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			http.Error(w, "Last event ID must be a number.", 400)
+			return nil, nil, err
+		}
+		id = n
+	}
+	tl := []string{}
+	if types != "" {
+		tl = strings.Split(types, ",")
+	}
+	cl, missed, err := c.Srv.Events.Subscribe(id, tl)
+	if err == ErrTooManyClients {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many stream clients are connected. Try again later.", 503)
+		return nil, nil, err
+	}
+	if err != nil {
+		http.Error(w, "Error connecting to the stream. "+err.Error(), 500)
+	}
+	return cl, missed, err
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *StreamController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("StreamController", LevelInfo, a)
+}
+
+// LogError is used to log error messages for this controller.
+func (c *StreamController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logEntry("StreamController", LevelError, a)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow holds a daily window of time, e.g. 06:00-09:00.
+// A window where the end is before the start crosses midnight.
+type TimeWindow struct {
+	Start int // Start of the window, in minutes after midnight
+	End   int // End of the window, in minutes after midnight
+}
+
+// ParseTimeWindows parses a comma separated list of time windows in the
+// form "HH:MM-HH:MM".
+func ParseTimeWindows(s string) ([]TimeWindow, error) {
+	l := []TimeWindow{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		se := strings.Split(p, "-")
+		if len(se) != 2 {
+			return l, errors.New("time window '" + p + "' must be in the form 'HH:MM-HH:MM'")
+		}
+		st, err := parseTimeOfDay(se[0])
+		if err != nil {
+			return l, err
+		}
+		en, err := parseTimeOfDay(se[1])
+		if err != nil {
+			return l, err
+		}
+		l = append(l, TimeWindow{Start: st, End: en})
+	}
+	return l, nil
+}
+
+// IsInTimeWindows returns whether the time falls in any of the windows.
+// An empty list of windows will always return true.
+func IsInTimeWindows(l []TimeWindow, t time.Time) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, w := range l {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns whether the time of day falls in the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start <= w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+// String returns the window in the form "HH:MM-HH:MM".
+func (w TimeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// parseTimeOfDay parses a "HH:MM" time and returns the minutes after midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, errors.New("invalid time of day '" + s + "'")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
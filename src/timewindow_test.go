@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowCanCrossMidnight(t *testing.T) {
+	l, err := ParseTimeWindows("06:00-09:00, 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 2 {
+		t.Fatal("Expected 2 windows but got", len(l))
+	}
+	d := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	for _, x := range []struct {
+		h, m int
+		in   bool
+	}{{5, 59, false}, {6, 0, true}, {8, 59, true}, {9, 0, false}, {23, 0, true}, {1, 30, true}, {2, 0, false}} {
+		if IsInTimeWindows(l, d.Add(time.Duration(x.h)*time.Hour+time.Duration(x.m)*time.Minute)) != x.in {
+			t.Errorf("%02d:%02d should be %v", x.h, x.m, x.in)
+		}
+	}
+}
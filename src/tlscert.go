@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	selfSignedCertFile = "cert.pem" // File holding the generated self-signed certificate
+	selfSignedKeyFile  = "key.pem"  // File holding the key of the generated self-signed certificate
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+// LoadSelfSignedCertificate loads the self-signed certificate from the files.
+// A new certificate is generated and saved if the files do not exist, the
+// certificate expires within 30 days, or it does not cover all of the hosts.
+// Returns whether a new certificate was generated.
+func LoadSelfSignedCertificate(certFile string, keyFile string, hosts []string) (tls.Certificate, bool, error) {
+	if c, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(c.Certificate[0]); err == nil {
+			if time.Now().Add(30*24*time.Hour).Before(leaf.NotAfter) && certCoversHosts(leaf, hosts) {
+				return c, false, nil
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, false, err
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(hosts)
+	if err != nil {
+		return tls.Certificate{}, false, err
+	}
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, false, err
+	}
+	if err := writeFileAtomic(certFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, false, err
+	}
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	return c, true, err
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the certificate in hex,
+// as shown by web browsers.
+func CertFingerprint(c tls.Certificate) string {
+	if len(c.Certificate) == 0 {
+		return ""
+	}
+	h := sha256.Sum256(c.Certificate[0])
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+// DeviceHosts returns the host name and IP addresses that the device can be reached on.
+func DeviceHosts() []string {
+	l := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		l = append(l, h)
+		if !strings.Contains(h, ".") {
+			l = append(l, h+".local")
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLinkLocalUnicast() {
+				l = append(l, n.IP.String())
+			}
+		}
+	}
+	return l
+}
+
+// RedirectToHTTPS returns a handler that redirects the requests to the HTTPS port.
+func RedirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != 443 {
+			host = host + ":" + strconv.Itoa(port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// generateSelfSigned generates a self-signed certificate for the hosts and returns
+// the certificate and key in PEM form.
+func generateSelfSigned(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	name := "SoilMonitor"
+	if len(hosts) > 1 {
+		name = hosts[1]
+	}
+	t := x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"Soil Monitor"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			t.IPAddresses = append(t.IPAddresses, ip)
+		} else {
+			t.DNSNames = append(t.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &t, &t, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), nil
+}
+
+// certCoversHosts returns whether the certificate is valid for all of the hosts.
+func certCoversHosts(c *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if c.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCertificate loads the TLS certificate for the web server.  The provided
+// certificate is used if there is one, otherwise a self-signed certificate is used.
+func (s *Server) loadCertificate() (tls.Certificate, error) {
+	if s.CertFile != "" || s.KeyFile != "" {
+		if s.CertFile == "" || s.KeyFile == "" {
+			return tls.Certificate{}, errors.New("both the certificate and key files must be specified")
+		}
+		return tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	}
+	c, created, err := LoadSelfSignedCertificate(selfSignedCertFile, selfSignedKeyFile, DeviceHosts())
+	if created {
+		s.logInfo("Generated a new self-signed certificate.")
+	}
+	return c, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cf := filepath.Join(dir, "cert.pem")
+	kf := filepath.Join(dir, "key.pem")
+	hosts := []string{"localhost", "soilmonitor", "192.168.1.20"}
+
+	c, created, err := LoadSelfSignedCertificate(cf, kf, hosts)
+	if err != nil || !created {
+		t.Fatal("Expected a new certificate.", err)
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hosts {
+		if err := leaf.VerifyHostname(h); err != nil {
+			t.Error(err)
+		}
+	}
+	if fi, err := os.Stat(kf); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("Expected the key to only be readable by the owner")
+	}
+
+	// The certificate is persisted
+	c2, created, err := LoadSelfSignedCertificate(cf, kf, hosts)
+	if err != nil || created {
+		t.Fatal("Expected the saved certificate.", err)
+	}
+	fp := CertFingerprint(c)
+	if len(fp) != 64 || CertFingerprint(c2) != fp {
+		t.Error("Expected the same fingerprint but got", fp, CertFingerprint(c2))
+	}
+
+	// A new address needs a new certificate
+	c3, created, err := LoadSelfSignedCertificate(cf, kf, append(hosts, "10.0.0.5"))
+	if err != nil || !created || CertFingerprint(c3) == fp {
+		t.Error("Expected a new certificate for the new address.", err)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, x := range []struct {
+		host string
+		port int
+		want string
+	}{
+		{"192.168.1.20:8080", 20510, "https://192.168.1.20:20510/config.html?a=1"},
+		{"soilmonitor", 443, "https://soilmonitor/config.html?a=1"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/config.html?a=1", nil)
+		r.Host = x.host
+		RedirectToHTTPS(x.port).ServeHTTP(w, r)
+		if w.Code != 301 || w.Header().Get("Location") != x.want {
+			t.Error("Expected a redirect to", x.want, "but got", w.Code, w.Header().Get("Location"))
+		}
+	}
+}